@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var linksCmd = &cobra.Command{
+	Use:   "links",
+	Short: "show signaler links health of the running xhe",
+	Long:  `show whether each signaler link of the running xhe is subscribed, through the control socket`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var ierr error
+		defer then(&ierr, nil, func() {
+			slog.Error("list links failed", "err", ierr)
+			os.Exit(1)
+		})
+		links, ierr := newCtlClient().Links()
+		if ierr != nil {
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "LINK\tSTATE\tSINCE\tFAILURES\tERROR")
+		for _, l := range links {
+			state := "down"
+			switch {
+			case l.Connected:
+				state = "up"
+			case l.Locked:
+				state = "locked"
+			}
+			lastErr := l.LastError
+			if lastErr == "" {
+				lastErr = "-"
+			}
+			since := time.Since(l.Since).Truncate(time.Second).String() + " ago"
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", l.Link, state, since, l.Failures, lastErr)
+		}
+		ierr = w.Flush()
+		if ierr != nil {
+			return
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(linksCmd)
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"remoon.net/xhe/pkg/signaler"
+	"remoon.net/xhe/pkg/vtun"
+	"remoon.net/xhe/pkg/xhe"
+	"remoon.net/xhe/pkg/xhe/tun"
+)
+
+// pairCmd 在没有 signaler 服务器时, 通过手动复制粘贴 offer 和 answer 建立连接
+var pairCmd = &cobra.Command{
+	Use:   "pair -k {private_key} {peer_pubkey}",
+	Short: "connect to a peer by copy-pasting offer and answer",
+	Long: `connect to a peer without any signaler server.
+the offer is printed as a compact blob (or a qr code with --qr), send it to the peer through any chat window,
+the peer runs "xhe pair --answer" and pastes it, then paste the answer printed by the peer back here`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var ierr error
+		defer then(&ierr, nil, func() {
+			slog.Error("pair broken", "err", ierr)
+			os.Exit(1)
+		})
+
+		f := cmd.Flags()
+		var logLevel slog.Level
+		lv, _ := f.GetString("log")
+		if err := json.Unmarshal(strconv.AppendQuote(nil, lv), &logLevel); err == nil {
+			h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+			slog.SetDefault(slog.New(h))
+		}
+
+		key, _ := f.GetString("key")
+		if key == "" {
+			key = viper.GetString("key")
+		}
+		answer, _ := f.GetBool("answer")
+		mtu, _ := f.GetInt("mtu")
+
+		// 提示和 blob 输出到 stderr, 不和日志混在 stdout 里
+		pair := signaler.NewPair(os.Stdin, os.Stderr)
+		pair.Answer = answer
+		pair.QR, _ = f.GetBool("qr")
+
+		link := "pair://" + args[0] + "?keepalive=15"
+		if answer {
+			// 应答方不主动发起, 只等对方的 offer
+			link = "peer://" + args[0]
+		}
+		cfg := xhe.Config{
+			PrivateKey: key,
+			Peers:      []string{link},
+			LogLevel:   logLevel,
+			MTU:        mtu,
+			Channel:    pair,
+		}
+
+		tunName := viper.GetString("tun")
+		if vtunMode, _ := f.GetBool("vtun"); vtunMode {
+			cfg.GoTun, ierr = vtun.CreateTUN(tunName, cfg.MTU)
+		} else {
+			cfg.GoTun, ierr = tun.CreateTUN(tunName, cfg.MTU)
+		}
+		if ierr != nil {
+			return
+		}
+
+		dev, ierr := xhe.Run(cfg)
+		if ierr != nil {
+			return
+		}
+		defer dev.Close()
+
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-term:
+		case <-dev.Wait():
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pairCmd)
+
+	// 不绑定到 viper, 避免覆盖 xhe 本身的同名参数
+	f := pairCmd.Flags()
+	f.StringP("key", "k", "", "WireGuard private key. generate by wg genkey")
+	f.Bool("answer", false, "wait for the offer of the peer and reply the answer")
+	f.Bool("qr", false, "also print offer and answer as qr code")
+	f.Bool("vtun", false, "vtun mode don't require root")
+	f.Int("mtu", defaultMTU, "mtu")
+	f.String("log", "info", "log level. debug, info, warn, error")
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"remoon.net/xhe/pkg/xhe/ctl"
+	"remoon.net/xhe/pkg/xhe/ipc"
+)
+
+// peerCmd represents the peer command
+var peerCmd = &cobra.Command{
+	Use:   "peer",
+	Short: "manage peers of the running xhe",
+	Long:  `manage peers of the running xhe through the control socket`,
+}
+
+var peerAddCmd = &cobra.Command{
+	Use:   "add {peer_link}",
+	Short: "add peer",
+	Long:  `add peer, the link is resolved by the running xhe`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var ierr error
+		defer then(&ierr, nil, func() {
+			slog.Error("add peer failed", "err", ierr)
+			os.Exit(1)
+		})
+		link := args[0]
+		peer, ierr := newCtlClient().AddPeer(link)
+		if ierr != nil {
+			return
+		}
+		fmt.Println(peer.PublicKey)
+		if !viper.GetBool("save") {
+			return
+		}
+		ierr = savePeers(func(links []string) []string {
+			if slices.Contains(links, link) {
+				return links
+			}
+			return append(links, link)
+		})
+		if ierr != nil {
+			return
+		}
+	},
+}
+
+var peerRemoveCmd = &cobra.Command{
+	Use:     "remove {pubkey|peer_link}",
+	Aliases: []string{"rm"},
+	Short:   "remove peer",
+	Long:    `remove peer`,
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var ierr error
+		defer then(&ierr, nil, func() {
+			slog.Error("remove peer failed", "err", ierr)
+			os.Exit(1)
+		})
+		peer, ierr := newCtlClient().RemovePeer(args[0])
+		if ierr != nil {
+			return
+		}
+		fmt.Println(peer.PublicKey)
+		if !viper.GetBool("save") {
+			return
+		}
+		ierr = savePeers(func(links []string) []string {
+			return slices.DeleteFunc(links, func(link string) bool {
+				return link == args[0] || link == peer.Link
+			})
+		})
+		if ierr != nil {
+			return
+		}
+	},
+}
+
+var peerListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "list peers",
+	Long:    `list peers`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var ierr error
+		defer then(&ierr, nil, func() {
+			slog.Error("list peers failed", "err", ierr)
+			os.Exit(1)
+		})
+		peers, ierr := newCtlClient().Peers()
+		if ierr != nil {
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PUBKEY\tLINK\tENDPOINT\tPATH\tSTATE\tFAILURES\tRX\tTX\tHANDSHAKE\tLAST ERROR")
+		for _, p := range peers {
+			handshake := "-"
+			if !p.LastHandshake.IsZero() {
+				handshake = time.Since(p.LastHandshake).Truncate(time.Second).String() + " ago"
+			}
+			state := p.State
+			if state == "" {
+				state = "-"
+			}
+			path := p.Path
+			if path == "" {
+				path = "-"
+			}
+			lastError := p.LastError
+			if lastError == "" {
+				lastError = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n", p.PublicKey, p.Link, p.Endpoint, path, state, p.Failures, p.RxBytes, p.TxBytes, handshake, lastError)
+		}
+		ierr = w.Flush()
+		if ierr != nil {
+			return
+		}
+	},
+}
+
+func newCtlClient() *ctl.Client {
+	path := getCtlPath()
+	return ctl.NewClient(func() (net.Conn, error) {
+		return ipc.CtlDial(path)
+	})
+}
+
+// savePeers 修改配置文件中的 peer 列表.
+// viper 会重写整个文件, 注释和 key 的顺序不会保留
+func savePeers(update func(links []string) []string) (ierr error) {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return fmt.Errorf("config file is not found, can't save peers")
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	ierr = v.ReadInConfig()
+	if ierr != nil {
+		return
+	}
+	v.Set("peer", update(v.GetStringSlice("peer")))
+	ierr = v.WriteConfig()
+	if ierr != nil {
+		return
+	}
+	return
+}
+
+func init() {
+	rootCmd.AddCommand(peerCmd)
+	peerCmd.AddCommand(peerAddCmd, peerRemoveCmd, peerListCmd)
+
+	pf := peerCmd.PersistentFlags()
+	pf.Bool("save", false, "save the change to config file, the file is rewritten and its comments and key order are lost")
+	viper.BindPFlag("save", pf.Lookup("save"))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -14,9 +15,12 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"remoon.net/xhe/pkg/metrics"
 	"remoon.net/xhe/pkg/vtun"
 	"remoon.net/xhe/pkg/xhe"
+	"remoon.net/xhe/pkg/xhe/ctl"
 	"remoon.net/xhe/pkg/xhe/ipc"
+	"remoon.net/xhe/pkg/xhe/resolve"
 	"remoon.net/xhe/pkg/xhe/tun"
 )
 
@@ -47,13 +51,29 @@ var rootCmd = &cobra.Command{
 
 		tunName := viper.GetString("tun")
 		cfg := xhe.Config{
-			PrivateKey: viper.GetString("key"),
-			DoH:        viper.GetString("doh"),
-			Port:       viper.GetUint16("port"),
-			Links:      viper.GetStringSlice("link"),
-			Peers:      viper.GetStringSlice("peer"),
-			LogLevel:   logLevel,
-			MTU:        viper.GetInt("mtu"),
+			PrivateKey:    viper.GetString("key"),
+			DoH:           viper.GetString("doh"),
+			Port:          viper.GetUint16("port"),
+			Links:         viper.GetStringSlice("link"),
+			Peers:         viper.GetStringSlice("peer"),
+			Allow:         viper.GetStringSlice("allow"),
+			AllowUnsigned: viper.GetBool("allow-unsigned"),
+			PlainSDP:      viper.GetBool("plain-sdp"),
+			SignMode:      viper.GetString("sign-mode"),
+			RequireLinks:  viper.GetInt("require-links"),
+			LAN:           viper.GetUint16("lan"),
+			Relay:         viper.GetUint16("relay"),
+			HA:            viper.GetBool("ha"),
+			Priority:      viper.GetInt("priority"),
+			LogLevel:      logLevel,
+			MTU:           viper.GetInt("mtu"),
+			HTTP: xhe.HTTPConfig{
+				Proxy: viper.GetString("proxy"),
+				CA:    viper.GetString("ca"),
+				Cert:  viper.GetString("cert"),
+				Key:   viper.GetString("cert-key"),
+				Pins:  viper.GetStringSlice("pin"),
+			},
 		}
 
 		vtunMode := viper.GetBool("vtun")
@@ -117,6 +137,83 @@ var rootCmd = &cobra.Command{
 			defer uapi.Close()
 		}
 
+		cl, ierr := func() (l net.Listener, ierr error) {
+			logger := slog.With("act", "control socket start")
+			path := getCtlPath()
+			if path == "" {
+				logger.
+					With("os", runtime.GOOS).
+					Warn("control socket is not supportted in this os")
+				return
+			}
+			logger.Debug("pending")
+			defer then(&ierr, func() {
+				logger.Debug("successful", "path", path)
+			}, nil)
+
+			l, ierr = ipc.CtlListen(path)
+			if ierr != nil {
+				return
+			}
+			go func() {
+				errs <- http.Serve(l, ctl.NewHandler(dev))
+			}()
+			return
+		}()
+		if ierr != nil {
+			return
+		}
+		if cl != nil {
+			defer cl.Close()
+		}
+
+		resolver, ierr := func() (r *resolve.Resolver, ierr error) {
+			domain := viper.GetString("dns-domain")
+			if domain == "" {
+				return
+			}
+			if vtunMode {
+				slog.Warn("vtun mode does not support dns integration")
+				return
+			}
+			return resolve.Start(dev, tunName, domain)
+		}()
+		if ierr != nil {
+			return
+		}
+		if resolver != nil {
+			defer resolver.Close()
+		}
+
+		ml, ierr := func() (l net.Listener, ierr error) {
+			addr := viper.GetString("metrics")
+			if addr == "" {
+				return
+			}
+			logger := slog.With("act", "metrics server start", "addr", addr)
+			logger.Debug("pending")
+			defer then(&ierr, func() {
+				logger.Info("successful")
+			}, nil)
+
+			l, ierr = net.Listen("tcp", addr)
+			if ierr != nil {
+				return
+			}
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			go func() {
+				errs <- http.Serve(l, mux)
+			}()
+			return
+		}()
+		if ierr != nil {
+			return
+		}
+		if ml != nil {
+			defer ml.Close()
+		}
+
 		l, ierr := func() (l net.Listener, ierr error) {
 			addr := getSocksListenAddr(viper.GetString("export"))
 			if addr == "" {
@@ -177,18 +274,38 @@ const defaultMTU = 2*1200 - 80
 func init() {
 	cobra.OnInitialize(initConfig)
 
+	pf := rootCmd.PersistentFlags()
+	pf.String("tun", "xhe", "tun name")
+	pf.String("ctl", "", "control socket path, default is derived from tun name")
+	viper.BindPFlags(pf)
+
 	f := rootCmd.Flags()
 
 	f.StringP("key", "k", "", "WireGuard private key. generate by wg genkey")
 	f.String("doh", "1.1.1.1", "DoH dns server. be used in cname link")
 	f.StringSliceP("link", "l", []string{}, "signaler server")
+	f.Int("require-links", 1, "how many signaler links must be connected at startup, others keep retrying in background. 0: start even if none is reachable, -1: all links")
 	f.StringSliceP("peer", "p", []string{}, "peer")
+	f.StringSlice("allow", []string{}, "extra pubkeys allowed to connect besides configured peers")
+	f.Bool("allow-unsigned", false, "accept offers without signature from old xhe versions")
+	f.Bool("plain-sdp", false, "don't encrypt offers, for peers of old xhe versions")
+	f.String("sign-mode", "compat", "how requests to signaler server are signed. compat: link params and v2 headers, v2: only v2 headers")
+	f.Uint16("lan", 0, "discover peers in the same lan by mdns and exchange offers on this port directly, all peers should use the same port. example: 9587")
+	f.Uint16("relay", 0, "relay offers for connected peers on this port inside the tunnel, and connect through them when signaler server is down. all peers should use the same port. example: 9588")
+	f.Bool("ha", false, "active/standby mode for two xhe with the same key. when signaler server answers 423 Locked, run as standby without routes and take over when the active one goes away")
+	f.Int("priority", 0, "takeover priority in --ha mode, 0-10. the standby with higher priority retries the lock sooner")
+	f.String("proxy", "", "proxy for signaler links and doh, http://, https:// or socks5://. default is HTTPS_PROXY / HTTP_PROXY env")
+	f.String("ca", "", "pem file of extra ca to trust for signaler links and doh, used with system ca")
+	f.String("cert", "", "pem file of client certificate for mtls to signaler links and doh")
+	f.String("cert-key", "", "pem file of the private key of --cert")
+	f.StringSlice("pin", []string{}, "base64(sha256(spki)) that must appear in the certificate chain, {host}={pin} only applies to this host. example: hub.example.com=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
 	f.StringSlice("ice", []string{}, "Todo. ice relay server support, NAT traversal")
 	f.Int("mtu", defaultMTU, "mtu")
-	f.Uint16("port", 0, "listen port")
+	f.Uint16("port", 0, "listen port, shared by ICE and direct udp WireGuard peers")
 	f.String("log", "info", "log level. debug, info, warn, error")
+	f.String("dns-domain", "", "register the domain for peer names to system dns, example: xhe. then peer can be accessed by {name}.xhe")
+	f.String("metrics", "", "expose prometheus metrics at http://{addr}/metrics, example: 127.0.0.1:9586")
 
-	f.String("tun", "xhe", "tun name")
 	f.Bool("vtun", false, "vtun mode don't require root")
 	f.String("export", "", "exprot socks5 server when run vtun mode, example: 1080, 127.0.0.1:1080")
 
@@ -223,6 +340,13 @@ func initConfig() {
 	}
 }
 
+func getCtlPath() string {
+	if p := viper.GetString("ctl"); p != "" {
+		return p
+	}
+	return ipc.CtlPath(viper.GetString("tun"))
+}
+
 func getSocksListenAddr(s string) string {
 	if s == "" {
 		return ""
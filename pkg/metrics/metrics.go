@@ -0,0 +1,131 @@
+// Package metrics 是一个精简的 Prometheus text exposition 实现
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Collector interface {
+	Name() string
+	Collect(w io.Writer)
+}
+
+type Registry struct {
+	locker     *sync.RWMutex
+	collectors map[string]Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		locker:     &sync.RWMutex{},
+		collectors: make(map[string]Collector),
+	}
+}
+
+var Default = NewRegistry()
+
+// Register 注册 Collector, 同名的会被替换
+func (r *Registry) Register(c Collector) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.collectors[c.Name()] = c
+}
+
+func (r *Registry) Unregister(name string) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	delete(r.collectors, name)
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.locker.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]Collector, 0, len(names))
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.locker.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.Collect(bw)
+	}
+	bw.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+func Handler() http.Handler { return Default.Handler() }
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d desc) Name() string { return d.name }
+
+func (d desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+func (d desc) writeSample(w io.Writer, suffix string, values []string, extra string, v float64) {
+	io.WriteString(w, d.name+suffix)
+	if len(values) > 0 || extra != "" {
+		io.WriteString(w, "{")
+		for i, l := range d.labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, l, escape(values[i]))
+		}
+		if extra != "" {
+			if len(values) > 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, extra)
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", formatFloat(v))
+}
+
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics %s: want %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string { return escaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
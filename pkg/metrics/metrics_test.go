@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+)
+
+func TestWriteTo(t *testing.T) {
+	Default = NewRegistry()
+	c := NewCounterVec("xhe_test_total", "test counter", "result")
+	c.Inc("ok")
+	c.Add(2, "ok")
+	c.Inc(`fa"il`)
+	h := NewHistogramVec("xhe_test_seconds", "test histogram", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	NewGaugeFunc("xhe_test_func", "test func", []string{"peer"}, func(emit func(v float64, values ...string)) {
+		emit(1, "a")
+	})
+
+	var b bytes.Buffer
+	Default.Write(&b)
+	assert.Equal(b.String(), `# HELP xhe_test_func test func
+# TYPE xhe_test_func gauge
+xhe_test_func{peer="a"} 1
+# HELP xhe_test_seconds test histogram
+# TYPE xhe_test_seconds histogram
+xhe_test_seconds_bucket{le="0.1"} 1
+xhe_test_seconds_bucket{le="1"} 2
+xhe_test_seconds_bucket{le="+Inf"} 3
+xhe_test_seconds_sum 5.55
+xhe_test_seconds_count 3
+# HELP xhe_test_total test counter
+# TYPE xhe_test_total counter
+xhe_test_total{result="fa\"il"} 1
+xhe_test_total{result="ok"} 3
+`)
+}
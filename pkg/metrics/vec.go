@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+type series struct {
+	values []string
+	value  float64
+
+	// histogram
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type vec struct {
+	desc
+	locker  *sync.Mutex
+	series  map[string]*series
+	buckets []float64
+}
+
+func newVec(d desc) *vec {
+	return &vec{
+		desc:   d,
+		locker: &sync.Mutex{},
+		series: make(map[string]*series),
+	}
+}
+
+func (v *vec) with(values []string, fn func(s *series)) {
+	k := v.key(values)
+	v.locker.Lock()
+	defer v.locker.Unlock()
+	s, ok := v.series[k]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if v.buckets != nil {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[k] = s
+	}
+	fn(s)
+}
+
+func (v *vec) Delete(values ...string) {
+	k := v.key(values)
+	v.locker.Lock()
+	defer v.locker.Unlock()
+	delete(v.series, k)
+}
+
+func (v *vec) sorted() []series {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]series, 0, len(keys))
+	for _, k := range keys {
+		s := *v.series[k]
+		s.counts = append([]uint64(nil), s.counts...)
+		list = append(list, s)
+	}
+	return list
+}
+
+func (v *vec) Collect(w io.Writer) {
+	list := v.sorted()
+	v.writeHeader(w)
+	for _, s := range list {
+		if v.buckets == nil {
+			v.writeSample(w, "", s.values, "", s.value)
+			continue
+		}
+		var acc uint64
+		for i, le := range v.buckets {
+			acc += s.counts[i]
+			v.writeSample(w, "_bucket", s.values, `le="`+formatFloat(le)+`"`, float64(acc))
+		}
+		v.writeSample(w, "_bucket", s.values, `le="+Inf"`, float64(s.count))
+		v.writeSample(w, "_sum", s.values, "", s.sum)
+		v.writeSample(w, "_count", s.values, "", float64(s.count))
+	}
+}
+
+type CounterVec struct{ *vec }
+
+// NewCounterVec 创建并注册到 Default
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(desc{name: name, help: help, typ: "counter", labels: labels})}
+	Default.Register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(values ...string) { c.Add(1, values...) }
+func (c *CounterVec) Add(d float64, values ...string) {
+	c.with(values, func(s *series) { s.value += d })
+}
+
+type GaugeVec struct{ *vec }
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(desc{name: name, help: help, typ: "gauge", labels: labels})}
+	Default.Register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.with(values, func(s *series) { s.value = v })
+}
+func (g *GaugeVec) Add(d float64, values ...string) {
+	g.with(values, func(s *series) { s.value += d })
+}
+
+type HistogramVec struct{ *vec }
+
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := newVec(desc{name: name, help: help, typ: "histogram", labels: labels})
+	v.buckets = buckets
+	h := &HistogramVec{v}
+	Default.Register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(x float64, values ...string) {
+	h.with(values, func(s *series) {
+		for i, le := range h.buckets {
+			if x <= le {
+				s.counts[i]++
+				break
+			}
+		}
+		s.sum += x
+		s.count++
+	})
+}
+
+// Func 在每次采集时调用 fn 生成数据, 适合从外部状态读取的指标.
+// 同名注册会替换之前的, 所以可以在每次启动时重新注册
+type Func struct {
+	desc
+	fn func(emit func(v float64, values ...string))
+}
+
+func NewGaugeFunc(name, help string, labels []string, fn func(emit func(v float64, values ...string))) *Func {
+	f := &Func{desc: desc{name: name, help: help, typ: "gauge", labels: labels}, fn: fn}
+	Default.Register(f)
+	return f
+}
+
+func NewCounterFunc(name, help string, labels []string, fn func(emit func(v float64, values ...string))) *Func {
+	f := &Func{desc: desc{name: name, help: help, typ: "counter", labels: labels}, fn: fn}
+	Default.Register(f)
+	return f
+}
+
+func (f *Func) Collect(w io.Writer) {
+	f.writeHeader(w)
+	f.fn(func(v float64, values ...string) {
+		f.key(values)
+		f.writeSample(w, "", values, "", v)
+	})
+}
+
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,98 @@
+package signaler
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 签名里的时间戳用本地时间, 设备时钟不准时 hub 会拒绝所有的订阅和握手.
+// 所以从 hub 响应的 Date 头学习时钟偏差, 之后发给这个 hub 的请求签名都加上这个偏差.
+// 每个 hub 分别记录, 偏差只用于给 hub 的请求签名.
+// 对方签名的 offer 和拒绝都用本地时间, hub 不能通过 Date 头让我们接受过期或者重放的 offer
+
+// maxClockSkew 小于这个偏差时不调整, Date 头只精确到秒
+const maxClockSkew = 10 * time.Second
+
+// clockOffsets 是每个 hub 的时钟偏差, key 是 hub 的 host
+type clockOffsets struct {
+	locker  *sync.Mutex
+	offsets map[string]time.Duration
+}
+
+func newClockOffsets() *clockOffsets {
+	return &clockOffsets{
+		locker:  &sync.Mutex{},
+		offsets: make(map[string]time.Duration),
+	}
+}
+
+func (c *clockOffsets) get(host string) time.Duration {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.offsets[host]
+}
+
+// now 返回按 host 的时间校正过的当前时间, 只用于给发往 host 的请求签名
+func (s *Signaler) now(host string) time.Time {
+	return time.Now().Add(s.clocks.get(host))
+}
+
+// observeDate 根据响应的 Date 头更新这个 hub 的时钟偏差, 返回偏差是否变化
+func (s *Signaler) observeDate(resp *http.Response) (changed bool) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil || resp.Request == nil {
+		return false
+	}
+	host := resp.Request.URL.Host
+	skew := time.Until(date)
+	c := s.clocks
+	c.locker.Lock()
+	offset := c.offsets[host]
+	if d := skew - offset; d < maxClockSkew && d > -maxClockSkew {
+		c.locker.Unlock()
+		return false
+	}
+	if skew < maxClockSkew && skew > -maxClockSkew {
+		skew = 0
+	}
+	if skew == 0 {
+		delete(c.offsets, host)
+	} else {
+		c.offsets[host] = skew
+	}
+	c.locker.Unlock()
+	clockOffset.Set(skew.Seconds(), host)
+	if skew == 0 {
+		slog.Info("local clock is in sync with signaler server again", "server", host)
+		return true
+	}
+	slog.Warn("local clock differs from signaler server, signatures use the server time. please sync the system clock",
+		"server", host,
+		"offset", skew.Round(time.Second).String(),
+	)
+	return true
+}
+
+// do 发送请求并学习时钟偏差.
+// 鉴权失败并且偏差变化时返回 errClockSkew, 调用方可以重新签名后重试
+func (s *Signaler) do(req *http.Request) (resp *http.Response, ierr error) {
+	resp, ierr = s.Client.Do(req)
+	if ierr != nil {
+		return
+	}
+	changed := s.observeDate(resp)
+	if changed && isAuthFailure(resp.StatusCode) {
+		resp.Body.Close()
+		return nil, errClockSkew
+	}
+	return
+}
+
+func isAuthFailure(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+var errClockSkew = errors.New("signature rejected because of clock skew, retry with server time")
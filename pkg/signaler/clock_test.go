@@ -0,0 +1,101 @@
+package signaler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/signaler"
+	"golang.org/x/net/websocket"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestClockSkew(t *testing.T) {
+	// hub 的时间比本地快一个小时
+	skew := time.Hour
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		now := time.Now().Add(skew)
+		w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		var ts int64
+		fmt.Sscan(r.Header.Get(HeaderTimestamp), &ts)
+		if d := now.Sub(time.Unix(ts, 0)); d > time.Minute || d < -time.Minute {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"type":"answer"}`))
+	}))
+	defer server.Close()
+
+	key := try.To1(wgtypes.GeneratePrivateKey())
+	pubkey := key.PublicKey()
+	s := New(key[:], nil)
+	s.PlainSDP = true
+	endpoint := server.URL + "?peer=" + hex.EncodeToString(pubkey[:])
+	answer := try.To1(s.Handshake(endpoint, signaler.SDP{Type: webrtc.SDPTypeOffer}))
+	assert.Equal(answer.Type, webrtc.SDPTypeAnswer)
+	assert.Equal(requests, 2)
+	u := try.To1(url.Parse(server.URL))
+	offset := s.clocks.get(u.Host)
+	assert.That(offset > skew-maxClockSkew && offset < skew+maxClockSkew)
+
+	// 之后的请求直接使用 hub 的时间
+	try.To1(s.Handshake(endpoint, signaler.SDP{Type: webrtc.SDPTypeOffer}))
+	assert.Equal(requests, 3)
+
+	// 偏差只属于这个 hub
+	assert.Equal(s.clocks.get("other.example"), time.Duration(0))
+
+	// 对方签名的 offer 仍然用本地时间验证
+	key2 := try.To1(wgtypes.GeneratePrivateKey())
+	s2 := New(key2[:], nil)
+	offer := Offer{SDP: signaler.SDP{Type: webrtc.SDPTypeOffer}}
+	try.To(s2.signOffer(endpoint, &offer))
+	try.To1(s.verifyOffer(offer))
+}
+
+func TestClockSkewWebSocket(t *testing.T) {
+	skew := time.Hour
+	dials := 0
+	answer := websocket.Handler(func(ws *websocket.Conn) {
+		var f wsFrame
+		if websocket.JSON.Receive(ws, &f) == nil {
+			websocket.JSON.Send(ws, wsFrame{Type: frameAnswer, Data: json.RawMessage(`{"type":"answer"}`)})
+		}
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dials++
+		now := time.Now().Add(skew)
+		var ts int64
+		fmt.Sscan(r.Header.Get(HeaderTimestamp), &ts)
+		if d := now.Sub(time.Unix(ts, 0)); d > time.Minute || d < -time.Minute {
+			w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		answer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	key := try.To1(wgtypes.GeneratePrivateKey())
+	pubkey := key.PublicKey()
+	s := New(key[:], nil)
+	s.PlainSDP = true
+	endpoint := "ws" + strings.TrimPrefix(server.URL, "http") + "?peer=" + hex.EncodeToString(pubkey[:])
+	a := try.To1(s.Handshake(endpoint, signaler.SDP{Type: webrtc.SDPTypeOffer}))
+	assert.Equal(a.Type, webrtc.SDPTypeAnswer)
+	assert.Equal(dials, 2)
+	u := try.To1(url.Parse(server.URL))
+	offset := s.clocks.get(u.Host)
+	assert.That(offset > skew-maxClockSkew && offset < skew+maxClockSkew)
+}
@@ -0,0 +1,134 @@
+package signaler
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// WebSocket 不经过 http.Client, 这里按 Client 的 Transport 使用同样的代理和 tls 配置建立连接
+
+// dialConn 建立到 ws:// 或 wss:// 链接的连接, wss 返回的是完成握手的 tls 连接
+func (s *Signaler) dialConn(ctx context.Context, u *url.URL) (conn net.Conn, ierr error) {
+	t, _ := s.Client.Transport.(*http.Transport)
+	if t == nil {
+		t = http.DefaultTransport.(*http.Transport)
+	}
+	secure := u.Scheme == "wss" || u.Scheme == "https"
+	addr := hostPort(u, secure)
+
+	var proxyURL *url.URL
+	if t.Proxy != nil {
+		hu := *u
+		hu.Scheme = "http"
+		if secure {
+			hu.Scheme = "https"
+		}
+		if proxyURL, ierr = t.Proxy(&http.Request{URL: &hu, Header: http.Header{}}); ierr != nil {
+			return
+		}
+	}
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	switch {
+	case proxyURL == nil:
+		conn, ierr = d.DialContext(ctx, "tcp", addr)
+	case proxyURL.Scheme == "socks5":
+		var pd proxy.Dialer
+		if pd, ierr = proxy.FromURL(proxyURL, d); ierr != nil {
+			return
+		}
+		conn, ierr = pd.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	default:
+		conn, ierr = dialConnect(ctx, d, proxyURL, addr, t.TLSClientConfig)
+	}
+	if ierr != nil {
+		return
+	}
+	if !secure {
+		return
+	}
+	tc := tls.Client(conn, tlsConfigFor(t.TLSClientConfig, u.Hostname()))
+	if ierr = tc.HandshakeContext(ctx); ierr != nil {
+		conn.Close()
+		return nil, ierr
+	}
+	return tc, nil
+}
+
+// dialConnect 通过 http 代理的 CONNECT 建立到 addr 的隧道
+func dialConnect(ctx context.Context, d *net.Dialer, p *url.URL, addr string, tlsConfig *tls.Config) (conn net.Conn, ierr error) {
+	conn, ierr = d.DialContext(ctx, "tcp", hostPort(p, p.Scheme == "https"))
+	if ierr != nil {
+		return
+	}
+	defer func() {
+		if ierr != nil {
+			conn.Close()
+		}
+	}()
+	if p.Scheme == "https" {
+		tc := tls.Client(conn, tlsConfigFor(tlsConfig, p.Hostname()))
+		if ierr = tc.HandshakeContext(ctx); ierr != nil {
+			return
+		}
+		conn = tc
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := p.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if ierr = req.Write(conn); ierr != nil {
+		return
+	}
+	// 代理在客户端发送数据之前不会发送隧道里的数据, 所以 bufio 不会多读
+	resp, ierr := http.ReadResponse(bufio.NewReader(conn), req)
+	if ierr != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", addr, resp.Status)
+	}
+	return conn, nil
+}
+
+func hostPort(u *url.URL, secure bool) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if secure {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func tlsConfigFor(c *tls.Config, host string) *tls.Config {
+	if c == nil {
+		c = &tls.Config{}
+	}
+	c = c.Clone()
+	if c.ServerName == "" {
+		c.ServerName = host
+	}
+	return c
+}
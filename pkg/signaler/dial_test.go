@@ -0,0 +1,74 @@
+package signaler
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"golang.org/x/net/websocket"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// testConnectProxy 是一个只支持 CONNECT 的 http 代理
+func testConnectProxy(count *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		count.Add(1)
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	})
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	hub := newTestWSHub()
+	server := httptest.NewTLSServer(websocket.Handler(hub.serve))
+	defer server.Close()
+	link := "wss" + strings.TrimPrefix(server.URL, "https")
+
+	var count atomic.Int32
+	proxy := httptest.NewServer(testConnectProxy(&count))
+	defer proxy.Close()
+
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(try.To1(url.Parse(proxy.URL)))
+
+	key := try.To1(wgtypes.GeneratePrivateKey())
+	s := New(key[:], []string{link})
+	s.Client = &http.Client{Transport: transport}
+	defer s.Close()
+	try.To1(s.Accept())
+	for i := 0; i < 100 && !hub.subscribed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.That(hub.subscribed())
+	assert.Equal(count.Load(), int32(1))
+
+	// 不信任 hub 的证书时连接失败
+	s2 := New(key[:], []string{link})
+	s2.Client = &http.Client{Transport: &http.Transport{Proxy: transport.Proxy}}
+	_, err := s2.Accept()
+	assert.Error(err)
+}
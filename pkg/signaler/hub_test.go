@@ -0,0 +1,95 @@
+package signaler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lainio/err2/try"
+	"github.com/r3labs/sse/v2"
+)
+
+// testHub 是一个最简单的 hub, trickle 为 true 时支持转发 candidate
+type testHub struct {
+	trickle  bool
+	peers    *sse.Server
+	sessions *sse.Server // 按会话缓存接收方的 candidate
+
+	locker  *sync.Mutex
+	nextID  int
+	answers map[string]chan []byte
+}
+
+func newTestHub(trickle bool) *testHub {
+	h := &testHub{
+		trickle:  trickle,
+		peers:    sse.New(),
+		sessions: sse.New(),
+		locker:   &sync.Mutex{},
+		answers:  make(map[string]chan []byte),
+	}
+	h.peers.AutoReplay = false
+	return h
+}
+
+func (h *testHub) publish(server *sse.Server, stream string, ev *sse.Event) {
+	if !server.StreamExists(stream) {
+		server.CreateStream(stream)
+	}
+	server.Publish(stream, ev)
+}
+
+func (h *testHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	session := r.Header.Get(headerSession)
+	switch {
+	case r.Method == http.MethodGet:
+		stream, server := q.Get("pubkey"), h.peers
+		if id := q.Get("session"); id != "" {
+			stream, server = id, h.sessions
+		}
+		if !server.StreamExists(stream) {
+			server.CreateStream(stream)
+		}
+		if h.trickle {
+			w.Header().Set(headerTrickle, "1")
+		}
+		q.Set("stream", stream)
+		r.URL.RawQuery = q.Encode()
+		server.ServeHTTP(w, r)
+	case r.Method == http.MethodPost && session != "" && h.trickle:
+		data := try.To1(io.ReadAll(r.Body))
+		if r.Header.Get("X-Event-Id") != "" {
+			h.publish(h.sessions, session, &sse.Event{Data: data})
+		} else {
+			h.publish(h.peers, q.Get("peer"), &sse.Event{Data: data, Event: []byte(eventCandidate)})
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost:
+		data := try.To1(io.ReadAll(r.Body))
+		h.locker.Lock()
+		h.nextID++
+		id := fmt.Sprint(h.nextID)
+		ch := make(chan []byte, 1)
+		h.answers[id] = ch
+		h.locker.Unlock()
+		h.publish(h.peers, q.Get("peer"), &sse.Event{ID: []byte(id), Data: data})
+		select {
+		case answer := <-ch:
+			w.Write(answer)
+		case <-time.After(5 * time.Second):
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	case r.Method == http.MethodDelete:
+		h.locker.Lock()
+		ch := h.answers[r.Header.Get("X-Event-Id")]
+		h.locker.Unlock()
+		if ch == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		ch <- try.To1(io.ReadAll(r.Body))
+	}
+}
@@ -0,0 +1,286 @@
+package signaler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/mdns"
+	"github.com/shynome/wgortc/signaler"
+	"golang.org/x/net/ipv4"
+)
+
+// 同一个局域网里的 peer 不需要 hub 就能连接, uplink 断开时也能继续工作:
+//   - 通过 mDNS 公布 xhe-{base32(pubkey)}.local, 解析到本机的局域网 ip
+//   - 在 LANPort 上监听 http, POST /offer 的 body 和发给 hub 的一样 (签名并加密), 响应是 answer.
+//     offer 的签名已经能证明发起方, 所以这个请求本身不签名
+//   - 发起方先通过 mDNS 查询对方, 找到就直接把 offer 发给对方, 不使用 trickle ICE, 找不到再通过 hub
+//   - lan://{pubkey} 的 endpoint 只通过局域网连接
+// 双方需要使用相同的 LANPort
+
+const (
+	lanLink = "lan"
+	// 查询对方的时间, hub 的握手最多多等这么久
+	lanQueryTimeout = time.Second
+	// 查询结果的缓存时间, 没找到的也缓存, 避免每次握手都多等 lanQueryTimeout
+	lanFoundTTL    = 5 * time.Minute
+	lanNotFoundTTL = 30 * time.Second
+	// 接收方等待 answer 的时间, 不使用 trickle ICE 需要等待 candidate 收集完成
+	lanAnswerTimeout = 10 * time.Second
+	maxLANOffer      = 64 << 10
+)
+
+type lanPeer struct {
+	addr    string
+	expires time.Time
+}
+
+func isLAN(endpoint string) bool {
+	return strings.HasPrefix(endpoint, lanLink+"://")
+}
+
+// lanName 是 pubkey 在 mDNS 中的名字, hex 编码超过了 63 字节的 label 长度限制
+func lanName(pubkey []byte) string {
+	name := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(pubkey)
+	return "xhe-" + strings.ToLower(name) + ".local"
+}
+
+// serveLAN 公布自己并接收局域网内的 offer, ctx 结束时停止
+func (s *Signaler) serveLAN(ctx context.Context, ch chan<- signaler.Session) (ierr error) {
+	logger := slog.With("act", "serve lan", "port", s.LANPort)
+	logger.Debug("start")
+	defer then(&ierr, func() {
+		logger.Debug("successful")
+	}, func() {
+		logger.Warn("failed", "err", ierr)
+	})
+
+	l, ierr := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(s.LANPort))))
+	if ierr != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/offer", s.handleOffer(ctx, ch, lanLink))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go server.Serve(l)
+
+	// mDNS 失败时仍然可以通过 lookupLAN 的替代实现或者对方主动连接
+	conn, err := s.listenMDNS()
+	if err != nil {
+		logger.Warn("mdns is not available", "err", err)
+	}
+	s.locker.Lock()
+	s.mdns = conn
+	s.locker.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		s.locker.Lock()
+		s.mdns = nil
+		s.lanPeers = make(map[string]lanPeer)
+		s.locker.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	return
+}
+
+func (s *Signaler) listenMDNS() (conn *mdns.Conn, ierr error) {
+	pubkey, ierr := s.Key.PublicKey()
+	if ierr != nil {
+		return
+	}
+	addr, ierr := net.ResolveUDPAddr("udp4", mdns.DefaultAddress)
+	if ierr != nil {
+		return
+	}
+	l, ierr := net.ListenUDP("udp4", addr)
+	if ierr != nil {
+		return
+	}
+	conn, ierr = mdns.Server(ipv4.NewPacketConn(l), &mdns.Config{
+		LocalNames: []string{lanName(pubkey)},
+	})
+	if ierr != nil {
+		l.Close()
+		return
+	}
+	return
+}
+
+// handleOffer 处理直接发来的 offer, 和 hub 推送的一样验证, answer 直接作为响应返回
+func (s *Signaler) handleOffer(ctx context.Context, ch chan<- signaler.Session, link string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.Active() {
+			// standby 不接受连接, 对方会回退到 hub
+			http.Error(w, "standby", http.StatusServiceUnavailable)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxLANOffer))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		release, ok := s.limits.admit(link)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		reply := make(chan []byte, 1)
+		sess := &Session{
+			ctx:     ctx,
+			root:    s,
+			link:    link,
+			id:      randomID(),
+			reply:   reply,
+			release: release,
+		}
+		go func() {
+			if err := s.acceptOffer(ctx, ch, sess, data); err != nil {
+				// 已经拒绝过的会被忽略
+				sess.Reject(Reject(RejectInvalidOffer, err))
+			}
+		}()
+		timer := time.NewTimer(lanAnswerTimeout)
+		defer timer.Stop()
+		select {
+		case body := <-reply:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		case <-timer.C:
+			http.Error(w, "answer timeout", http.StatusGatewayTimeout)
+		case <-r.Context().Done():
+		case <-ctx.Done():
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// replyHTTP 回复直接发来的 offer, 只有第一次回复有效
+func (s *Session) replyHTTP(body []byte) {
+	select {
+	case s.reply <- body:
+	default:
+	}
+}
+
+// lookupLAN 返回 endpoint 对应的 peer 在局域网中的地址, 没有找到时返回 false
+func (s *Signaler) lookupLAN(endpoint string) (addr string, ok bool) {
+	if s.LANPort == 0 {
+		return "", false
+	}
+	pubkey, err := peerOf(endpoint)
+	if err != nil {
+		return "", false
+	}
+	name := lanName(pubkey)
+	s.locker.Lock()
+	conn := s.mdns
+	p, cached := s.lanPeers[name]
+	s.locker.Unlock()
+	if cached && time.Now().Before(p.expires) {
+		return p.addr, p.addr != ""
+	}
+	resolve := s.resolveLAN
+	if resolve == nil {
+		if conn == nil {
+			return "", false
+		}
+		resolve = func(ctx context.Context, name string) (addr string, ierr error) {
+			_, src, ierr := conn.Query(ctx, name)
+			if ierr != nil {
+				return
+			}
+			ip, ok := src.(*net.IPAddr)
+			if !ok {
+				return "", fmt.Errorf("unexpected mdns answer %s", src)
+			}
+			return net.JoinHostPort(ip.String(), strconv.Itoa(int(s.LANPort))), nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lanQueryTimeout)
+	defer cancel()
+	addr, err = resolve(ctx, name)
+	p = lanPeer{addr: addr, expires: time.Now().Add(lanFoundTTL)}
+	if err != nil {
+		p = lanPeer{expires: time.Now().Add(lanNotFoundTTL)}
+	}
+	s.locker.Lock()
+	s.lanPeers[name] = p
+	s.locker.Unlock()
+	if p.addr != "" {
+		slog.Debug("found peer in lan", "name", name, "addr", p.addr)
+	}
+	return p.addr, p.addr != ""
+}
+
+// forgetLAN 在局域网握手失败时清除缓存, 下次重新查询
+func (s *Signaler) forgetLAN(endpoint string) {
+	pubkey, err := peerOf(endpoint)
+	if err != nil {
+		return
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	delete(s.lanPeers, lanName(pubkey))
+}
+
+// handshakeLAN 把 offer 直接发给局域网中的 peer
+func (s *Signaler) handshakeLAN(addr string, endpoint string, offer Offer) (answer *Answer, ierr error) {
+	u := url.URL{Scheme: "http", Host: addr, Path: "/offer"}
+	return s.postOffer(lanClient, u.String(), endpoint, offer)
+}
+
+// postOffer 把发往 endpoint 的 offer 直接 POST 到 link, 响应是 answer
+func (s *Signaler) postOffer(client *http.Client, link string, endpoint string, offer Offer) (answer *Answer, ierr error) {
+	b, ierr := s.offerBody(endpoint, &offer)
+	if ierr != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lanAnswerTimeout+5*time.Second)
+	defer cancel()
+	req, ierr := http.NewRequestWithContext(ctx, http.MethodPost, link, bytes.NewReader(b))
+	if ierr != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, ierr := client.Do(req)
+	if ierr != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if ierr = checkResponse(resp); ierr != nil {
+		return
+	}
+	answer = new(Answer)
+	if ierr = json.NewDecoder(resp.Body).Decode(answer); ierr != nil {
+		return
+	}
+	return s.openAnswer(endpoint, offer, answer)
+}
+
+// lanClient 不使用代理, 局域网的地址不能通过代理访问
+var lanClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: 3 * time.Second}).DialContext,
+	},
+}
+
+var ErrLANNotFound = errors.New("peer is not found in lan")
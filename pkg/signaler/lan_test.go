@@ -0,0 +1,99 @@
+package signaler
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/signaler"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestLAN(t *testing.T) {
+	l := try.To1(net.Listen("tcp", "127.0.0.1:0"))
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	key1 := try.To1(wgtypes.GeneratePrivateKey())
+	key2 := try.To1(wgtypes.GeneratePrivateKey())
+	s1 := New(key1[:], nil)
+	s1.LANPort = uint16(port)
+	defer s1.Close()
+	s2 := New(key2[:], nil)
+	s2.LANPort = uint16(port)
+
+	pubkey := key1.PublicKey()
+	name := lanName(pubkey[:])
+	// 不依赖局域网的组播, 直接解析到本机
+	s2.resolveLAN = func(ctx context.Context, n string) (string, error) {
+		if n != name {
+			return "", errors.New("not found")
+		}
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), nil
+	}
+
+	ch := try.To1(s1.Accept())
+	go func() {
+		for sess := range ch {
+			assert.Equal(sess.Description().SDP, "lan-offer")
+			sess.Resolve(&signaler.SDP{Type: webrtc.SDPTypeAnswer, SDP: "lan-answer"})
+		}
+	}()
+
+	endpoint := "lan://" + hex.EncodeToString(pubkey[:])
+	tr := s2.Trickle(endpoint)
+	assert.ThatNot(tr.Partial)
+	answer := try.To1(s2.HandshakeTrickle(endpoint, signaler.SDP{Type: webrtc.SDPTypeOffer, SDP: "lan-offer"}, tr))
+	assert.Equal(answer.SDP, "lan-answer")
+
+	other := try.To1(wgtypes.GeneratePrivateKey()).PublicKey()
+	_, err := s2.Handshake("lan://"+hex.EncodeToString(other[:]), signaler.SDP{Type: webrtc.SDPTypeOffer})
+	assert.Equal(err, ErrLANNotFound)
+}
+
+func TestLANSpoofedReject(t *testing.T) {
+	hub := newTestHub(false)
+	server := httptest.NewServer(hub)
+	defer server.Close()
+	// 伪造 mDNS 回答的设备, 总是回复没有签名的拒绝
+	spoofed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Answer{SDP: signaler.SDP{Type: webrtc.SDPTypeRollback}, Reject: Reject(RejectForbidden, nil)})
+	}))
+	defer spoofed.Close()
+
+	key1 := try.To1(wgtypes.GeneratePrivateKey())
+	key2 := try.To1(wgtypes.GeneratePrivateKey())
+	s1 := New(key1[:], []string{server.URL})
+	defer s1.Close()
+	s2 := New(key2[:], nil)
+	s2.LANPort = 9587
+	s2.resolveLAN = func(ctx context.Context, n string) (string, error) {
+		return strings.TrimPrefix(spoofed.URL, "http://"), nil
+	}
+
+	ch := try.To1(s1.Accept())
+	go func() {
+		for sess := range ch {
+			sess.Resolve(&signaler.SDP{Type: webrtc.SDPTypeAnswer, SDP: "hub-answer"})
+		}
+	}()
+	pubkey := key1.PublicKey()
+	endpoint := server.URL + "?peer=" + hex.EncodeToString(pubkey[:])
+	answer := try.To1(s2.Handshake(endpoint, signaler.SDP{Type: webrtc.SDPTypeOffer}))
+	assert.Equal(answer.SDP, "hub-answer")
+	// 伪造的地址不再缓存
+	s2.locker.Lock()
+	_, cached := s2.lanPeers[lanName(pubkey[:])]
+	s2.locker.Unlock()
+	assert.ThatNot(cached)
+}
@@ -0,0 +1,148 @@
+package signaler
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// 每个收到的 offer 都会在上层创建 PeerConnection, 大量的 offer 会耗尽资源:
+//   - 所有来源共用一个速率限制, 在创建 goroutine 之前检查, 超出的直接丢弃
+//   - 同时等待 answer 的 offer 数有上限, Resolve 或者 Reject 之后释放
+//   - 签名验证之后按发起方 pubkey 限速, 超出的回复 busy 让对方退避
+//   - 丢弃的 offer 计入 xhe_signaler_offers_dropped_total
+
+// OfferLimits 是接收 offer 的限制, 为 0 的项不限制
+type OfferLimits struct {
+	// Rate 和 Burst 是所有来源加起来每秒接收的 offer 数
+	Rate  rate.Limit
+	Burst int
+	// PeerRate 和 PeerBurst 是同一个发起方每秒接收的 offer 数
+	PeerRate  rate.Limit
+	PeerBurst int
+	// MaxPending 是同时等待 answer 的 offer 数
+	MaxPending int
+}
+
+var DefaultOfferLimits = OfferLimits{
+	Rate:       20,
+	Burst:      50,
+	PeerRate:   1,
+	PeerBurst:  5,
+	MaxPending: 64,
+}
+
+const (
+	// pendingOfferTimeout 后上层还没有回复的 offer 也释放名额
+	pendingOfferTimeout = 30 * time.Second
+	// maxPeerLimiters 是记录的发起方数量, 超出时清理令牌已经满了的
+	maxPeerLimiters = 4096
+)
+
+var ErrOfferRateLimited = errors.New("too many offers from this peer")
+
+type offerLimiter struct {
+	limits  OfferLimits
+	global  *rate.Limiter
+	pending chan struct{}
+
+	locker *sync.Mutex
+	peers  map[string]*rate.Limiter
+
+	logLimiter *rate.Limiter
+	dropped    atomic.Int64 // 上次日志之后丢弃的数量
+}
+
+func newOfferLimiter(limits OfferLimits) *offerLimiter {
+	l := &offerLimiter{
+		limits:     limits,
+		locker:     &sync.Mutex{},
+		peers:      make(map[string]*rate.Limiter),
+		logLimiter: rate.NewLimiter(rate.Every(10*time.Second), 1),
+	}
+	if limits.Rate > 0 {
+		l.global = rate.NewLimiter(limits.Rate, max(limits.Burst, 1))
+	}
+	if limits.MaxPending > 0 {
+		l.pending = make(chan struct{}, limits.MaxPending)
+	}
+	return l
+}
+
+// admit 在处理 offer 之前检查全局速率和等待中的数量, 通过时返回释放名额的函数.
+// l 为空时不限制
+func (l *offerLimiter) admit(link string) (release func(), ok bool) {
+	release = func() {}
+	if l == nil {
+		return release, true
+	}
+	if l.global != nil && !l.global.Allow() {
+		l.drop(link, "rate")
+		return nil, false
+	}
+	if l.pending == nil {
+		return release, true
+	}
+	select {
+	case l.pending <- struct{}{}:
+	default:
+		l.drop(link, "pending")
+		return nil, false
+	}
+	once := &sync.Once{}
+	var timer *time.Timer
+	release = func() {
+		once.Do(func() {
+			timer.Stop()
+			<-l.pending
+		})
+	}
+	timer = time.AfterFunc(pendingOfferTimeout, release)
+	return release, true
+}
+
+// allowPeer 按发起方限速
+func (l *offerLimiter) allowPeer(link string, from []byte) bool {
+	if l == nil || l.limits.PeerRate <= 0 || from == nil {
+		return true
+	}
+	l.locker.Lock()
+	lim, ok := l.peers[string(from)]
+	if !ok {
+		if len(l.peers) >= maxPeerLimiters {
+			l.sweep()
+		}
+		lim = rate.NewLimiter(l.limits.PeerRate, max(l.limits.PeerBurst, 1))
+		l.peers[string(from)] = lim
+	}
+	l.locker.Unlock()
+	if lim.Allow() {
+		return true
+	}
+	l.drop(link, "peer_rate")
+	return false
+}
+
+// sweep 删除令牌已经满了的发起方, 它们和新建的没有区别
+func (l *offerLimiter) sweep() {
+	for k, lim := range l.peers {
+		if lim.Tokens() >= float64(lim.Burst()) {
+			delete(l.peers, k)
+		}
+	}
+}
+
+// drop 记录丢弃的 offer, 日志每 10s 最多一条, 避免 offer 洪水变成日志洪水
+func (l *offerLimiter) drop(link string, reason string) {
+	offersDropped.Inc(reason)
+	n := l.dropped.Add(1)
+	if !l.logLimiter.Allow() {
+		return
+	}
+	l.dropped.Add(-n)
+	slog.Warn("drop offers", "act", "limit offers", "server", link, "reason", reason, "count", n)
+}
@@ -0,0 +1,48 @@
+package signaler
+
+import (
+	"testing"
+
+	"github.com/lainio/err2/assert"
+)
+
+func TestOfferLimits(t *testing.T) {
+	l := newOfferLimiter(OfferLimits{Rate: 1, Burst: 3, PeerRate: 1, PeerBurst: 2, MaxPending: 2})
+
+	// 等待中的 offer 达到上限后丢弃, 释放后恢复
+	r1, ok := l.admit("hub")
+	assert.That(ok)
+	_, ok = l.admit("hub")
+	assert.That(ok)
+	_, ok = l.admit("hub")
+	assert.ThatNot(ok)
+	r1()
+	r1() // 多次释放只生效一次
+	_, ok = l.admit("hub")
+	// 全局速率已经用完
+	assert.ThatNot(ok)
+
+	l = newOfferLimiter(OfferLimits{Rate: 1, Burst: 3})
+	for i := 0; i < 3; i++ {
+		_, ok := l.admit("hub")
+		assert.That(ok)
+	}
+	_, ok = l.admit("hub")
+	assert.ThatNot(ok)
+
+	// 按发起方限速, 不同发起方互不影响
+	l = newOfferLimiter(OfferLimits{PeerRate: 1, PeerBurst: 2})
+	a, b := []byte("a"), []byte("b")
+	assert.That(l.allowPeer("hub", a))
+	assert.That(l.allowPeer("hub", a))
+	assert.ThatNot(l.allowPeer("hub", a))
+	assert.That(l.allowPeer("hub", b))
+	// 没有签名的 offer 只受全局限制
+	assert.That(l.allowPeer("hub", nil))
+
+	// 没有启动时不限制
+	var none *offerLimiter
+	_, ok = none.admit("hub")
+	assert.That(ok)
+	assert.That(none.allowPeer("hub", a))
+}
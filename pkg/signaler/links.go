@@ -0,0 +1,198 @@
+package signaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/shynome/wgortc/signaler"
+	"remoon.net/xhe/pkg/metrics"
+)
+
+// 多个 hub 是互为备份的, 订阅尽力而为:
+//   - 每个链接各自在后台重试, 一个链接连不上不影响其他链接
+//   - 启动时最多等待 linkStartTimeout, 连上的链接少于 RequireLinks 时 Accept 才失败
+//   - 每个链接的状态见 Signaler.Links
+
+// linkStartTimeout 是启动时等待每个链接第一次连接的时间, 超时的链接继续在后台重试
+const linkStartTimeout = 15 * time.Second
+
+// LinkStatus 是一个订阅链接的状态
+type LinkStatus struct {
+	Link      string `json:"link"`
+	Connected bool   `json:"connected"`
+	// Since 是进入当前状态的时间
+	Since time.Time `json:"since"`
+	// Failures 是连续失败的次数, 连上后清零
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+	// Locked 表示 hub 返回 423, 同一个 key 的另一个实例持有这个订阅, 见 standby.go
+	Locked bool `json:"locked,omitempty"`
+}
+
+type linkHealth struct {
+	locker *sync.Mutex
+	links  map[string]*LinkStatus
+	// onChange 在状态变化之后调用, 不持有锁
+	onChange func()
+}
+
+func newLinkHealth() *linkHealth {
+	return &linkHealth{
+		locker: &sync.Mutex{},
+		links:  make(map[string]*LinkStatus),
+	}
+}
+
+func (h *linkHealth) get(link string) *LinkStatus {
+	st, ok := h.links[link]
+	if !ok {
+		st = &LinkStatus{Link: link, Since: time.Now()}
+		h.links[link] = st
+	}
+	return st
+}
+
+// set 记录链接的状态, err 不为空表示这次连接失败
+func (h *linkHealth) set(link string, connected bool, err error) {
+	subscribedGauge.Set(metrics.Bool(connected), link)
+	defer h.changed()
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	st := h.get(link)
+	if st.Connected != connected {
+		st.Since = time.Now()
+	}
+	st.Connected = connected
+	if connected {
+		st.Failures = 0
+		st.LastError = ""
+		st.Locked = false
+		return
+	}
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+		st.Locked = false
+	}
+}
+
+// setLocked 记录链接被另一个实例锁定, 不算作失败
+func (h *linkHealth) setLocked(link string) {
+	subscribedGauge.Set(0, link)
+	defer h.changed()
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	st := h.get(link)
+	if st.Connected || !st.Locked {
+		st.Since = time.Now()
+	}
+	st.Connected = false
+	st.Locked = true
+	st.Failures = 0
+	st.LastError = ""
+}
+
+func (h *linkHealth) locked(link string) bool {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	return h.get(link).Locked
+}
+
+// count 返回已经订阅和被锁定的链接数
+func (h *linkHealth) count() (connected int, locked int) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	for _, st := range h.links {
+		if st.Connected {
+			connected++
+		}
+		if st.Locked {
+			locked++
+		}
+	}
+	return
+}
+
+func (h *linkHealth) changed() {
+	if h.onChange != nil {
+		h.onChange()
+	}
+}
+
+// Links 返回每个订阅链接的状态, 顺序和创建时的链接一致
+func (s *Signaler) Links() (links []LinkStatus) {
+	s.health.locker.Lock()
+	defer s.health.locker.Unlock()
+	for _, server := range s.servers {
+		links = append(links, *s.health.get(server))
+	}
+	return
+}
+
+// requiredLinks 返回启动时至少要连上的链接数
+func (s *Signaler) requiredLinks() int {
+	n := s.RequireLinks
+	if n < 0 || n > len(s.servers) {
+		n = len(s.servers)
+	}
+	return n
+}
+
+func (s *Signaler) subscribeAll(ctx context.Context) (ch chan signaler.Session, ierr error) {
+	logger := slog.With("act", "subscribe all", "links", len(s.servers))
+	ch = make(chan signaler.Session, 512)
+	if s.LANPort != 0 {
+		if ierr = s.serveLAN(ctx, ch); ierr != nil {
+			return
+		}
+	}
+	results := make(chan error, len(s.servers))
+	s.ha.restart = func(server string) { s.subscribeLink(ctx, ch, server) }
+	for _, _server := range s.servers {
+		server := _server
+		s.health.set(server, false, nil)
+		go func() {
+			results <- s.subscribeLink(ctx, ch, server)
+		}()
+	}
+	timer := time.NewTimer(linkStartTimeout)
+	defer timer.Stop()
+	var errs []error
+	connected := 0
+	for i := 0; i < len(s.servers); i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			connected++
+		case <-timer.C:
+			errs = append(errs, ErrLinkTimeout)
+			i = len(s.servers)
+		}
+	}
+	if need := s.requiredLinks(); connected < need {
+		return nil, fmt.Errorf("%d of %d signaler links connected, require %d: %w", connected, len(s.servers), need, errors.Join(errs...))
+	}
+	if connected < len(s.servers) {
+		logger.Warn("some links are not connected, retry in background", "connected", connected, "err", errors.Join(errs...))
+	}
+	return
+}
+
+// subscribeLink 订阅一个链接, 让出订阅时可以单独取消, 见 standby.go
+func (s *Signaler) subscribeLink(ctx context.Context, ch chan signaler.Session, server string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	s.ha.setCancel(server, cancel)
+	if isWS(server) {
+		return s.subscribeWS(ctx, ch, server)
+	}
+	return s.subscribe(ctx, ch, server)
+}
+
+var ErrLinkTimeout = errors.New("timeout waiting for signaler links")
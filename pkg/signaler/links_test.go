@@ -0,0 +1,42 @@
+package signaler
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestLinks(t *testing.T) {
+	server := httptest.NewServer(newTestHub(false))
+	defer server.Close()
+	// 端口 1 上没有服务, 连接会被拒绝
+	bad := "http://127.0.0.1:1/"
+
+	key := try.To1(wgtypes.GeneratePrivateKey())
+	s := New(key[:], []string{bad, server.URL})
+	defer s.Close()
+	try.To1(s.Accept())
+
+	links := s.Links()
+	assert.SLen(links, 2)
+	assert.Equal(links[0].Link, bad)
+	assert.ThatNot(links[0].Connected)
+	assert.That(links[0].Failures > 0)
+	assert.NotEmpty(links[0].LastError)
+	assert.That(links[1].Connected)
+
+	// 要求全部连上时启动失败
+	s2 := New(key[:], []string{bad, server.URL})
+	s2.RequireLinks = -1
+	_, err := s2.Accept()
+	assert.Error(err)
+
+	// 不要求时都连不上也能启动
+	s3 := New(key[:], []string{bad})
+	s3.RequireLinks = 0
+	defer s3.Close()
+	try.To1(s3.Accept())
+}
@@ -0,0 +1,45 @@
+package signaler
+
+import "remoon.net/xhe/pkg/metrics"
+
+var (
+	subscribedGauge = metrics.NewGaugeVec(
+		"xhe_signaler_subscribed",
+		"Whether the signaler subscription of the link is connected",
+		"link",
+	)
+	handshakeTotal = metrics.NewCounterVec(
+		"xhe_signaler_handshakes_total",
+		"Signaler handshakes by result",
+		"result",
+	)
+	offersUnverified = metrics.NewCounterVec(
+		"xhe_signaler_offers_unverified_total",
+		"Received offers whose signature could not be verified by reason",
+		"reason",
+	)
+	offersDropped = metrics.NewCounterVec(
+		"xhe_signaler_offers_dropped_total",
+		"Received offers dropped by rate limits or the pending cap by reason",
+		"reason",
+	)
+	activeGauge = metrics.NewGaugeVec(
+		"xhe_signaler_active",
+		"Whether this instance holds the signaler subscriptions in HA mode, 0 means standby",
+	)
+	clockOffset = metrics.NewGaugeVec(
+		"xhe_signaler_clock_offset_seconds",
+		"Offset learned from signaler server Date header that is added to local time when signing requests to the server",
+		"server",
+	)
+	relayedOffers = metrics.NewCounterVec(
+		"xhe_signaler_relayed_offers_total",
+		"Offers relayed for connected peers by result",
+		"result",
+	)
+	handshakeDuration = metrics.NewHistogramVec(
+		"xhe_signaler_handshake_duration_seconds",
+		"Latency of successful signaler handshakes",
+		metrics.DefBuckets,
+	)
+)
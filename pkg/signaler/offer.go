@@ -0,0 +1,158 @@
+package signaler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shynome/go-x25519"
+)
+
+// SignURL 只向 hub 证明自己的身份, 接收方无法确认 offer 是谁发的.
+// 所以发起方在 offer 里再带一个签名, 覆盖 offer 内容, 时间戳和接收方的 pubkey,
+// 接收方在把 Session 交给上层之前验证, 并且记住见过的签名防止重放
+
+const (
+	// offerMaxAge 是 offer 时间戳允许的偏差
+	offerMaxAge = 60 * time.Second
+	// 最多记住的签名数量, 超过时拒绝新的 offer 直到旧的过期
+	maxSeenOffers = 4096
+)
+
+// OfferSignature 证明 offer 是 From 发给 To 的
+type OfferSignature struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+func offerMessage(o Offer, from, to string, timestamp int64) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%t", o.Type, o.SDP.SDP, o.Trickle, o.Partial)
+	return []byte(fmt.Sprintf("xhe-offer\n%s\n%s\n%d\n%x", from, to, timestamp, h.Sum(nil)))
+}
+
+// signOffer 用 endpoint 的 peer 参数作为接收方签名 offer
+func (s *Signaler) signOffer(endpoint string, o *Offer) (ierr error) {
+	to, ierr := peerOf(endpoint)
+	if ierr != nil {
+		return
+	}
+	pubkey, ierr := s.Key.PublicKey()
+	if ierr != nil {
+		return
+	}
+	sig := &OfferSignature{
+		From:      hex.EncodeToString(pubkey),
+		To:        hex.EncodeToString(to),
+		Timestamp: time.Now().Unix(),
+	}
+	signature, ierr := x25519.Sign(rand.Reader, s.Key, offerMessage(*o, sig.From, sig.To, sig.Timestamp))
+	if ierr != nil {
+		return
+	}
+	sig.Signature = hex.EncodeToString(signature)
+	o.Sig = sig
+	return
+}
+
+// verifyOffer 返回发起方的 pubkey
+func (s *Signaler) verifyOffer(o Offer) (from x25519.PublicKey, ierr error) {
+	sig := o.Sig
+	if sig == nil {
+		return nil, ErrOfferUnsigned
+	}
+	pubkey, ierr := s.Key.PublicKey()
+	if ierr != nil {
+		return
+	}
+	if sig.To != hex.EncodeToString(pubkey) {
+		return nil, ErrOfferTarget
+	}
+	// 用本地时间验证, hub 的时钟偏差不能影响对方签名的时间窗口
+	now := time.Now()
+	age := now.Sub(time.Unix(sig.Timestamp, 0))
+	if age > offerMaxAge || age < -offerMaxAge {
+		return nil, ErrOfferExpired
+	}
+	from, ierr = hex.DecodeString(sig.From)
+	if ierr != nil || len(from) != 32 {
+		return nil, ErrOfferSignature
+	}
+	signature, ierr := hex.DecodeString(sig.Signature)
+	if ierr != nil {
+		return nil, ErrOfferSignature
+	}
+	if !x25519.Verify(from, offerMessage(o, sig.From, sig.To, sig.Timestamp), signature) {
+		return nil, ErrOfferSignature
+	}
+	if ierr = s.seen.add(signature, time.Unix(sig.Timestamp, 0), now); ierr != nil {
+		return nil, ierr
+	}
+	return from, nil
+}
+
+// seenOffers 记住时间窗口内见过的签名.
+// hex 不区分大小写, 所以用解码后的签名作为 key, 否则改一下大小写就能重放
+type seenOffers struct {
+	locker *sync.Mutex
+	seen   map[string]time.Time
+}
+
+func newSeenOffers() *seenOffers {
+	return &seenOffers{
+		locker: &sync.Mutex{},
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// add 记住签名, 同时删除时间窗口外的. now 和验证时间戳时用的是同一个
+func (s *seenOffers) add(signature []byte, timestamp, now time.Time) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for k, t := range s.seen {
+		if now.Sub(t) > offerMaxAge {
+			delete(s.seen, k)
+		}
+	}
+	key := string(signature)
+	if _, ok := s.seen[key]; ok {
+		return ErrOfferReplayed
+	}
+	if len(s.seen) >= maxSeenOffers {
+		return ErrOfferBusy
+	}
+	s.seen[key] = timestamp
+	return nil
+}
+
+func offerVerifyReason(err error) string {
+	switch {
+	case errors.Is(err, ErrOfferUnsigned):
+		return "unsigned"
+	case errors.Is(err, ErrOfferTarget):
+		return "target"
+	case errors.Is(err, ErrOfferExpired):
+		return "expired"
+	case errors.Is(err, ErrOfferReplayed):
+		return "replayed"
+	case errors.Is(err, ErrOfferBusy):
+		return "busy"
+	}
+	return "signature"
+}
+
+var (
+	ErrPeerRequired   = errors.New("endpoint requires a hex peer param")
+	ErrOfferUnsigned  = errors.New("offer is not signed")
+	ErrOfferTarget    = errors.New("offer is signed for another peer")
+	ErrOfferExpired   = errors.New("offer timestamp is out of window")
+	ErrOfferSignature = errors.New("offer signature is invalid")
+	ErrOfferReplayed  = errors.New("offer is replayed")
+	ErrOfferBusy      = errors.New("too many offers in window")
+)
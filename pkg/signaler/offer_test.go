@@ -0,0 +1,73 @@
+package signaler
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/signaler"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestSignOffer(t *testing.T) {
+	key1 := try.To1(wgtypes.GeneratePrivateKey())
+	key2 := try.To1(wgtypes.GeneratePrivateKey())
+	key3 := try.To1(wgtypes.GeneratePrivateKey())
+	s1 := New(key1[:], nil)
+	s2 := New(key2[:], nil)
+	s3 := New(key3[:], nil)
+
+	pubkey := key1.PublicKey()
+	endpoint := "https://hub.example?peer=" + hex.EncodeToString(pubkey[:])
+	offer := Offer{SDP: signaler.SDP{Type: webrtc.SDPTypeOffer, SDP: "v=0"}, Trickle: "id"}
+	try.To(s2.signOffer(endpoint, &offer))
+
+	from := try.To1(s1.verifyOffer(offer))
+	pubkey2 := key2.PublicKey()
+	assert.DeepEqual([]byte(from), pubkey2[:])
+
+	// 同一个 offer 只能用一次
+	_, err := s1.verifyOffer(offer)
+	assert.Equal(err, ErrOfferReplayed)
+	// 签名改成大写也是同一个
+	offer.Sig.Signature = strings.ToUpper(offer.Sig.Signature)
+	_, err = s1.verifyOffer(offer)
+	assert.Equal(err, ErrOfferReplayed)
+
+	// 发给别人的 offer
+	_, err = s3.verifyOffer(offer)
+	assert.Equal(err, ErrOfferTarget)
+
+	// 修改过内容
+	try.To(s2.signOffer(endpoint, &offer))
+	offer.SDP.SDP = "v=1"
+	_, err = s1.verifyOffer(offer)
+	assert.Equal(err, ErrOfferSignature)
+
+	// 过期
+	try.To(s2.signOffer(endpoint, &offer))
+	offer.Sig.Timestamp -= 2 * int64(offerMaxAge.Seconds())
+	_, err = s1.verifyOffer(offer)
+	assert.Equal(err, ErrOfferExpired)
+
+	offer.Sig = nil
+	_, err = s1.verifyOffer(offer)
+	assert.Equal(err, ErrOfferUnsigned)
+}
+
+func TestSeenOffers(t *testing.T) {
+	seen := newSeenOffers()
+	now := time.Now()
+	try.To(seen.add([]byte{1}, now, now))
+	assert.Equal(seen.add([]byte{1}, now, now), ErrOfferReplayed)
+
+	// 过期的签名在下一次添加时删除
+	later := now.Add(offerMaxAge + time.Second)
+	try.To(seen.add([]byte{2}, later, later))
+	assert.MLen(seen.seen, 1)
+	try.To(seen.add([]byte{1}, later, later))
+}
@@ -0,0 +1,292 @@
+package signaler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/signaler"
+	"rsc.io/qr"
+)
+
+// Pair 是手动交换 offer 和 answer 的 signaler.Channel, 用于连不上任何 signaler 服务器的环境.
+// offer 和 answer 压缩后用 base64 打印出来, 也可以打印成终端二维码,
+// 通过聊天窗口之类的方式发给对方, 再把对方的回复粘贴到输入里
+type Pair struct {
+	In  io.Reader
+	Out io.Writer
+	// QR 同时打印终端二维码
+	QR bool
+	// Answer 为 true 时从 In 读取对方的 offer 并回复, 否则发起连接
+	Answer bool
+	// Timeout 是等待粘贴的时间
+	Timeout time.Duration
+
+	locker  *sync.Mutex
+	pending bool // 同时只有一次交换
+	cancel  context.CancelFunc
+	lines   chan string
+	eof     chan struct{}
+	once    *sync.Once
+}
+
+var _ signaler.Channel = (*Pair)(nil)
+
+func NewPair(in io.Reader, out io.Writer) *Pair {
+	return &Pair{
+		In:      in,
+		Out:     out,
+		Timeout: 10 * time.Minute,
+
+		locker: &sync.Mutex{},
+		lines:  make(chan string),
+		eof:    make(chan struct{}),
+		once:   &sync.Once{},
+	}
+}
+
+// HandshakeTimeout 让连接状态机等待人工交换完成, 而不是 20s 后重新发起
+func (p *Pair) HandshakeTimeout() time.Duration {
+	return p.Timeout
+}
+
+func (p *Pair) Handshake(endpoint string, offer signaler.SDP) (answer *signaler.SDP, ierr error) {
+	p.locker.Lock()
+	if p.pending {
+		p.locker.Unlock()
+		return nil, ErrPairPending
+	}
+	p.pending = true
+	p.locker.Unlock()
+	defer func() {
+		p.locker.Lock()
+		p.pending = false
+		p.locker.Unlock()
+	}()
+
+	blob, ierr := EncodePair(offer)
+	if ierr != nil {
+		return
+	}
+	p.print("offer", blob)
+	fmt.Fprintln(p.Out, "paste the answer from the other side:")
+	line, ierr := p.readLine(context.Background())
+	if ierr != nil {
+		return
+	}
+	var a Answer
+	if ierr = DecodePair(line, &a); ierr != nil {
+		return
+	}
+	if a.Reject != nil {
+		return nil, a.Reject
+	}
+	return &a.SDP, nil
+}
+
+func (p *Pair) Accept() (offerCh <-chan signaler.Session, ierr error) {
+	ch := make(chan signaler.Session)
+	if !p.Answer {
+		close(ch)
+		return ch, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.locker.Lock()
+	p.cancel = cancel
+	p.locker.Unlock()
+	go func() {
+		defer close(ch)
+		for {
+			fmt.Fprintln(p.Out, "paste the offer from the other side:")
+			line, err := p.readLine(ctx)
+			if err != nil {
+				return
+			}
+			var offer signaler.SDP
+			if err := DecodePair(line, &offer); err != nil {
+				fmt.Fprintln(p.Out, "invalid offer:", err)
+				continue
+			}
+			sess := &pairSession{
+				p:     p,
+				offer: offer,
+				done:  make(chan struct{}),
+				once:  &sync.Once{},
+			}
+			select {
+			case ch <- sess:
+			case <-ctx.Done():
+				return
+			}
+			// 回复之后再读下一个 offer, 避免提示交错
+			select {
+			case <-sess.done:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (p *Pair) Close() error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+	}
+	return nil
+}
+
+// readLine 读取一个非空行, 输入只有一个, 所以由一个 goroutine 一直读取
+func (p *Pair) readLine(ctx context.Context) (line string, ierr error) {
+	p.once.Do(func() {
+		go func() {
+			defer close(p.eof)
+			scanner := bufio.NewScanner(p.In)
+			scanner.Buffer(nil, 1<<20)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "" {
+					continue
+				}
+				p.lines <- line
+			}
+		}()
+	})
+	timer := time.NewTimer(p.Timeout)
+	defer timer.Stop()
+	select {
+	case line = <-p.lines:
+		return line, nil
+	case <-timer.C:
+		return "", ErrPairTimeout
+	case <-p.eof:
+		return "", io.EOF
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (p *Pair) print(kind string, blob string) {
+	fmt.Fprintf(p.Out, "\n%s, send it to the other side:\n\n%s\n\n", kind, blob)
+	if !p.QR {
+		return
+	}
+	code, err := qr.Encode(blob, qr.L)
+	if err != nil {
+		fmt.Fprintln(p.Out, "too large for qr code:", err)
+		return
+	}
+	fmt.Fprintln(p.Out, renderQR(code))
+}
+
+type pairSession struct {
+	p     *Pair
+	offer signaler.SDP
+	done  chan struct{}
+	once  *sync.Once
+}
+
+var _ signaler.Session = (*pairSession)(nil)
+
+func (s *pairSession) Description() signaler.SDP { return s.offer }
+
+func (s *pairSession) Resolve(answer *signaler.SDP) (ierr error) {
+	defer s.once.Do(func() { close(s.done) })
+	blob, ierr := EncodePair(Answer{SDP: *answer})
+	if ierr != nil {
+		return
+	}
+	s.p.print("answer", blob)
+	return
+}
+
+func (s *pairSession) Reject(err error) {
+	defer s.once.Do(func() { close(s.done) })
+	var rejection *RejectError
+	if !errors.As(err, &rejection) {
+		rejection = Reject(RejectInternal, err)
+	}
+	fmt.Fprintln(s.p.Out, "offer is rejected:", rejection)
+	answer := Answer{SDP: signaler.SDP{Type: webrtc.SDPTypeRollback}, Reject: rejection}
+	if blob, err := EncodePair(answer); err == nil {
+		s.p.print("rejection", blob)
+	}
+}
+
+// EncodePair 把 v 编码成可以复制粘贴的文本: base64url(deflate(json))
+func EncodePair(v any) (blob string, ierr error) {
+	b, ierr := json.Marshal(v)
+	if ierr != nil {
+		return
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	if _, ierr = w.Write(b); ierr != nil {
+		return
+	}
+	if ierr = w.Close(); ierr != nil {
+		return
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func DecodePair(blob string, v any) (ierr error) {
+	b, ierr := base64.RawURLEncoding.DecodeString(strings.TrimSpace(blob))
+	if ierr != nil {
+		return
+	}
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	// 防止粘贴的内容解压出超大的数据
+	b, ierr = io.ReadAll(io.LimitReader(r, 1<<20))
+	if ierr != nil {
+		return
+	}
+	return json.Unmarshal(b, v)
+}
+
+// renderQR 用半格字符画二维码, 两行模块占一行文本, 亮色模块用字符填充, 适合深色背景的终端
+func renderQR(code *qr.Code) string {
+	const quiet = 2
+	light := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return true
+		}
+		return !code.Black(x, y)
+	}
+	var sb strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+var (
+	ErrPairPending = errors.New("another offer is waiting for its answer")
+	ErrPairTimeout = errors.New("timeout waiting for the pasted answer")
+)
@@ -0,0 +1,59 @@
+package signaler
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/signaler"
+	"rsc.io/qr"
+)
+
+func TestPair(t *testing.T) {
+	offer := signaler.SDP{Type: webrtc.SDPTypeOffer, SDP: strings.Repeat("a=candidate\r\n", 20)}
+	blob := try.To1(EncodePair(offer))
+	assert.ThatNot(strings.ContainsAny(blob, "+/=\n"))
+	assert.That(len(blob) < len(offer.SDP))
+	var got signaler.SDP
+	try.To(DecodePair(" "+blob+"\n", &got))
+	assert.DeepEqual(got, offer)
+	assert.NotEmpty(renderQR(try.To1(qr.Encode(blob, qr.L))))
+
+	// 两端通过管道模拟复制粘贴
+	answererIn, offererOut := io.Pipe()
+	offererIn, answererOut := io.Pipe()
+	offerer := NewPair(offererIn, pasteBlobs(offererOut))
+	answerer := NewPair(answererIn, pasteBlobs(answererOut))
+	answerer.Answer = true
+	defer answerer.Close()
+
+	ch := try.To1(answerer.Accept())
+	go func() {
+		for sess := range ch {
+			assert.DeepEqual(sess.Description(), offer)
+			sess.Resolve(&signaler.SDP{Type: webrtc.SDPTypeAnswer, SDP: "v=0"})
+		}
+	}()
+	answer := try.To1(offerer.Handshake("pair://peer", offer))
+	assert.Equal(answer.SDP, "v=0")
+}
+
+// pasteBlobs 只把输出中的 blob 那一行粘贴到对方的输入, 提示文字被丢弃
+func pasteBlobs(w io.Writer) io.Writer {
+	r, out := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" || strings.ContainsAny(line, " :") {
+				continue
+			}
+			io.WriteString(w, line+"\n")
+		}
+	}()
+	return out
+}
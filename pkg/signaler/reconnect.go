@@ -10,6 +10,8 @@ import (
 type Retry struct {
 	ctx      context.Context
 	duration time.Duration
+	// delay 返回大于 0 时替换 duration, 见 Signaler.lockedDelay
+	delay func() time.Duration
 }
 
 var _ backoff.BackOff = (*Retry)(nil)
@@ -25,6 +27,11 @@ func (r *Retry) NextBackOff() time.Duration {
 	if r.ctx.Err() != nil {
 		return backoff.Stop
 	}
+	if r.delay != nil {
+		if d := r.delay(); d > 0 {
+			return d
+		}
+	}
 	return r.duration
 }
 func (r *Retry) Reset() {
@@ -0,0 +1,188 @@
+package signaler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/go-x25519"
+	"github.com/shynome/wgortc/signaler"
+)
+
+// RejectCode 是拒绝 offer 的原因
+type RejectCode string
+
+const (
+	// RejectInternal 处理 offer 时出错
+	RejectInternal RejectCode = "internal"
+	// RejectInvalidOffer offer 格式不对
+	RejectInvalidOffer RejectCode = "invalid_offer"
+	// RejectForbidden 不接受这个 pubkey 的连接
+	RejectForbidden RejectCode = "forbidden"
+	// RejectBusy 暂时不能处理, 稍后再试
+	RejectBusy RejectCode = "busy"
+)
+
+// RejectError 是对方拒绝 offer 时 Handshake 返回的错误
+type RejectError struct {
+	Code   RejectCode `json:"code"`
+	Reason string     `json:"reason,omitempty"`
+	// Sig 是拒绝方的签名, From 是拒绝方, To 是发起方, 防止 hub 伪造拒绝
+	Sig *OfferSignature `json:"sig,omitempty"`
+
+	verified bool
+}
+
+func (e *RejectError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("offer rejected: %s", e.Code)
+	}
+	return fmt.Sprintf("offer rejected: %s: %s", e.Code, e.Reason)
+}
+
+// Permanent 表示重试也不会成功, 除非对方修改了配置.
+// 只有验证过签名的拒绝才算, 否则 hub 可以伪造 forbidden 让发起方长时间不重试
+func (e *RejectError) Permanent() bool {
+	return e.verified && e.Code == RejectForbidden
+}
+
+// isVerifiedReject 判断 err 是不是验证过签名的拒绝. 没有验证过的可能是 hub 或者中间节点伪造的, 不能据此停止尝试其他路线
+func isVerifiedReject(err error) bool {
+	var rejection *RejectError
+	return errors.As(err, &rejection) && rejection.verified
+}
+
+// Reject 构造一个带原因的拒绝, 传给 Session.Reject
+func Reject(code RejectCode, err error) *RejectError {
+	e := &RejectError{Code: code}
+	if err != nil {
+		e.Reason = err.Error()
+	}
+	return e
+}
+
+const headerReject = "X-Xhe-Reject"
+
+// Reject 通知发起方这个 offer 被拒绝, 发起方的 Handshake 会立即返回 RejectError 而不用等待超时.
+// 拒绝放在 answer 的 reject 字段里, 只会原样转发 body 的 hub 也能传递,
+// X-Xhe-Reject 头让新版本的 hub 可以返回对应的状态码.
+// 拒绝和 answer 一样签名, offer 加密时也加密给发起方, hub 只能看到 X-Xhe-Reject 头里的 code
+func (s *Session) Reject(err error) {
+	defer s.done()
+	if s.t != nil {
+		s.t.Close()
+	}
+	var rejection *RejectError
+	if !errors.As(err, &rejection) {
+		rejection = Reject(RejectInternal, err)
+	}
+	if ierr := s.reject(rejection); ierr != nil {
+		slog.Warn("send rejection failed", "id", s.id, "code", rejection.Code, "err", ierr)
+	}
+}
+
+func (s *Session) reject(rejection *RejectError) (ierr error) {
+	// 旧版本的发起方会把它当作 answer, rollback 能正常解析, 然后在 SetRemoteDescription 时立即失败
+	if ierr = s.signReject(rejection); ierr != nil {
+		return
+	}
+	answer := Answer{SDP: signaler.SDP{Type: webrtc.SDPTypeRollback}, Reject: rejection}
+	if to := s.sealTo(); to != nil {
+		box, ierr := sealJSON(to, answer)
+		if ierr != nil {
+			return ierr
+		}
+		answer = Answer{SDP: signaler.SDP{Type: webrtc.SDPTypeRollback}, Sealed: box}
+	}
+	body, ierr := json.Marshal(answer)
+	if ierr != nil {
+		return
+	}
+	if s.ws != nil {
+		return s.ws.send(wsFrame{Type: frameAnswer, ID: s.id, Reject: rejection.Code, Data: body})
+	}
+	if s.reply != nil {
+		s.replyHTTP(body)
+		return
+	}
+	root := s.root
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+	req, ierr := root.newRequest(ctx, http.MethodDelete, s.link, body, http.Header{
+		headerEventID: {s.id},
+		headerReject:  {string(rejection.Code)},
+	})
+	if ierr != nil {
+		return
+	}
+	resp, ierr := root.do(req)
+	if ierr != nil {
+		return
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// rejectMessage 覆盖被拒绝的 offer 的签名, 一个拒绝不能用在同一个发起方的其他 offer 上
+func rejectMessage(e *RejectError, from, to string, timestamp int64, offer string) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s", e.Code, e.Reason)
+	return []byte(fmt.Sprintf("xhe-reject\n%s\n%s\n%d\n%s\n%x", from, to, timestamp, offer, h.Sum(nil)))
+}
+
+// signReject 签名发给发起方的拒绝, 发起方没有验证过时不签名, 对方也不会把它当作 Permanent
+func (s *Session) signReject(e *RejectError) (ierr error) {
+	if s.from == nil {
+		return
+	}
+	root := s.root
+	pubkey, ierr := root.Key.PublicKey()
+	if ierr != nil {
+		return
+	}
+	sig := &OfferSignature{
+		From:      hex.EncodeToString(pubkey),
+		To:        hex.EncodeToString(s.from),
+		Timestamp: time.Now().Unix(),
+	}
+	signature, ierr := x25519.Sign(rand.Reader, root.Key, rejectMessage(e, sig.From, sig.To, sig.Timestamp, s.offerSig))
+	if ierr != nil {
+		return
+	}
+	sig.Signature = hex.EncodeToString(signature)
+	e.Sig = sig
+	return
+}
+
+// verifyReject 验证拒绝是 endpoint 的 peer 对 offer 做出的, offer 是自己发出的 offer 的签名
+func (s *Signaler) verifyReject(endpoint string, offer *OfferSignature, e *RejectError) bool {
+	sig := e.Sig
+	if sig == nil || offer == nil {
+		return false
+	}
+	peer, err := peerOf(endpoint)
+	if err != nil || sig.From != hex.EncodeToString(peer) {
+		return false
+	}
+	pubkey, err := s.Key.PublicKey()
+	if err != nil || sig.To != hex.EncodeToString(pubkey) {
+		return false
+	}
+	age := time.Since(time.Unix(sig.Timestamp, 0))
+	if age > offerMaxAge || age < -offerMaxAge {
+		return false
+	}
+	signature, err := hex.DecodeString(sig.Signature)
+	if err != nil {
+		return false
+	}
+	return x25519.Verify(peer, rejectMessage(e, sig.From, sig.To, sig.Timestamp, offer.Signature), signature)
+}
@@ -0,0 +1,74 @@
+package signaler
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/signaler"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestReject(t *testing.T) {
+	hub := newTestHub(false)
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	key1 := try.To1(wgtypes.GeneratePrivateKey())
+	key2 := try.To1(wgtypes.GeneratePrivateKey())
+	s1 := New(key1[:], []string{server.URL})
+	defer s1.Close()
+	s2 := New(key2[:], nil)
+
+	ch := try.To1(s1.Accept())
+	go func() {
+		for sess := range ch {
+			sess.Reject(Reject(RejectForbidden, fmt.Errorf("not allowed")))
+		}
+	}()
+	pubkey := key1.PublicKey()
+	_, err := s2.Handshake(server.URL+"?peer="+hex.EncodeToString(pubkey[:]), signaler.SDP{Type: webrtc.SDPTypeOffer})
+	var rejection *RejectError
+	assert.That(errors.As(err, &rejection))
+	assert.Equal(rejection.Code, RejectForbidden)
+	assert.Equal(rejection.Reason, "not allowed")
+	assert.That(rejection.Permanent())
+
+	endpoint := server.URL + "?peer=" + hex.EncodeToString(pubkey[:])
+	pubkey2 := key2.PublicKey()
+	// signed 返回 s1 对 offer 的拒绝
+	signed := func(offer Offer) *RejectError {
+		sess := &Session{root: s1, from: pubkey2[:], offerSig: offer.Sig.Signature}
+		e := Reject(RejectForbidden, nil)
+		try.To(sess.signReject(e))
+		return e
+	}
+	offer := Offer{SDP: signaler.SDP{Type: webrtc.SDPTypeOffer}}
+	try.To1(s2.offerBody(endpoint, &offer))
+	_, err = s2.openAnswer(endpoint, offer, &Answer{Reject: signed(offer)})
+	assert.That(errors.As(err, &rejection))
+	assert.That(rejection.Permanent())
+
+	// 对另一个 offer 的拒绝不能重放
+	other := Offer{SDP: signaler.SDP{Type: webrtc.SDPTypeOffer}}
+	try.To1(s2.offerBody(endpoint, &other))
+	_, err = s2.openAnswer(endpoint, offer, &Answer{Reject: signed(other)})
+	assert.That(errors.As(err, &rejection))
+	assert.ThatNot(rejection.Permanent())
+
+	// 被篡改或者伪造的拒绝
+	changed := signed(offer)
+	changed.Reason = "changed"
+	_, err = s2.openAnswer(endpoint, offer, &Answer{Reject: changed})
+	assert.That(errors.As(err, &rejection))
+	assert.ThatNot(rejection.Permanent())
+	_, err = s2.openAnswer(endpoint, offer, &Answer{Reject: Reject(RejectForbidden, nil)})
+	assert.That(errors.As(err, &rejection))
+	assert.Equal(rejection.Code, RejectForbidden)
+	assert.ThatNot(rejection.Permanent())
+}
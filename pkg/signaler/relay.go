@@ -0,0 +1,270 @@
+package signaler
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/shynome/wgortc/signaler"
+)
+
+// hub 不可用时, 通过已经连接的 peer 转发 offer, 让网络可以继续建立新的连接.
+// 转发走 WireGuard 隧道内部, 每个节点在自己的隧道 ip 上监听 Port:
+//   - POST /offer 和局域网的一样, 接收发给自己的 offer, 响应是 answer
+//   - POST /relay?peer={pubkey} 把 body 原样转发给已经连接的 peer 的 /offer, 响应原样返回.
+//     只转发一跳, offer 是签名并加密给接收方的, 转发的节点看不到内容, 也不能伪造
+//   - 发起方在 hub 握手失败时, 依次通过已经连接的 peer 转发, 不使用 trickle ICE
+// 所有节点需要使用相同的 Port
+
+const (
+	relayLink = "relay"
+	// 每次握手最多尝试的转发节点
+	maxRelayTries = 3
+)
+
+// Relay 在 Signaler 的基础上通过已经连接的 peer 转发 offer
+type Relay struct {
+	*Signaler
+
+	Port uint16
+	// Peers 返回已经连接的 peer 的 pubkey, 为空时不转发
+	Peers func() [][]byte
+	// Addr 返回 pubkey 在隧道中的 ip
+	Addr func(pubkey []byte) netip.Addr
+	// Dial 和 Listen 通过隧道连接, 为空时使用系统的网络, vtun 模式需要使用它的网络栈
+	Dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	Listen func(addr netip.AddrPort) (net.Listener, error)
+
+	client *http.Client
+	locker *sync.Mutex
+	cancel context.CancelFunc
+}
+
+var _ signaler.Channel = (*Relay)(nil)
+
+func NewRelay(s *Signaler, port uint16) *Relay {
+	r := &Relay{
+		Signaler: s,
+		Port:     port,
+		locker:   &sync.Mutex{},
+	}
+	r.client = &http.Client{
+		Transport: &http.Transport{DialContext: r.dial},
+	}
+	return r
+}
+
+func (r *Relay) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if r.Dial != nil {
+		return r.Dial(ctx, network, addr)
+	}
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	return d.DialContext(ctx, network, addr)
+}
+
+func (r *Relay) listen(addr netip.AddrPort) (net.Listener, error) {
+	if r.Listen != nil {
+		return r.Listen(addr)
+	}
+	return net.Listen("tcp", addr.String())
+}
+
+// link 返回 pubkey 在隧道中的 relay 地址
+func (r *Relay) link(pubkey []byte, path string) string {
+	addr := netip.AddrPortFrom(r.Addr(pubkey), r.Port)
+	u := url.URL{Scheme: "http", Host: addr.String(), Path: path}
+	return u.String()
+}
+
+func (r *Relay) Handshake(endpoint string, offer signaler.SDP) (answer *signaler.SDP, ierr error) {
+	answer, ierr = r.Signaler.Handshake(endpoint, offer)
+	if !r.relayable(endpoint, ierr) {
+		return
+	}
+	a, err := r.handshakeRelay(endpoint, Offer{SDP: offer})
+	if err != nil {
+		return nil, errors.Join(ierr, err)
+	}
+	return &a.SDP, nil
+}
+
+// HandshakeTrickle 只有完整的 offer 才能转发, 不完整的 offer 失败后下次会使用完整的 offer
+func (r *Relay) HandshakeTrickle(endpoint string, offer signaler.SDP, t *Trickle) (answer *signaler.SDP, ierr error) {
+	answer, ierr = r.Signaler.HandshakeTrickle(endpoint, offer, t)
+	if t.Partial || !r.relayable(endpoint, ierr) {
+		return
+	}
+	a, err := r.handshakeRelay(endpoint, Offer{SDP: offer})
+	if err != nil {
+		return nil, errors.Join(ierr, err)
+	}
+	return &a.SDP, nil
+}
+
+// relayable 判断 hub 握手失败后是否需要转发, 对方签名的拒绝才不转发, 没有验证过的可能是 hub 伪造的
+func (r *Relay) relayable(endpoint string, err error) bool {
+	if err == nil || isVerifiedReject(err) || isLAN(endpoint) {
+		return false
+	}
+	return r.Peers != nil && r.Addr != nil
+}
+
+// handshakeRelay 依次通过已经连接的 peer 转发 offer
+func (r *Relay) handshakeRelay(endpoint string, offer Offer) (answer *Answer, ierr error) {
+	logger := slog.With(
+		"act", "relay handshake",
+		"endpoint", endpoint,
+	)
+	logger.Debug("pending")
+	defer then(&ierr, func() {
+		logger.Info("successful")
+	}, func() {
+		logger.Debug("failed", "err", ierr)
+	})
+
+	target, ierr := peerOf(endpoint)
+	if ierr != nil {
+		return
+	}
+	tries := 0
+	ierr = ErrNoRelay
+	for _, via := range r.Peers() {
+		if string(via) == string(target) {
+			continue
+		}
+		if tries++; tries > maxRelayTries {
+			break
+		}
+		link := r.link(via, "/relay") + "?peer=" + hex.EncodeToString(target)
+		// 每次重新签名, 否则经过上一个节点到达的 offer 会被当作重放
+		answer, ierr = r.postOffer(r.client, link, endpoint, offer)
+		// 转发的节点也可以伪造拒绝, 没有验证过时继续尝试下一个
+		if ierr == nil || isVerifiedReject(ierr) {
+			return
+		}
+		logger.Debug("relay failed", "via", hex.EncodeToString(via), "err", ierr)
+	}
+	return
+}
+
+func (r *Relay) Accept() (offerCh <-chan signaler.Session, ierr error) {
+	in, ierr := r.Signaler.Accept()
+	if ierr != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.locker.Lock()
+	r.cancel = cancel
+	r.locker.Unlock()
+	ch := make(chan signaler.Session, 512)
+	go func() {
+		for sess := range in {
+			ch <- sess
+		}
+	}()
+	go r.serve(ctx, ch)
+	return ch, nil
+}
+
+func (r *Relay) Close() error {
+	r.locker.Lock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.locker.Unlock()
+	return r.Signaler.Close()
+}
+
+// serve 在隧道 ip 上监听, 启动时隧道的地址可能还没有设置, 所以一直重试
+func (r *Relay) serve(ctx context.Context, ch chan<- signaler.Session) {
+	logger := slog.With("act", "serve relay", "port", r.Port)
+	pubkey, err := r.Key.PublicKey()
+	if err != nil || r.Addr == nil {
+		logger.Warn("relay is not available", "err", err)
+		return
+	}
+	addr := netip.AddrPortFrom(r.Addr(pubkey), r.Port)
+	var l net.Listener
+	for {
+		if l, err = r.listen(addr); err == nil {
+			break
+		}
+		logger.Debug("listen failed, retry", "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	logger.Debug("successful", "addr", addr)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/offer", r.handleOffer(ctx, ch, relayLink))
+	mux.HandleFunc("/relay", r.handleRelay)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	server.Serve(l)
+}
+
+// handleRelay 把 offer 转发给已经连接的 peer
+func (r *Relay) handleRelay(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := hex.DecodeString(req.URL.Query().Get("peer"))
+	if err != nil || !r.connected(target) {
+		relayedOffers.Inc("refused")
+		http.Error(w, "peer is not connected", http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxLANOffer))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), lanAnswerTimeout+2*time.Second)
+	defer cancel()
+	fwd, err := http.NewRequestWithContext(ctx, http.MethodPost, r.link(target, "/offer"), bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fwd.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(fwd)
+	if err != nil {
+		relayedOffers.Inc("failure")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	relayedOffers.Inc("forwarded")
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, io.LimitReader(resp.Body, maxLANOffer))
+}
+
+func (r *Relay) connected(pubkey []byte) bool {
+	if len(pubkey) != 32 || r.Peers == nil {
+		return false
+	}
+	for _, p := range r.Peers() {
+		if string(p) == string(pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+var ErrNoRelay = errors.New("no connected peer to relay the offer")
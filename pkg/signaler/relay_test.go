@@ -0,0 +1,92 @@
+package signaler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/signaler"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestRelay(t *testing.T) {
+	l := try.To1(net.Listen("tcp", "127.0.0.1:0"))
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	// 每个节点使用不同的回环地址模拟隧道中的 ip
+	keys := make([]wgtypes.Key, 4)
+	addrs := map[string]netip.Addr{}
+	for i := range keys {
+		keys[i] = try.To1(wgtypes.GeneratePrivateKey())
+		pubkey := keys[i].PublicKey()
+		addrs[string(pubkey[:])] = netip.AddrFrom4([4]byte{127, 0, 0, byte(i + 2)})
+	}
+	pubkeyOf := func(i int) []byte {
+		pubkey := keys[i].PublicKey()
+		return pubkey[:]
+	}
+	relays := make([]*Relay, 3) // keys[3] 是伪造拒绝的节点
+	for i := range relays {
+		r := NewRelay(New(keys[i][:], nil), port)
+		r.Addr = func(pubkey []byte) netip.Addr { return addrs[string(pubkey)] }
+		relays[i] = r
+	}
+	a, b, c := relays[0], relays[1], relays[2]
+	// a 和 c 都只连上了 b
+	a.Peers = func() [][]byte { return [][]byte{pubkeyOf(1)} }
+	b.Peers = func() [][]byte { return [][]byte{pubkeyOf(0), pubkeyOf(2)} }
+	c.Peers = func() [][]byte { return [][]byte{pubkeyOf(1)} }
+
+	for _, r := range relays[1:] {
+		defer r.Close()
+		ch := try.To1(r.Accept())
+		go func() {
+			for sess := range ch {
+				assert.Equal(sess.Description().SDP, "relay-offer")
+				sess.Resolve(&signaler.SDP{Type: webrtc.SDPTypeAnswer, SDP: "relay-answer"})
+			}
+		}()
+	}
+
+	// hub 连不上时通过 b 转发
+	endpoint := "http://127.0.0.1:1?peer=" + hex.EncodeToString(pubkeyOf(2))
+	offer := signaler.SDP{Type: webrtc.SDPTypeOffer, SDP: "relay-offer"}
+	var answer *signaler.SDP
+	for i := 0; i < 50; i++ { // 等待监听
+		if answer, _ = a.Handshake(endpoint, offer); answer != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NotNil(answer)
+	assert.Equal(answer.SDP, "relay-answer")
+
+	// b 只转发给已经连接的 peer
+	other := try.To1(wgtypes.GeneratePrivateKey()).PublicKey()
+	_, err := a.Handshake("http://127.0.0.1:1?peer="+hex.EncodeToString(other[:]), offer)
+	assert.Error(err)
+
+	// hub 和转发节点伪造的拒绝没有签名, 不影响通过 b 转发
+	forged := func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Answer{SDP: signaler.SDP{Type: webrtc.SDPTypeRollback}, Reject: Reject(RejectForbidden, nil)})
+	}
+	hub := httptest.NewServer(http.HandlerFunc(forged))
+	defer hub.Close()
+	fake := httptest.NewUnstartedServer(http.HandlerFunc(forged))
+	fake.Listener.Close()
+	fake.Listener = try.To1(net.Listen("tcp", netip.AddrPortFrom(addrs[string(pubkeyOf(3))], port).String()))
+	fake.Start()
+	defer fake.Close()
+	a.Peers = func() [][]byte { return [][]byte{pubkeyOf(3), pubkeyOf(1)} }
+	answer = try.To1(a.Handshake(hub.URL+"?peer="+hex.EncodeToString(pubkeyOf(2)), offer))
+	assert.Equal(answer.SDP, "relay-answer")
+}
@@ -0,0 +1,57 @@
+package signaler
+
+import "sync"
+
+// SSE 重连时带上 Last-Event-ID, hub 可以补发断开期间的 offer.
+// 补发的事件可能已经处理过, 所以按事件 id 去重, 同一个 offer 不会回复两次
+
+// maxRecentEvents 是每个 hub 记住的事件 id 数量
+const maxRecentEvents = 1024
+
+type eventLog struct {
+	locker *sync.Mutex
+	last   map[string]string
+	recent map[string]*recentEvents
+}
+
+type recentEvents struct {
+	ids   map[string]struct{}
+	order []string
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{
+		locker: &sync.Mutex{},
+		last:   make(map[string]string),
+		recent: make(map[string]*recentEvents),
+	}
+}
+
+// add 记录 server 的事件 id, 返回是否已经见过
+func (l *eventLog) add(server, id string) (seen bool) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	l.last[server] = id
+	r := l.recent[server]
+	if r == nil {
+		r = &recentEvents{ids: make(map[string]struct{})}
+		l.recent[server] = r
+	}
+	if _, ok := r.ids[id]; ok {
+		return true
+	}
+	r.ids[id] = struct{}{}
+	r.order = append(r.order, id)
+	if len(r.order) > maxRecentEvents {
+		delete(r.ids, r.order[0])
+		r.order = r.order[1:]
+	}
+	return false
+}
+
+// lastID 返回 server 最后一个事件 id
+func (l *eventLog) lastID(server string) string {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	return l.last[server]
+}
@@ -0,0 +1,68 @@
+package signaler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestResume(t *testing.T) {
+	lastIDs := make(chan string, 2)
+	conns := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			return
+		}
+		conns++
+		lastIDs <- r.Header.Get("Last-Event-ID")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		offer := func(id int) {
+			fmt.Fprintf(w, "id: %d\ndata: {\"type\":\"offer\",\"sdp\":\"%d\"}\n\n", id, id)
+		}
+		switch conns {
+		case 1:
+			offer(1)
+		default:
+			// 补发断开期间的事件, 其中 1 已经处理过了
+			offer(1)
+			offer(2)
+		}
+		w.(http.Flusher).Flush()
+		if conns > 1 {
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	key := try.To1(wgtypes.GeneratePrivateKey())
+	s := New(key[:], []string{server.URL})
+	s.AllowUnsigned = true
+	defer s.Close()
+	ch := try.To1(s.Accept())
+
+	var sdps []string
+	timeout := time.After(5 * time.Second)
+	for len(sdps) < 2 {
+		select {
+		case sess := <-ch:
+			sdps = append(sdps, sess.Description().SDP)
+		case <-timeout:
+			t.Fatal("offers are not received")
+		}
+	}
+	assert.Equal(<-lastIDs, "")
+	assert.Equal(<-lastIDs, "1")
+	assert.DeepEqual(sdps, []string{"1", "2"})
+	select {
+	case sess := <-ch:
+		t.Fatalf("replayed offer %s is handled twice", sess.Description().SDP)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,136 @@
+package signaler
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// offer, answer 和 trickle 的 candidate 里有双方真实的内网和公网 ip, 不应该让 hub 看到.
+// 发送方生成临时 X25519 密钥, 和接收方的 WireGuard 公钥协商出 ChaCha20-Poly1305 的密钥,
+// 密文是 base64(临时公钥 || 密文), hub 只能看到 sealed 字段.
+//   - offer 用 endpoint 的 peer 参数加密, 签名在密文里面
+//   - answer, 拒绝和接收方的 candidate 用 offer 签名中的 from 加密
+//   - hub 根据 X-Xhe-Reject 头返回拒绝的状态码, 不需要解开 body
+
+// seal 把 plaintext 加密给 to
+func seal(to []byte, plaintext []byte) (box string, ierr error) {
+	if len(to) != curve25519.PointSize {
+		return "", ErrSealKey
+	}
+	eph := make([]byte, curve25519.ScalarSize)
+	if _, ierr = rand.Read(eph); ierr != nil {
+		return
+	}
+	ephPub, ierr := curve25519.X25519(eph, curve25519.Basepoint)
+	if ierr != nil {
+		return
+	}
+	ss, ierr := curve25519.X25519(eph, to)
+	if ierr != nil {
+		return
+	}
+	aead, ierr := sealAEAD(ss, ephPub, to)
+	if ierr != nil {
+		return
+	}
+	// 每次都是新的临时密钥, nonce 固定为 0 是安全的
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	b := aead.Seal(append([]byte{}, ephPub...), nonce, plaintext, ephPub)
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// open 用自己的私钥解开 seal 的密文
+func (s *Signaler) open(box string) (plaintext []byte, ierr error) {
+	b, ierr := base64.StdEncoding.DecodeString(box)
+	if ierr != nil {
+		return
+	}
+	if len(b) < curve25519.PointSize+chacha20poly1305.Overhead {
+		return nil, ErrSealed
+	}
+	ephPub, ciphertext := b[:curve25519.PointSize], b[curve25519.PointSize:]
+	pubkey, ierr := s.Key.PublicKey()
+	if ierr != nil {
+		return
+	}
+	ss, ierr := curve25519.X25519(s.Key, ephPub)
+	if ierr != nil {
+		return nil, ErrSealed
+	}
+	aead, ierr := sealAEAD(ss, ephPub, pubkey)
+	if ierr != nil {
+		return
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	plaintext, ierr = aead.Open(nil, nonce, ciphertext, ephPub)
+	if ierr != nil {
+		return nil, ErrSealed
+	}
+	return
+}
+
+// sealAEAD 由 X25519 的共享密钥, 临时公钥和接收方公钥派生出加密密钥
+func sealAEAD(ss, ephPub, to []byte) (cipher.AEAD, error) {
+	h, _ := blake2s.New256(nil)
+	h.Write([]byte("xhe-seal"))
+	h.Write(ss)
+	h.Write(ephPub)
+	h.Write(to)
+	return chacha20poly1305.New(h.Sum(nil))
+}
+
+func sealJSON(to []byte, v any) (box string, ierr error) {
+	b, ierr := json.Marshal(v)
+	if ierr != nil {
+		return
+	}
+	return seal(to, b)
+}
+
+func (s *Signaler) openJSON(box string, v any) (ierr error) {
+	b, ierr := s.open(box)
+	if ierr != nil {
+		return
+	}
+	return json.Unmarshal(b, v)
+}
+
+// sealTo 返回发往 endpoint 的消息要加密给的 pubkey, 不加密时返回 nil
+func (s *Signaler) sealTo(endpoint string) []byte {
+	if s.PlainSDP {
+		return nil
+	}
+	to, _ := peerOf(endpoint)
+	return to
+}
+
+// peerOf 返回 endpoint 的 peer 参数, 也就是接收方的 pubkey. lan:// 的 pubkey 是 host
+func peerOf(endpoint string) (pubkey []byte, ierr error) {
+	u, ierr := url.Parse(endpoint)
+	if ierr != nil {
+		return
+	}
+	peer := u.Query().Get("peer")
+	if u.Scheme == lanLink {
+		peer = u.Hostname()
+	}
+	pubkey, ierr = hex.DecodeString(peer)
+	if ierr != nil || len(pubkey) != 32 {
+		return nil, ErrPeerRequired
+	}
+	return
+}
+
+var (
+	ErrSealKey = errors.New("seal requires a 32 bytes pubkey")
+	ErrSealed  = errors.New("could not open sealed message")
+)
@@ -0,0 +1,82 @@
+package signaler
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/signaler"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestSeal(t *testing.T) {
+	key := try.To1(wgtypes.GeneratePrivateKey())
+	pubkey := key.PublicKey()
+	s := New(key[:], nil)
+	box := try.To1(seal(pubkey[:], []byte("hello")))
+	assert.DeepEqual(try.To1(s.open(box)), []byte("hello"))
+
+	key2 := try.To1(wgtypes.GeneratePrivateKey())
+	other := New(key2[:], nil)
+	_, err := other.open(box)
+	assert.Equal(err, ErrSealed)
+}
+
+func TestSealedHandshake(t *testing.T) {
+	hub := newTestHub(true)
+	locker := &sync.Mutex{}
+	var seen [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := try.To1(io.ReadAll(r.Body))
+		locker.Lock()
+		seen = append(seen, b)
+		locker.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		hub.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	key1 := try.To1(wgtypes.GeneratePrivateKey())
+	key2 := try.To1(wgtypes.GeneratePrivateKey())
+	s1 := New(key1[:], []string{server.URL})
+	defer s1.Close()
+	s2 := New(key2[:], nil)
+
+	ch := try.To1(s1.Accept())
+	go func() {
+		for sess := range ch {
+			assert.Equal(sess.Description().SDP, "secret-offer")
+			tr := sess.(*Session).Trickle()
+			tr.Send(testCandidate("secret-candidate"))
+			tr.Send(nil)
+			sess.Resolve(&signaler.SDP{Type: webrtc.SDPTypeAnswer, SDP: "secret-answer"})
+		}
+	}()
+
+	pubkey := key1.PublicKey()
+	endpoint := server.URL + "?peer=" + hex.EncodeToString(pubkey[:])
+	tr := s2.Trickle(endpoint)
+	answer := try.To1(s2.HandshakeTrickle(endpoint, signaler.SDP{Type: webrtc.SDPTypeOffer, SDP: "secret-offer"}, tr))
+	assert.Equal(answer.SDP, "secret-answer")
+	var remote []string
+	for c := range tr.Remote() {
+		remote = append(remote, c.Candidate)
+	}
+	assert.SLen(remote, 1)
+	assert.Equal(remote[0], "secret-candidate")
+
+	// hub 只能看到密文
+	locker.Lock()
+	defer locker.Unlock()
+	for _, b := range seen {
+		assert.ThatNot(strings.Contains(string(b), "secret"))
+	}
+}
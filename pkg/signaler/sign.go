@@ -1,22 +1,32 @@
 package signaler
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"time"
 
+	"github.com/r3labs/sse/v2"
 	"github.com/shynome/go-x25519"
 )
 
 func SignURL(link string, privkey x25519.PrivateKey) (u *url.URL, ierr error) {
+	return signURL(link, privkey, time.Now())
+}
+
+func signURL(link string, privkey x25519.PrivateKey, now time.Time) (u *url.URL, ierr error) {
 	u, ierr = url.Parse(link)
 	if ierr != nil {
 		return
 	}
 	pubkey, _ := privkey.PublicKey()
-	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	timestamp := fmt.Sprintf("%d", now.Unix())
 	signature, ierr := x25519.Sign(rand.Reader, privkey, []byte(timestamp))
 	if ierr != nil {
 		return
@@ -29,3 +39,136 @@ func SignURL(link string, privkey x25519.PrivateKey) (u *url.URL, ierr error) {
 	u.Fragment = ""
 	return
 }
+
+// SignURL 只签名了时间戳, 截获的链接在时间窗口内可以用在同一个 hub 的任何请求上.
+// v2 签名放在请求头里, 覆盖请求方法, 路径, 目标 peer, body 的哈希, 随机 nonce
+// 和决定请求落到哪个事件上的请求头 (没有时是空行):
+//
+//	xhe-v2\n{method}\n{path}\n{peer}\n{hex(sha256(body))}\n{timestamp}\n{nonce}
+//	\n{X-Event-Id}\n{X-Xhe-Reject}\n{X-Xhe-Session}
+//
+// hub 需要拒绝时间窗口内重复的 nonce
+
+const (
+	HeaderPubkey    = "X-Xhe-Pubkey"
+	HeaderTimestamp = "X-Xhe-Timestamp"
+	HeaderNonce     = "X-Xhe-Nonce"
+	HeaderSignature = "X-Xhe-Signature"
+)
+
+// SignMode 决定请求怎么签名
+type SignMode string
+
+const (
+	// SignCompat 同时带上 v1 的链接参数和 v2 的请求头, 旧版本的 hub 只认识前者. 空值也是 SignCompat
+	SignCompat SignMode = "compat"
+	// SignV2 只使用 v2 签名, hub 需要支持
+	SignV2 SignMode = "v2"
+)
+
+// headerEventID 指明请求回复的是哪个事件
+const headerEventID = "X-Event-Id"
+
+// signedHeaders 是 v2 签名覆盖的请求头, 按顺序接在 nonce 后面
+var signedHeaders = []string{headerEventID, headerReject, headerSession}
+
+func signMessage(req *http.Request, body []byte, timestamp, nonce string) []byte {
+	msg := fmt.Sprintf("xhe-v2\n%s\n%s\n%s\n%x\n%s\n%s", req.Method, req.URL.Path, req.URL.Query().Get("peer"), sha256.Sum256(body), timestamp, nonce)
+	for _, k := range signedHeaders {
+		msg += "\n" + req.Header.Get(k)
+	}
+	return []byte(msg)
+}
+
+// SignRequest 给请求加上 v2 签名头, body 是请求的完整 body. 被签名的请求头要在这之前设置好
+func SignRequest(req *http.Request, body []byte, privkey x25519.PrivateKey) (ierr error) {
+	return signRequest(req, body, privkey, time.Now())
+}
+
+func signRequest(req *http.Request, body []byte, privkey x25519.PrivateKey, now time.Time) (ierr error) {
+	pubkey, ierr := privkey.PublicKey()
+	if ierr != nil {
+		return
+	}
+	timestamp := fmt.Sprintf("%d", now.Unix())
+	nonce := randomID()
+	msg := signMessage(req, body, timestamp, nonce)
+	signature, ierr := x25519.Sign(rand.Reader, privkey, msg)
+	if ierr != nil {
+		return
+	}
+	req.Header.Set(HeaderPubkey, hex.EncodeToString(pubkey))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, hex.EncodeToString(signature))
+	return
+}
+
+// VerifyRequest 验证 v2 签名, 返回签名者的 pubkey. nonce 是否重复由调用方检查
+func VerifyRequest(req *http.Request, body []byte, maxAge time.Duration) (pubkey x25519.PublicKey, ierr error) {
+	h := req.Header
+	pubkey, ierr = hex.DecodeString(h.Get(HeaderPubkey))
+	if ierr != nil || len(pubkey) != 32 {
+		return nil, ErrRequestSignature
+	}
+	var ts int64
+	if _, ierr = fmt.Sscan(h.Get(HeaderTimestamp), &ts); ierr != nil {
+		return nil, ErrRequestSignature
+	}
+	age := time.Since(time.Unix(ts, 0))
+	if age > maxAge || age < -maxAge {
+		return nil, ErrRequestExpired
+	}
+	signature, ierr := hex.DecodeString(h.Get(HeaderSignature))
+	if ierr != nil {
+		return nil, ErrRequestSignature
+	}
+	msg := signMessage(req, body, h.Get(HeaderTimestamp), h.Get(HeaderNonce))
+	if h.Get(HeaderNonce) == "" || !x25519.Verify(pubkey, msg, signature) {
+		return nil, ErrRequestSignature
+	}
+	return pubkey, nil
+}
+
+// newRequest 创建并签名发往 hub 的请求
+// newRequest 创建签名过的请求, header 会在签名前设置上
+func (s *Signaler) newRequest(ctx context.Context, method string, link string, body []byte, header http.Header) (req *http.Request, ierr error) {
+	u, ierr := url.Parse(link)
+	if ierr != nil {
+		return
+	}
+	// 没有设置时是 SignCompat
+	if s.Signing == "" || s.Signing == SignCompat {
+		if u, ierr = signURL(link, s.Key, s.now(u.Host)); ierr != nil {
+			return
+		}
+	}
+	u.Fragment = ""
+	req, ierr = http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if ierr != nil {
+		return
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	ierr = signRequest(req, body, s.Key, s.now(u.Host))
+	return
+}
+
+// signSSE 重新签名 sse 的订阅请求, 每次重连前都要调用
+func (s *Signaler) signSSE(c *sse.Client, link string) (ierr error) {
+	req, ierr := s.newRequest(context.Background(), http.MethodGet, link, nil, nil)
+	if ierr != nil {
+		return
+	}
+	c.URL = req.URL.String()
+	for k := range req.Header {
+		c.Headers[k] = req.Header.Get(k)
+	}
+	return
+}
+
+var (
+	ErrRequestSignature = errors.New("request signature is invalid")
+	ErrRequestExpired   = errors.New("request timestamp is out of window")
+)
@@ -0,0 +1,63 @@
+package signaler
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestSignRequest(t *testing.T) {
+	key := try.To1(wgtypes.GeneratePrivateKey())
+	pubkey := key.PublicKey()
+	s := New(key[:], nil)
+	link := "https://hub.example/path?peer=" + hex.EncodeToString(pubkey[:])
+	body := []byte(`{"type":"answer"}`)
+
+	req := try.To1(s.newRequest(context.Background(), http.MethodDelete, link, body, nil))
+	// 兼容模式同时带上 v1 的链接参数
+	assert.NotEqual(req.URL.Query().Get("signature"), "")
+	signer := try.To1(VerifyRequest(req, body, time.Minute))
+	assert.DeepEqual([]byte(signer), pubkey[:])
+
+	s.Signing = SignCompat
+	req = try.To1(s.newRequest(context.Background(), http.MethodDelete, link, body, nil))
+	assert.NotEqual(req.URL.Query().Get("signature"), "")
+
+	s.Signing = SignV2
+	req = try.To1(s.newRequest(context.Background(), http.MethodDelete, link, body, nil))
+	assert.Equal(req.URL.Query().Get("signature"), "")
+	try.To1(VerifyRequest(req, body, time.Minute))
+
+	// 换了 body, 方法或者路径都无法通过验证
+	_, err := VerifyRequest(req, []byte(`{}`), time.Minute)
+	assert.Equal(err, ErrRequestSignature)
+	req.Method = http.MethodPost
+	_, err = VerifyRequest(req, body, time.Minute)
+	assert.Equal(err, ErrRequestSignature)
+	req.Method = http.MethodDelete
+	req.URL.Path = "/other"
+	_, err = VerifyRequest(req, body, time.Minute)
+	assert.Equal(err, ErrRequestSignature)
+
+	// 决定请求落到哪个事件上的请求头也被签名了, 截获的请求不能换到别的事件上
+	header := http.Header{headerEventID: {"event-a"}, headerReject: {string(RejectForbidden)}}
+	tampers := []struct{ key, value string }{
+		{headerEventID, "event-b"},
+		{headerReject, string(RejectBusy)},
+		{headerReject, ""},
+		{headerSession, "session"},
+	}
+	for _, tc := range tampers {
+		req = try.To1(s.newRequest(context.Background(), http.MethodDelete, link, body, header))
+		try.To1(VerifyRequest(req, body, time.Minute))
+		req.Header.Set(tc.key, tc.value)
+		_, err = VerifyRequest(req, body, time.Minute)
+		assert.Equal(err, ErrRequestSignature, tc.key)
+	}
+}
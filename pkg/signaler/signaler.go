@@ -1,7 +1,6 @@
 package signaler
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,12 +8,14 @@ import (
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pion/mdns"
 	"github.com/r3labs/sse/v2"
 	"github.com/shynome/go-x25519"
 	"github.com/shynome/wgortc/signaler"
-	"golang.org/x/sync/errgroup"
 )
 
 type Signaler struct {
@@ -22,17 +23,66 @@ type Signaler struct {
 	servers []string
 	Client  *http.Client
 
+	// AllowUnsigned 接受旧版本发起方没有签名的 offer
+	AllowUnsigned bool
+	// PlainSDP 不加密发出的 offer, 对方是不支持加密的旧版本时使用
+	PlainSDP bool
+	// Signing 是请求的签名方式, 默认兼容旧版本的 hub
+	Signing SignMode
+	// RequireLinks 是 Accept 时至少要连上的链接数, 默认为 1. 为 0 时都连不上也继续, 小于 0 时要求全部连上
+	RequireLinks int
+	// LANPort 不为 0 时通过 mDNS 公布自己, 并在这个端口接收局域网内的 offer, 见 lan.go
+	LANPort uint16
+	// Limits 限制接收 offer 的速度和数量, 默认为 DefaultOfferLimits, 在 Accept 之前设置
+	Limits OfferLimits
+	// HA 为 true 时 hub 返回 423 Locked 的链接不算失败, 这个实例作为 standby 等待接管, 见 standby.go
+	HA bool
+	// Priority 是 HA 模式下接管的优先级, 0 到 MaxPriority, 高的先接管
+	Priority int
+	// OnRole 在 HA 模式下角色变化时调用, active 为 false 时是 standby
+	OnRole func(active bool)
+
+	clocks *clockOffsets // 本地时钟和每个 hub 的偏差, 见 clock.go
+
 	cancel context.CancelCauseFunc
+	seen   *seenOffers
+	events *eventLog
+	health *linkHealth
+	limits *offerLimiter
+	ha     *haState
+
+	locker           *sync.Mutex
+	trickles         map[string]*Trickle
+	trickleHubs      map[string]bool // 订阅的 hub 是否支持转发 candidate
+	trickleEndpoints map[string]bool // 已知支持 trickle ICE 的 endpoint
+	mdns             *mdns.Conn
+	lanPeers         map[string]lanPeer
+	resolveLAN       func(ctx context.Context, name string) (addr string, err error) // 测试时替换 mDNS
 }
 
 var _ signaler.Channel = (*Signaler)(nil)
 
 func New(key x25519.PrivateKey, servers []string) *Signaler {
-	return &Signaler{
-		Key:     key,
-		servers: servers,
-		Client:  http.DefaultClient,
+	s := &Signaler{
+		Key:          key,
+		servers:      servers,
+		Client:       http.DefaultClient,
+		RequireLinks: 1,
+		Limits:       DefaultOfferLimits,
+		seen:         newSeenOffers(),
+		events:       newEventLog(),
+		health:       newLinkHealth(),
+		ha:           newHAState(),
+		clocks:       newClockOffsets(),
+
+		locker:           &sync.Mutex{},
+		trickles:         make(map[string]*Trickle),
+		trickleHubs:      make(map[string]bool),
+		trickleEndpoints: make(map[string]bool),
+		lanPeers:         make(map[string]lanPeer),
 	}
+	s.health.onChange = s.updateRole
+	return s
 }
 
 func (s *Signaler) Handshake(endpoint string, offer signaler.SDP) (answer *signaler.SDP, ierr error) {
@@ -41,54 +91,133 @@ func (s *Signaler) Handshake(endpoint string, offer signaler.SDP) (answer *signa
 		"endpoint", endpoint,
 	)
 	logger.Debug("pending")
+	start := time.Now()
 	defer then(&ierr, func() {
 		logger.Debug("successful")
+		handshakeTotal.Inc("success")
+		handshakeDuration.Observe(time.Since(start).Seconds())
 	}, func() {
 		logger.Warn("failed", "err", ierr)
+		var rejection *RejectError
+		if errors.As(ierr, &rejection) {
+			handshakeTotal.Inc("rejected")
+			return
+		}
+		handshakeTotal.Inc("failure")
 	})
 
-	b, ierr := json.Marshal(offer)
-	if ierr != nil {
-		return
+	a, ierr := s.handshake(endpoint, Offer{SDP: offer})
+	if errors.Is(ierr, errClockSkew) {
+		a, ierr = s.handshake(endpoint, Offer{SDP: offer})
 	}
-	body := bytes.NewBuffer(b)
-	link, ierr := SignURL(endpoint, s.Key)
 	if ierr != nil {
 		return
 	}
-	req, ierr := http.NewRequest(http.MethodPost, link.String(), body)
+	return &a.SDP, nil
+}
+
+// handshake 签名并发送 offer, 对方在局域网中时直接发给对方
+func (s *Signaler) handshake(endpoint string, offer Offer) (answer *Answer, ierr error) {
+	if addr, ok := s.lookupLAN(endpoint); ok {
+		answer, ierr = s.handshakeLAN(addr, endpoint, offer)
+		if ierr == nil || isVerifiedReject(ierr) {
+			return
+		}
+		// mDNS 的回答没有鉴权, 没有验证过的拒绝可能是局域网中的其他设备伪造的
+		s.forgetLAN(endpoint)
+		if isLAN(endpoint) {
+			return
+		}
+		slog.Debug("lan handshake failed, fallback to signaler server", "endpoint", endpoint, "err", ierr)
+	} else if isLAN(endpoint) {
+		return nil, ErrLANNotFound
+	}
+	if isWS(endpoint) {
+		ws, ierr := s.dialWS(endpoint)
+		if ierr != nil {
+			return nil, ierr
+		}
+		defer ws.Close()
+		return s.handshakeWS(ws, endpoint, offer)
+	}
+	b, ierr := s.offerBody(endpoint, &offer)
 	if ierr != nil {
 		return
 	}
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
-	req = req.WithContext(ctx)
-	resp, ierr := s.Client.Do(req)
+	req, ierr := s.newRequest(ctx, http.MethodPost, endpoint, b, nil)
 	if ierr != nil {
 		return
 	}
-	ierr = checkResponse(resp)
+	resp, ierr := s.do(req)
 	if ierr != nil {
 		return
 	}
-	answer = new(signaler.SDP)
+	defer resp.Body.Close()
+	answer = new(Answer)
+	if ierr = checkResponse(resp); ierr != nil {
+		// hub 可能根据 X-Xhe-Reject 返回错误的状态码, body 中仍然是拒绝原因
+		if json.NewDecoder(resp.Body).Decode(answer) == nil && (answer.Reject != nil || answer.Sealed != "") {
+			var rejection *RejectError
+			if _, err := s.openAnswer(endpoint, offer, answer); errors.As(err, &rejection) {
+				return nil, rejection
+			}
+		}
+		return nil, ierr
+	}
 	ierr = json.NewDecoder(resp.Body).Decode(answer)
 	if ierr != nil {
 		return
 	}
-	return
+	return s.openAnswer(endpoint, offer, answer)
+}
+
+// offerBody 签名并加密 offer, 签名留在 offer 里用来验证对方的拒绝
+func (s *Signaler) offerBody(endpoint string, offer *Offer) (b []byte, ierr error) {
+	if ierr = s.signOffer(endpoint, offer); ierr != nil {
+		return
+	}
+	if to := s.sealTo(endpoint); to != nil {
+		box, ierr := sealJSON(to, offer)
+		if ierr != nil {
+			return nil, ierr
+		}
+		return json.Marshal(Offer{SDP: signaler.SDP{Type: offer.Type}, Sealed: box})
+	}
+	return json.Marshal(offer)
+}
+
+// openAnswer 解开加密的 answer, 拒绝时返回 RejectError. offer 是 offerBody 签名过的
+func (s *Signaler) openAnswer(endpoint string, offer Offer, answer *Answer) (_ *Answer, ierr error) {
+	if answer.Sealed != "" {
+		box := answer.Sealed
+		answer = new(Answer)
+		if ierr = s.openJSON(box, answer); ierr != nil {
+			return nil, ierr
+		}
+	}
+	if rejection := answer.Reject; rejection != nil {
+		rejection.verified = s.verifyReject(endpoint, offer.Sig, rejection)
+		return nil, rejection
+	}
+	return answer, nil
 }
+
 func (s *Signaler) Accept() (offerCh <-chan signaler.Session, ierr error) {
 	ctx := context.Background()
 	ctx, s.cancel = context.WithCancelCause(ctx)
-	if len(s.servers) == 0 {
+	s.limits = newOfferLimiter(s.Limits)
+	if len(s.servers) == 0 && s.LANPort == 0 {
 		ch := make(chan signaler.Session)
 		close(ch)
 		return ch, nil
 	}
 	ch, ierr := s.subscribeAll(ctx)
 	if ierr != nil {
+		// 停止后台重试
+		s.cancel(ierr)
 		return
 	}
 	return ch, nil
@@ -100,22 +229,6 @@ func (s *Signaler) Close() error {
 	return nil
 }
 
-func (s *Signaler) subscribeAll(ctx context.Context) (ch chan signaler.Session, ierr error) {
-	ch = make(chan signaler.Session, 512)
-	g := new(errgroup.Group)
-	for _, _server := range s.servers {
-		server := _server
-		g.Go(func() (err error) {
-			return s.subscribe(ctx, ch, server)
-		})
-	}
-	ierr = g.Wait()
-	if ierr != nil {
-		return
-	}
-	return
-}
-
 func (s *Signaler) subscribe(ctx context.Context, ch chan<- signaler.Session, server string) (ierr error) {
 	logger := slog.With(
 		"act", "subscribe",
@@ -128,35 +241,65 @@ func (s *Signaler) subscribe(ctx context.Context, ch chan<- signaler.Session, se
 		logger.Warn("failed", "err", ierr)
 	})
 
-	u, ierr := SignURL(server, s.Key)
-	if ierr != nil {
-		return
-	}
-	c := sse.NewClient(u.String(), func(c *sse.Client) {
+	// make sure the first connect is fine. 启动时可能已经不再等待, 所以不能阻塞
+	var errch = make(chan error, 1)
+	var first sync.Once
+	// responded 表示这次连接收到了响应, 结果已经在 ResponseValidator 中处理
+	var responded atomic.Bool
+	c := sse.NewClient(server, func(c *sse.Client) {
 		c.Connection = s.Client
-		c.ReconnectStrategy = NewReconnectStrategy(ctx, time.Second)
+		retry := NewReconnectStrategy(ctx, time.Second)
+		retry.delay = func() time.Duration { return s.lockedDelay(server) }
+		c.ReconnectStrategy = retry
 		c.ReconnectNotify = func(err error, d time.Duration) {
-			u, err := SignURL(server, s.Key)
-			if err != nil {
+			if !responded.Swap(false) {
+				// 连不上 hub, 第一次连接就失败时不再等待
+				s.health.set(server, false, err)
+				first.Do(func() { errch <- err })
+			}
+			if err := s.signSSE(c, server); err != nil {
 				panic(err)
 			}
-			c.URL = u.String()
 		}
 	})
-	// make sure the first connect is fine
-	var errch = make(chan error)
-	defer close(errch)
+	if ierr = s.signSSE(c, server); ierr != nil {
+		return
+	}
+	// 重新 Accept 时从上次的位置继续
+	resume := func() {
+		if id := s.events.lastID(server); id != "" {
+			c.LastEventID.Store([]byte(id))
+		}
+	}
+	c.OnDisconnect(func(c *sse.Client) {
+		s.health.set(server, false, nil)
+	})
 	c.ResponseValidator = func(c *sse.Client, resp *http.Response) (err error) {
+		responded.Store(true)
+		// 下次重连时使用校正后的时间签名
+		skewed := s.observeDate(resp) && isAuthFailure(resp.StatusCode)
 		defer func() {
 			if resp.StatusCode == http.StatusLocked {
+				s.health.setLocked(server)
+				if s.HA {
+					// 另一个实例持有订阅, 作为 standby 也算连上了
+					logger.Debug("signaler server is locked by another instance. standby")
+					first.Do(func() { errch <- nil })
+					return
+				}
 				logger.Warn("signaler server is locked. continue try")
 				return
 			}
-			errch <- err
+			s.health.set(server, err == nil, err)
+			if skewed {
+				logger.Warn("subscription is rejected because of clock skew. retry with server time")
+				return
+			}
+			first.Do(func() { errch <- err })
 		}()
 		if resp.StatusCode == 200 {
+			s.setHubTrickle(server, resp.Header.Get(headerTrickle) != "")
 			logger.Debug("subscribed")
-			c.ResponseValidator = nil
 			return nil
 		}
 		resp.Body.Close()
@@ -165,31 +308,32 @@ func (s *Signaler) subscribe(ctx context.Context, ch chan<- signaler.Session, se
 	}
 	go func() {
 		for {
+			resume()
 			err := c.SubscribeRawWithContext(ctx, func(msg *sse.Event) {
 				if len(msg.Data) == 0 {
 					return
 				}
-				go func() (ierr error) {
-					logger.Debug("connect in")
-					defer then(&ierr, nil, func() {
-						logger.Error("sse wrong", ierr, string(msg.Data))
-					})
-					var sdp signaler.SDP
-					ierr = json.Unmarshal(msg.Data, &sdp)
-					if ierr != nil {
-						return
-					}
-					sess := &Session{
-						ctx:  ctx,
-						root: s,
-						link: server,
-						id:   string(msg.ID),
-						sdp:  sdp,
-					}
-					ch <- sess
+				if string(msg.Event) == eventCandidate {
+					s.dispatchCandidate(msg.Data)
+					return
+				}
+				if len(msg.ID) > 0 && s.events.add(server, string(msg.ID)) {
+					logger.Debug("skip replayed event", "id", string(msg.ID))
+					return
+				}
+				release, ok := s.limits.admit(server)
+				if !ok {
 					return
-				}()
+				}
+				go s.acceptOffer(ctx, ch, &Session{
+					ctx:     ctx,
+					root:    s,
+					link:    server,
+					id:      string(msg.ID),
+					release: release,
+				}, msg.Data)
 			})
+			s.health.set(server, false, err)
 			// err == nil 也继续重试, 只有当手动取消时才会退出
 			if errors.Is(err, context.Canceled) {
 				return
@@ -200,48 +344,178 @@ func (s *Signaler) subscribe(ctx context.Context, ch chan<- signaler.Session, se
 	return <-errch
 }
 
+// acceptOffer 解开并验证 offer, 通过后把 sess 交给上层
+func (s *Signaler) acceptOffer(ctx context.Context, ch chan<- signaler.Session, sess *Session, data []byte) (ierr error) {
+	logger := slog.With(
+		"act", "accept offer",
+		"server", sess.link,
+		"id", sess.id,
+	)
+	logger.Debug("connect in")
+	defer then(&ierr, nil, func() {
+		sess.done()
+		logger.Error("wrong offer", "err", ierr, "data", string(data))
+	})
+	var offer Offer
+	ierr = json.Unmarshal(data, &offer)
+	if ierr != nil {
+		return
+	}
+	if offer.Sealed != "" {
+		var inner Offer
+		if ierr = s.openJSON(offer.Sealed, &inner); ierr != nil {
+			sess.Reject(Reject(RejectInvalidOffer, ierr))
+			return
+		}
+		offer = inner
+		sess.sealed = true
+	}
+	sess.sdp = offer.SDP
+	sess.trickle = offer.Trickle
+	sess.from, ierr = s.verifyOffer(offer)
+	if ierr == nil {
+		sess.offerSig = strings.ToLower(offer.Sig.Signature)
+	}
+	if ierr != nil {
+		offersUnverified.Inc(offerVerifyReason(ierr))
+		if !(s.AllowUnsigned && errors.Is(ierr, ErrOfferUnsigned)) {
+			// 重放的 offer 也回复拒绝, hub 上的事件 id 已经失效, 不会影响原来的会话
+			code := RejectForbidden
+			if errors.Is(ierr, ErrOfferBusy) {
+				code = RejectBusy
+			}
+			sess.Reject(Reject(code, ierr))
+			return
+		}
+		ierr = nil
+	}
+	if !s.limits.allowPeer(sess.link, sess.from) {
+		sess.Reject(Reject(RejectBusy, ErrOfferRateLimited))
+		return
+	}
+	select {
+	case ch <- sess:
+	case <-ctx.Done():
+		sess.done()
+	}
+	return
+}
+
 type Session struct {
 	root *Signaler
 	ctx  context.Context
 	link string
 	id   string
 	sdp  signaler.SDP
+
+	trickle string
+	t       *Trickle
+	from    x25519.PublicKey
+	// offerSig 是验证过的 offer 签名, 拒绝的签名覆盖它
+	offerSig string
+	// sealed 为 true 时 answer 和 candidate 也加密给发起方
+	sealed bool
+	// ws 不为空时通过 WebSocket 订阅连接回复
+	ws *wsConn
+	// reply 不为空时是局域网或者 relay 直接发来的 offer, 回复作为 http 响应返回
+	reply chan []byte
+	// release 释放等待中的 offer 名额, 见 limits.go
+	release func()
 }
 
 var _ signaler.Session = (*Session)(nil)
 
 func (s *Session) Description() (offer signaler.SDP) { return s.sdp }
+
+// done 在回复之后释放 offer 名额
+func (s *Session) done() {
+	if s.release != nil {
+		s.release()
+	}
+}
+
+// Initiator 返回验证过签名的发起方 pubkey, 接受的未签名 offer 返回 nil
+func (s *Session) Initiator() []byte { return s.from }
+
+// Trickle 返回这次会话的 trickle ICE, 发起方或者 hub 不支持时返回 nil.
+// 使用后 answer 不需要等待 candidate 收集完成
+func (s *Session) Trickle() *Trickle {
+	if s.t != nil {
+		return s.t
+	}
+	if s.trickle == "" || !s.root.hubTrickle(s.link) {
+		return nil
+	}
+	t, ok := s.root.trickle(s.trickle)
+	if !ok {
+		return nil
+	}
+	t.Partial = true
+	t.start(func(msg candidateMsg) error {
+		if s.ws != nil {
+			return s.ws.sendCandidate(msg, s.id, s.sealTo())
+		}
+		return s.root.postCandidate(s.link, msg, s.id, s.sealTo())
+	})
+	s.t = t
+	return t
+}
+
+// sealTo 返回 answer 和 candidate 要加密给的 pubkey, offer 没有加密或者没有签名时返回 nil
+func (s *Session) sealTo() []byte {
+	if !s.sealed || s.from == nil {
+		return nil
+	}
+	return s.from
+}
+
 func (s *Session) Resolve(answer *signaler.SDP) (ierr error) {
 	logger := slog.With(
 		"act", "accept handshake",
 		"id", s.id,
 	)
 	logger.Debug("start")
+	defer s.done()
 	defer then(&ierr, func() {
 		logger.Debug("successful")
 	}, func() {
 		logger.Warn("failed", "err", ierr)
 	})
 
-	body, ierr := json.Marshal(answer)
+	a := Answer{SDP: *answer}
+	if t := s.t; t != nil {
+		a.Trickle, a.Partial = true, t.Partial
+	}
+	if to := s.sealTo(); to != nil {
+		box, ierr := sealJSON(to, a)
+		if ierr != nil {
+			return ierr
+		}
+		a = Answer{SDP: signaler.SDP{Type: answer.Type}, Sealed: box}
+	}
+	body, ierr := json.Marshal(a)
 	if ierr != nil {
 		return
 	}
 
-	root := s.root
-	link, ierr := SignURL(s.link, root.Key)
-	if ierr != nil {
-		return
+	if s.ws != nil {
+		return s.ws.send(wsFrame{Type: frameAnswer, ID: s.id, Data: body})
 	}
-	req, ierr := http.NewRequest(http.MethodDelete, link.String(), bytes.NewBuffer(body))
-	if ierr != nil {
+	if s.reply != nil {
+		s.replyHTTP(body)
 		return
 	}
-	req.Header.Set("X-Event-Id", s.id)
+
+	root := s.root
 	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
 	defer cancel()
-	req = req.WithContext(ctx)
-	resp, ierr := root.Client.Do(req)
+	req, ierr := root.newRequest(ctx, http.MethodDelete, s.link, body, http.Header{
+		headerEventID: {s.id},
+	})
+	if ierr != nil {
+		return
+	}
+	resp, ierr := root.do(req)
 	if ierr != nil {
 		return
 	}
@@ -252,7 +526,6 @@ func (s *Session) Resolve(answer *signaler.SDP) (ierr error) {
 
 	return
 }
-func (s *Session) Reject(err error) { return }
 
 func checkResponse(r *http.Response) error {
 	if !strings.HasPrefix(r.Status, "2") {
@@ -0,0 +1,142 @@
+package signaler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"remoon.net/xhe/pkg/metrics"
+)
+
+// HA 模式下同一个 key 可以运行两个实例, 一个 active 一个 standby.
+// hub 只允许一个订阅, 之后的订阅会收到 423 Locked:
+//   - 有订阅上的链接并且没有被锁定的链接时是 active, 能连上的链接都被锁定时是 standby
+//   - 被锁定的链接按 Priority 间隔重试, active 消失后 hub 释放锁, 优先级高的 standby 先重试, 先接管
+//   - 两个实例各自抢到一部分链接时, 持有的不多于被锁定的一方让出订阅, 按优先级延迟之后重新订阅
+//   - 角色变化时调用 OnRole, 上层据此启停路由和发送
+
+// MaxPriority 是 Priority 的最大值
+const MaxPriority = 10
+
+var ErrLinkLocked = errors.New("signaler link is locked by another instance with the same key")
+
+type haState struct {
+	locker   *sync.Mutex
+	active   bool
+	yielding bool
+	cancels  map[string]context.CancelFunc
+	// restart 重新订阅让出的链接, 在 subscribeAll 中设置
+	restart func(server string)
+}
+
+func newHAState() *haState {
+	return &haState{
+		locker:  &sync.Mutex{},
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+func (h *haState) setCancel(server string, cancel context.CancelFunc) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	h.cancels[server] = cancel
+}
+
+// Active 返回这个实例是否持有订阅, 没有开启 HA 时总是 true
+func (s *Signaler) Active() bool {
+	if !s.HA {
+		return true
+	}
+	s.ha.locker.Lock()
+	defer s.ha.locker.Unlock()
+	return s.ha.active
+}
+
+// updateRole 在链接状态变化后重新判断角色
+func (s *Signaler) updateRole() {
+	if !s.HA {
+		return
+	}
+	connected, locked := s.health.count()
+	h := s.ha
+	h.locker.Lock()
+	active, yield := h.active, false
+	switch {
+	case connected > 0 && locked == 0:
+		active = true
+	case connected == 0 && locked > 0:
+		active = false
+	case connected > 0 && locked > 0 && connected <= locked && !h.yielding:
+		active, yield = false, true
+		h.yielding = true
+	}
+	changed := active != h.active
+	h.active = active
+	h.locker.Unlock()
+
+	if yield {
+		s.yield()
+	}
+	if !changed {
+		return
+	}
+	activeGauge.Set(metrics.Bool(active))
+	if active {
+		slog.Info("become active", "act", "standby", "links", connected)
+	} else {
+		slog.Info("become standby", "act", "standby", "locked", locked)
+	}
+	if s.OnRole != nil {
+		s.OnRole(active)
+	}
+}
+
+// yield 让出持有的订阅, 延迟之后重新订阅
+func (s *Signaler) yield() {
+	delay := s.standbyDelay()
+	var servers []string
+	for _, l := range s.Links() {
+		if l.Connected {
+			servers = append(servers, l.Link)
+		}
+	}
+	slog.Warn("links are split with another instance, yield subscriptions", "act", "standby", "links", len(servers), "retry", delay)
+	h := s.ha
+	h.locker.Lock()
+	for _, server := range servers {
+		if cancel := h.cancels[server]; cancel != nil {
+			cancel()
+		}
+	}
+	restart := h.restart
+	h.locker.Unlock()
+	time.AfterFunc(delay, func() {
+		h.locker.Lock()
+		h.yielding = false
+		h.locker.Unlock()
+		if restart == nil {
+			return
+		}
+		for _, server := range servers {
+			go restart(server)
+		}
+	})
+}
+
+// standbyDelay 是被锁定的链接重试的间隔, 优先级高的间隔短, 加上随机抖动避免同时重试
+func (s *Signaler) standbyDelay() time.Duration {
+	p := min(max(s.Priority, 0), MaxPriority)
+	d := time.Second + time.Duration(MaxPriority-p)*500*time.Millisecond
+	return d + time.Duration(rand.Int63n(int64(250*time.Millisecond)))
+}
+
+// lockedDelay 返回被锁定的链接的重试间隔, 没有被锁定时返回 0
+func (s *Signaler) lockedDelay(server string) time.Duration {
+	if !s.HA || !s.health.locked(server) {
+		return 0
+	}
+	return s.standbyDelay()
+}
@@ -0,0 +1,120 @@
+package signaler
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// lockHub 只允许一个订阅, 之后同一个 pubkey 的订阅返回 423
+type lockHub struct {
+	*testHub
+	locker *sync.Mutex
+	held   map[string]bool
+}
+
+func newLockHub() *lockHub {
+	return &lockHub{
+		testHub: newTestHub(false),
+		locker:  &sync.Mutex{},
+		held:    make(map[string]bool),
+	}
+}
+
+// lock 返回 false 表示已经被锁定
+func (h *lockHub) lock(pubkey string, held bool) bool {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	if held && h.held[pubkey] {
+		return false
+	}
+	h.held[pubkey] = held
+	return true
+}
+
+func (h *lockHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if r.Method != http.MethodGet || q.Get("session") != "" {
+		h.testHub.ServeHTTP(w, r)
+		return
+	}
+	pubkey := q.Get("pubkey")
+	if !h.lock(pubkey, true) {
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	defer h.lock(pubkey, false)
+	h.testHub.ServeHTTP(w, r)
+}
+
+func waitActive(s *Signaler, active bool) bool {
+	for i := 0; i < 100 && s.Active() != active; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return s.Active() == active
+}
+
+func TestStandby(t *testing.T) {
+	hub := newLockHub()
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	key := try.To1(wgtypes.GeneratePrivateKey())
+	roles := make(chan bool, 10)
+	s1 := New(key[:], []string{server.URL})
+	s1.HA = true
+	try.To1(s1.Accept())
+	assert.That(waitActive(s1, true))
+
+	s2 := New(key[:], []string{server.URL})
+	s2.HA, s2.Priority = true, MaxPriority
+	s2.OnRole = func(active bool) { roles <- active }
+	defer s2.Close()
+	// 被锁定时作为 standby 启动
+	try.To1(s2.Accept())
+	assert.ThatNot(s2.Active())
+	assert.That(s2.Links()[0].Locked)
+
+	// active 消失后接管
+	s1.Close()
+	assert.That(waitActive(s2, true))
+	assert.That(<-roles)
+	assert.ThatNot(s2.Links()[0].Locked)
+}
+
+func TestStandbySplit(t *testing.T) {
+	hub1, hub2 := newLockHub(), newLockHub()
+	server1 := httptest.NewServer(hub1)
+	defer server1.Close()
+	server2 := httptest.NewServer(hub2)
+	defer server2.Close()
+
+	key := try.To1(wgtypes.GeneratePrivateKey())
+	s := New(key[:], []string{server1.URL, server2.URL})
+	s.HA, s.Priority = true, MaxPriority
+	defer s.Close()
+
+	// 另一个实例持有 hub2, 只抢到一半时让出订阅
+	pubkey := key.PublicKey()
+	other := hex.EncodeToString(pubkey[:])
+	assert.That(hub2.lock(other, true))
+	try.To1(s.Accept())
+	assert.ThatNot(s.Active())
+
+	// 另一个实例消失后接管所有链接
+	hub2.lock(other, false)
+	assert.That(waitActive(s, true))
+	for i := 0; i < 100 && !s.Links()[0].Connected; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, l := range s.Links() {
+		assert.That(l.Connected)
+	}
+}
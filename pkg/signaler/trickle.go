@@ -0,0 +1,460 @@
+package signaler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/r3labs/sse/v2"
+	"github.com/shynome/wgortc/signaler"
+)
+
+// trickle ICE 扩展, 旧版本的 hub 和 peer 会回退到完整的 offer/answer:
+//   - 发起方在 offer 中带上 trickle 会话 id, 旧版本的 peer 会忽略这个字段
+//   - 支持转发 candidate 的 hub 在订阅响应中带上 X-Xhe-Trickle 头,
+//     接收方据此在 answer 中带上 trickle: true, 并且不等待 candidate 收集完成就回复
+//   - 发起方记住支持 trickle 的 endpoint, 之后的 offer 也不再等待 candidate 收集完成
+//
+// candidate 通过接收方的 hub 传递, hub 需要按会话 id 缓存它们:
+//   - 发起方 POST {endpoint}, 带 X-Xhe-Session 头, hub 以 candidate 事件推送给接收方
+//   - 接收方 POST {link}, 带 X-Xhe-Session 和 X-Event-Id 头,
+//     发起方通过 GET {endpoint}&session={id} 的 SSE 接收
+// candidate 为 null 表示已经发送完毕
+
+const (
+	headerTrickle  = "X-Xhe-Trickle"
+	headerSession  = "X-Xhe-Session"
+	eventCandidate = "candidate"
+
+	trickleTimeout = 30 * time.Second
+	// 最多同时存在的 trickle 会话, 防止被未知会话的 candidate 占满内存
+	maxTrickles = 1024
+)
+
+// Offer 是带 trickle 协商信息的 offer
+type Offer struct {
+	signaler.SDP
+	// Trickle 是 trickle 会话 id, 表示发起方支持 trickle ICE
+	Trickle string `json:"trickle,omitempty"`
+	// Partial 表示 sdp 中的 candidate 不完整
+	Partial bool `json:"partial,omitempty"`
+	// Sig 是发起方的签名, 见 offer.go
+	Sig *OfferSignature `json:"sig,omitempty"`
+	// Sealed 是加密后的 Offer, 见 seal.go
+	Sealed string `json:"sealed,omitempty"`
+}
+
+// Answer 是带 trickle 协商信息的 answer
+type Answer struct {
+	signaler.SDP
+	Trickle bool `json:"trickle,omitempty"`
+	Partial bool `json:"partial,omitempty"`
+	// Reject 不为空表示 offer 被拒绝, 见 Session.Reject
+	Reject *RejectError `json:"reject,omitempty"`
+	// Sealed 是加密后的 Answer
+	Sealed string `json:"sealed,omitempty"`
+}
+
+type candidateMsg struct {
+	Session   string                   `json:"session"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate"`
+	// Sealed 是加密后的 Candidate
+	Sealed string `json:"sealed,omitempty"`
+}
+
+// Trickle 是一次 trickle ICE 会话
+type Trickle struct {
+	ID string
+	// Partial 表示本端的 description 不需要等待 candidate 收集完成
+	Partial bool
+	// Full 返回 candidate 收集完成的 offer. 对方不支持 trickle ICE 时,
+	// HandshakeTrickle 用它在同一次握手中重试, 而不是让这次连接失败
+	Full func() (signaler.SDP, error)
+
+	queue  chan *webrtc.ICECandidateInit
+	remote chan webrtc.ICECandidateInit
+	done   chan struct{}
+
+	locker  *sync.Mutex
+	started bool
+	ended   bool
+	closed  bool
+	timer   *time.Timer
+	release func()
+}
+
+func newTrickle(id string, release func()) *Trickle {
+	t := &Trickle{
+		ID:      id,
+		queue:   make(chan *webrtc.ICECandidateInit, 128),
+		remote:  make(chan webrtc.ICECandidateInit, 128),
+		done:    make(chan struct{}),
+		locker:  &sync.Mutex{},
+		release: release,
+	}
+	t.timer = time.AfterFunc(trickleTimeout, t.Close)
+	return t
+}
+
+// Send 发送本端的 candidate, nil 表示发送完毕
+func (t *Trickle) Send(c *webrtc.ICECandidateInit) {
+	select {
+	case t.queue <- c:
+	case <-t.done:
+	default:
+		slog.Warn("trickle queue is full, drop candidate", "session", t.ID)
+	}
+}
+
+// Remote 返回对方的 candidate, 对方发送完毕或者会话结束时关闭
+func (t *Trickle) Remote() <-chan webrtc.ICECandidateInit {
+	return t.remote
+}
+
+func (t *Trickle) push(c *webrtc.ICECandidateInit) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if t.ended {
+		return
+	}
+	if c == nil {
+		t.ended = true
+		close(t.remote)
+		return
+	}
+	select {
+	case t.remote <- *c:
+	default:
+		slog.Warn("trickle remote queue is full, drop candidate", "session", t.ID)
+	}
+}
+
+// start 开始发送 candidate, 在此之前 Send 的 candidate 会先缓存
+func (t *Trickle) start(send func(msg candidateMsg) error) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if t.started || t.closed {
+		return
+	}
+	t.started = true
+	go func() {
+		for {
+			select {
+			case <-t.done:
+				return
+			case c := <-t.queue:
+				if err := send(candidateMsg{Session: t.ID, Candidate: c}); err != nil {
+					slog.Warn("send candidate failed", "session", t.ID, "err", err)
+				}
+				if c == nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (t *Trickle) Close() {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	t.timer.Stop()
+	close(t.done)
+	if !t.ended {
+		t.ended = true
+		close(t.remote)
+	}
+	if t.release != nil {
+		t.release()
+	}
+}
+
+// Trickle 创建一个发往 endpoint 的 trickle 会话.
+// 如果已经知道对方支持 trickle ICE, 会话的 Partial 为 true
+func (s *Signaler) Trickle(endpoint string) *Trickle {
+	// 对方的 candidate 通过会话流接收, 不需要登记
+	t := newTrickle(randomID(), nil)
+	t.Partial = s.trickleSupported(endpoint)
+	// 局域网内直接交换完整的 offer
+	if _, ok := s.lookupLAN(endpoint); ok {
+		t.Partial = false
+	}
+	return t
+}
+
+// HandshakeTrickle 和 Handshake 一样, 但是在 offer 中带上 trickle 会话.
+// 对方不支持时 t 会被关闭, 只能使用完整的 description
+func (s *Signaler) HandshakeTrickle(endpoint string, offer signaler.SDP, t *Trickle) (answer *signaler.SDP, ierr error) {
+	if _, ok := s.lookupLAN(endpoint); ok && !t.Partial {
+		t.Close()
+		return s.Handshake(endpoint, offer)
+	}
+	defer then(&ierr, nil, func() {
+		t.Close()
+		// 下次回退到完整的 offer
+		s.setTrickleSupported(endpoint, false)
+	})
+	to := s.sealTo(endpoint)
+	// WebSocket 的 candidate 在握手的连接上交换
+	var ws *wsConn
+	if isWS(endpoint) {
+		if ws, ierr = s.dialWS(endpoint); ierr != nil {
+			return
+		}
+		defer then(&ierr, nil, func() { ws.Close() })
+	}
+	send := func(msg candidateMsg) error {
+		if ws != nil {
+			return ws.sendCandidate(msg, "", to)
+		}
+		return s.postCandidate(endpoint, msg, "", to)
+	}
+	if t.Partial {
+		t.start(send)
+	}
+	o := Offer{SDP: offer, Trickle: t.ID, Partial: t.Partial}
+	var a *Answer
+	if ws != nil {
+		a, ierr = s.handshakeWS(ws, endpoint, o)
+	} else {
+		a, ierr = s.handshake(endpoint, o)
+		if errors.Is(ierr, errClockSkew) {
+			a, ierr = s.handshake(endpoint, o)
+		}
+	}
+	if ierr != nil {
+		return
+	}
+	if !a.Trickle {
+		if ws != nil {
+			ws.Close()
+		}
+		t.Close()
+		if t.Partial {
+			// partial offer 中的 candidate 不完整, 对方的 answer 不能用, 马上用完整的 offer 重试
+			if t.Full == nil {
+				return nil, ErrTrickleUnsupported
+			}
+			var full signaler.SDP
+			if full, ierr = t.Full(); ierr != nil {
+				return
+			}
+			if answer, ierr = s.Handshake(endpoint, full); ierr != nil {
+				return
+			}
+			s.setTrickleSupported(endpoint, false)
+			return answer, nil
+		}
+		s.setTrickleSupported(endpoint, false)
+		return &a.SDP, nil
+	}
+	s.setTrickleSupported(endpoint, true)
+	t.start(send)
+	if ws != nil {
+		if !a.Partial {
+			t.push(nil)
+		}
+		// 连接保持到会话结束
+		go ws.receiveCandidates(s, t)
+		return &a.SDP, nil
+	}
+	if a.Partial {
+		go s.receiveCandidates(endpoint, t)
+	} else {
+		t.push(nil)
+	}
+	return &a.SDP, nil
+}
+
+// receiveCandidates 发起方通过 hub 的会话流接收对方的 candidate
+func (s *Signaler) receiveCandidates(endpoint string, t *Trickle) (ierr error) {
+	logger := slog.With(
+		"act", "receive candidates",
+		"session", t.ID,
+	)
+	defer then(&ierr, nil, func() {
+		logger.Warn("failed", "err", ierr)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	u, ierr := url.Parse(endpoint)
+	if ierr != nil {
+		return
+	}
+	q := u.Query()
+	q.Set("session", t.ID)
+	u.RawQuery = q.Encode()
+	link := u.String()
+	c := sse.NewClient(link, func(c *sse.Client) {
+		c.Connection = s.Client
+		c.ReconnectStrategy = NewReconnectStrategy(ctx, time.Second)
+		c.ReconnectNotify = func(err error, d time.Duration) {
+			s.signSSE(c, link)
+		}
+		c.ResponseValidator = func(c *sse.Client, resp *http.Response) error {
+			s.observeDate(resp)
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				return fmt.Errorf("could not connect to stream: %s", http.StatusText(resp.StatusCode))
+			}
+			return nil
+		}
+	})
+	if ierr = s.signSSE(c, link); ierr != nil {
+		return
+	}
+	ierr = c.SubscribeRawWithContext(ctx, func(msg *sse.Event) {
+		var m candidateMsg
+		if err := json.Unmarshal(msg.Data, &m); err != nil || m.Session != t.ID {
+			return
+		}
+		if err := s.openCandidate(&m); err != nil {
+			logger.Warn("open candidate failed", "err", err)
+			return
+		}
+		t.push(m.Candidate)
+		if m.Candidate == nil {
+			cancel()
+		}
+	})
+	if errors.Is(ierr, context.Canceled) {
+		return nil
+	}
+	return
+}
+
+// candidateBody 编码 candidate, to 不为空时加密给 to
+func candidateBody(msg candidateMsg, to []byte) (b []byte, ierr error) {
+	if to != nil {
+		msg.Sealed, ierr = sealJSON(to, msg.Candidate)
+		if ierr != nil {
+			return
+		}
+		msg.Candidate = nil
+	}
+	return json.Marshal(msg)
+}
+
+// postCandidate 发送 candidate, to 不为空时加密给 to
+func (s *Signaler) postCandidate(link string, msg candidateMsg, eventID string, to []byte) (ierr error) {
+	b, ierr := candidateBody(msg, to)
+	if ierr != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	header := http.Header{headerSession: {msg.Session}}
+	if eventID != "" {
+		header.Set(headerEventID, eventID)
+	}
+	req, ierr := s.newRequest(ctx, http.MethodPost, link, b, header)
+	if ierr != nil {
+		return
+	}
+	resp, ierr := s.do(req)
+	if ierr != nil {
+		return
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// trickle 返回会话 id 对应的 trickle 会话, 不存在时创建.
+// candidate 事件可能先于 offer 到达, 所以两边都可能创建
+func (s *Signaler) trickle(id string) (t *Trickle, ok bool) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if t, ok = s.trickles[id]; ok {
+		return
+	}
+	if len(s.trickles) >= maxTrickles {
+		return nil, false
+	}
+	t = newTrickle(id, func() {
+		s.locker.Lock()
+		defer s.locker.Unlock()
+		delete(s.trickles, id)
+	})
+	s.trickles[id] = t
+	return t, true
+}
+
+// dispatchCandidate 把 hub 推送的 candidate 交给对应的会话
+func (s *Signaler) dispatchCandidate(data []byte) {
+	var m candidateMsg
+	if err := json.Unmarshal(data, &m); err != nil || m.Session == "" {
+		return
+	}
+	if err := s.openCandidate(&m); err != nil {
+		slog.Warn("open candidate failed", "session", m.Session, "err", err)
+		return
+	}
+	t, ok := s.trickle(m.Session)
+	if !ok {
+		return
+	}
+	t.push(m.Candidate)
+}
+
+func (s *Signaler) openCandidate(m *candidateMsg) error {
+	if m.Sealed == "" {
+		return nil
+	}
+	return s.openJSON(m.Sealed, &m.Candidate)
+}
+
+func (s *Signaler) trickleSupported(endpoint string) bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.trickleEndpoints[endpoint]
+}
+
+func (s *Signaler) setTrickleSupported(endpoint string, ok bool) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if ok {
+		s.trickleEndpoints[endpoint] = true
+	} else {
+		delete(s.trickleEndpoints, endpoint)
+	}
+}
+
+func (s *Signaler) hubTrickle(server string) bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.trickleHubs[server]
+}
+
+func (s *Signaler) setHubTrickle(server string, ok bool) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.trickleHubs[server] = ok
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var ErrTrickleUnsupported = errors.New("peer does not support trickle ice anymore")
@@ -0,0 +1,121 @@
+package signaler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/signaler"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func testCandidate(s string) *webrtc.ICECandidateInit {
+	return &webrtc.ICECandidateInit{Candidate: s}
+}
+
+func runTrickle(hubTrickle bool) (partial bool, remote []string) {
+	hub := newTestHub(hubTrickle)
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	key1 := try.To1(wgtypes.GeneratePrivateKey())
+	key2 := try.To1(wgtypes.GeneratePrivateKey())
+	s1 := New(key1[:], []string{server.URL})
+	defer s1.Close()
+	s2 := New(key2[:], nil)
+
+	ch := try.To1(s1.Accept())
+	go func() {
+		for sess := range ch {
+			answer := &signaler.SDP{Type: webrtc.SDPTypeAnswer}
+			tr := sess.(*Session).Trickle()
+			if tr != nil {
+				tr.Send(testCandidate("a1"))
+				tr.Send(nil)
+			}
+			sess.Resolve(answer)
+		}
+	}()
+
+	pubkey := key1.PublicKey()
+	endpoint := server.URL + "?peer=" + hex.EncodeToString(pubkey[:])
+	for i := 0; i < 2; i++ {
+		tr := s2.Trickle(endpoint)
+		partial = tr.Partial
+		answer := try.To1(s2.HandshakeTrickle(endpoint, signaler.SDP{Type: webrtc.SDPTypeOffer}, tr))
+		assert.Equal(answer.Type, webrtc.SDPTypeAnswer)
+		remote = nil
+		for c := range tr.Remote() {
+			remote = append(remote, c.Candidate)
+		}
+	}
+	return partial, remote
+}
+
+func TestTrickle(t *testing.T) {
+	partial, remote := runTrickle(true)
+	// 第二次握手时已经知道对方支持 trickle ICE
+	assert.That(partial)
+	assert.SLen(remote, 1)
+	assert.Equal(remote[0], "a1")
+}
+
+func TestTrickleFallback(t *testing.T) {
+	partial, remote := runTrickle(false)
+	assert.ThatNot(partial)
+	assert.SLen(remote, 0)
+}
+
+func TestOfferCompat(t *testing.T) {
+	b := try.To1(json.Marshal(Offer{SDP: signaler.SDP{Type: webrtc.SDPTypeOffer, SDP: "v=0"}, Trickle: "id"}))
+	// 旧版本只认识 SDP 的字段
+	var sdp signaler.SDP
+	try.To(json.Unmarshal(b, &sdp))
+	assert.Equal(sdp.Type, webrtc.SDPTypeOffer)
+	assert.Equal(sdp.SDP, "v=0")
+
+	var answer Answer
+	try.To(json.Unmarshal([]byte(`{"type":"answer","sdp":"v=0"}`), &answer))
+	assert.ThatNot(answer.Trickle)
+	assert.Equal(answer.Type, webrtc.SDPTypeAnswer)
+}
+
+// TestTrickleDowngrade 对方不再支持 trickle ICE 时在同一次握手中用完整的 offer 重试
+func TestTrickleDowngrade(t *testing.T) {
+	hub := newTestHub(false)
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	key1 := try.To1(wgtypes.GeneratePrivateKey())
+	key2 := try.To1(wgtypes.GeneratePrivateKey())
+	s1 := New(key1[:], []string{server.URL})
+	defer s1.Close()
+	s2 := New(key2[:], nil)
+
+	offers := make(chan string, 2)
+	ch := try.To1(s1.Accept())
+	go func() {
+		for sess := range ch {
+			offers <- sess.Description().SDP
+			sess.Resolve(&signaler.SDP{Type: webrtc.SDPTypeAnswer, SDP: "answer"})
+		}
+	}()
+
+	pubkey := key1.PublicKey()
+	endpoint := server.URL + "?peer=" + hex.EncodeToString(pubkey[:])
+	s2.setTrickleSupported(endpoint, true)
+	tr := s2.Trickle(endpoint)
+	assert.That(tr.Partial)
+	tr.Full = func() (signaler.SDP, error) {
+		return signaler.SDP{Type: webrtc.SDPTypeOffer, SDP: "full"}, nil
+	}
+	answer := try.To1(s2.HandshakeTrickle(endpoint, signaler.SDP{Type: webrtc.SDPTypeOffer, SDP: "partial"}, tr))
+	assert.Equal(answer.SDP, "answer")
+	assert.Equal(<-offers, "partial")
+	assert.Equal(<-offers, "full")
+	assert.ThatNot(s2.Trickle(endpoint).Partial)
+}
@@ -0,0 +1,365 @@
+package signaler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shynome/wgortc/signaler"
+	"golang.org/x/net/websocket"
+)
+
+// 有的代理会缓存或者断开长时间的 SSE 响应, 所以 ws:// 和 wss:// 的链接改用 WebSocket.
+// 一个连接上收发 json 帧, 鉴权和 http 一样, 签名放在升级请求的链接参数和请求头里:
+//   - 订阅: 连接 {link}, hub 推送 offer 和 candidate 帧, 接收方在同一个连接上回复 answer 和 candidate 帧
+//   - 握手: 连接 {endpoint}, 发送 offer 帧, 等待 answer 帧. trickle ICE 时连接保持到 candidate 交换结束
+//   - hub 连接后可以先发送 hello 帧, trickle 为 true 表示支持转发 candidate
+//   - 双方每 20s 发送 ping 帧, 收到后回复 pong 帧, 超过两个周期没有收到任何帧就断开
+
+const (
+	frameHello     = "hello"
+	frameOffer     = "offer"
+	frameAnswer    = "answer"
+	frameCandidate = "candidate"
+	framePing      = "ping"
+	framePong      = "pong"
+
+	wsPingInterval = 20 * time.Second
+	wsReadTimeout  = 2 * wsPingInterval
+	wsWriteTimeout = 10 * time.Second
+)
+
+type wsFrame struct {
+	Type string `json:"type"`
+	// ID 是 offer 的事件 id, answer 和接收方的 candidate 带上它
+	ID string `json:"id,omitempty"`
+	// Reject 和 X-Xhe-Reject 头一样, 拒绝的原因在 Data 里
+	Reject  RejectCode      `json:"reject,omitempty"`
+	Trickle bool            `json:"trickle,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func isWS(link string) bool {
+	return strings.HasPrefix(link, "ws://") || strings.HasPrefix(link, "wss://")
+}
+
+type wsConn struct {
+	ws     *websocket.Conn
+	locker *sync.Mutex // 写锁
+	done   chan struct{}
+	once   *sync.Once
+}
+
+// dialWS 连接 link, 升级请求和 http 请求一样签名. 因为时钟偏差被拒绝时用 hub 的时间重新签名再试一次
+func (s *Signaler) dialWS(link string) (c *wsConn, ierr error) {
+	c, ierr = s.dialWSOnce(link)
+	if errors.Is(ierr, errClockSkew) {
+		c, ierr = s.dialWSOnce(link)
+	}
+	return
+}
+
+func (s *Signaler) dialWSOnce(link string) (c *wsConn, ierr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, ierr := s.newRequest(ctx, http.MethodGet, link, nil, nil)
+	if ierr != nil {
+		return
+	}
+	origin := *req.URL
+	origin.Scheme = strings.Replace(origin.Scheme, "ws", "http", 1)
+	origin.Path, origin.RawQuery = "", ""
+	config, ierr := websocket.NewConfig(req.URL.String(), origin.String())
+	if ierr != nil {
+		return
+	}
+	config.Header = req.Header
+	if id := s.events.lastID(link); id != "" {
+		config.Header.Set("Last-Event-ID", id)
+	}
+	conn, ierr := s.dialConn(ctx, req.URL)
+	if ierr != nil {
+		return
+	}
+	sc := &statusConn{Conn: conn}
+	ws, ierr := websocket.NewClient(config, sc)
+	// 和 http 请求一样从升级响应的 Date 头学习时钟偏差
+	resp := sc.response(req)
+	skewed := resp != nil && s.observeDate(resp) && isAuthFailure(resp.StatusCode)
+	if ierr != nil {
+		conn.Close()
+		switch {
+		case skewed:
+			return nil, errClockSkew
+		case resp != nil && resp.StatusCode == http.StatusLocked:
+			return nil, ErrLinkLocked
+		}
+		return
+	}
+	c = &wsConn{
+		ws:     ws,
+		locker: &sync.Mutex{},
+		done:   make(chan struct{}),
+		once:   &sync.Once{},
+	}
+	go c.keepalive()
+	return c, nil
+}
+
+// statusConn 记录升级响应的头, websocket.ErrBadStatus 不包含状态码, 也拿不到 Date 头
+type statusConn struct {
+	net.Conn
+	head []byte
+	done bool
+}
+
+// maxStatusHead 是最多记录的响应头长度
+const maxStatusHead = 8 << 10
+
+func (c *statusConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if c.done {
+		return
+	}
+	c.head = append(c.head, b[:n]...)
+	if i := bytes.Index(c.head, []byte("\r\n\r\n")); i >= 0 {
+		// 之后是 WebSocket 的帧
+		c.head, c.done = c.head[:i+4], true
+	} else if len(c.head) > maxStatusHead {
+		c.done = true
+	}
+	return
+}
+
+// response 解析记录的升级响应, 不完整时返回 nil
+func (c *statusConn) response(req *http.Request) *http.Response {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.head)), req)
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+func (c *wsConn) send(f wsFrame) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return websocket.JSON.Send(c.ws, f)
+}
+
+// recv 读取下一个帧, 自动回复 ping
+func (c *wsConn) recv() (f wsFrame, ierr error) {
+	for {
+		c.ws.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		f = wsFrame{}
+		if ierr = websocket.JSON.Receive(c.ws, &f); ierr != nil {
+			return
+		}
+		switch f.Type {
+		case framePing:
+			if ierr = c.send(wsFrame{Type: framePong}); ierr != nil {
+				return
+			}
+		case framePong:
+		default:
+			return
+		}
+	}
+}
+
+func (c *wsConn) keepalive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.send(wsFrame{Type: framePing}); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *wsConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		err = c.ws.Close()
+	})
+	return err
+}
+
+// subscribeWS 和 subscribe 一样, 返回第一次连接的结果, 之后断开或者第一次就失败都会一直重连
+func (s *Signaler) subscribeWS(ctx context.Context, ch chan<- signaler.Session, server string) (ierr error) {
+	logger := slog.With(
+		"act", "subscribe",
+		"server", server,
+	)
+	logger.Debug("start")
+	defer then(&ierr, func() {
+		logger.Debug("successful")
+	}, func() {
+		logger.Warn("failed", "err", ierr)
+	})
+
+	c, ierr := s.dialWS(server)
+	if ierr != nil {
+		s.wsFailed(server, ierr)
+		if s.HA && errors.Is(ierr, ErrLinkLocked) {
+			// 另一个实例持有订阅, 作为 standby 也算连上了
+			ierr = nil
+		}
+	}
+	go func() {
+		for {
+			if c != nil {
+				s.serveWS(ctx, ch, server, c)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			for {
+				wait := time.Second
+				if d := s.lockedDelay(server); d > 0 {
+					wait = d
+				}
+				time.Sleep(wait)
+				if ctx.Err() != nil {
+					return
+				}
+				var err error
+				if c, err = s.dialWS(server); err == nil {
+					break
+				}
+				s.wsFailed(server, err)
+				logger.Debug("reconnect failed", "err", err)
+			}
+		}
+	}()
+	return
+}
+
+func (s *Signaler) wsFailed(server string, err error) {
+	if errors.Is(err, ErrLinkLocked) {
+		s.health.setLocked(server)
+		return
+	}
+	s.health.set(server, false, err)
+}
+
+// serveWS 处理一个订阅连接上的帧, 直到连接断开
+func (s *Signaler) serveWS(ctx context.Context, ch chan<- signaler.Session, server string, c *wsConn) {
+	logger := slog.With("act", "serve websocket", "server", server)
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	s.health.set(server, true, nil)
+	defer s.health.set(server, false, nil)
+	logger.Debug("subscribed")
+	for {
+		f, err := c.recv()
+		if err != nil {
+			logger.Debug("disconnected", "err", err)
+			return
+		}
+		switch f.Type {
+		case frameHello:
+			s.setHubTrickle(server, f.Trickle)
+		case frameCandidate:
+			s.dispatchCandidate(f.Data)
+		case frameOffer:
+			if f.ID != "" && s.events.add(server, f.ID) {
+				logger.Debug("skip replayed event", "id", f.ID)
+				continue
+			}
+			release, ok := s.limits.admit(server)
+			if !ok {
+				continue
+			}
+			go s.acceptOffer(ctx, ch, &Session{
+				ctx:     ctx,
+				root:    s,
+				link:    server,
+				id:      f.ID,
+				ws:      c,
+				release: release,
+			}, f.Data)
+		}
+	}
+}
+
+// handshakeWS 在 c 上发送 offer 并等待 answer
+func (s *Signaler) handshakeWS(c *wsConn, endpoint string, offer Offer) (answer *Answer, ierr error) {
+	b, ierr := s.offerBody(endpoint, &offer)
+	if ierr != nil {
+		return
+	}
+	if ierr = c.send(wsFrame{Type: frameOffer, Data: b}); ierr != nil {
+		return
+	}
+	timer := time.AfterFunc(10*time.Second, func() { c.Close() })
+	defer timer.Stop()
+	for {
+		f, ierr := c.recv()
+		if ierr != nil {
+			return nil, ierr
+		}
+		if f.Type != frameAnswer {
+			continue
+		}
+		answer = new(Answer)
+		if ierr = json.Unmarshal(f.Data, answer); ierr != nil {
+			return nil, ierr
+		}
+		return s.openAnswer(endpoint, offer, answer)
+	}
+}
+
+// receiveCandidates 发起方在握手的连接上接收对方的 candidate, 会话结束时关闭连接
+func (c *wsConn) receiveCandidates(s *Signaler, t *Trickle) {
+	defer c.Close()
+	go func() {
+		select {
+		case <-t.done:
+			c.Close()
+		case <-c.done:
+		}
+	}()
+	for {
+		f, err := c.recv()
+		if err != nil {
+			return
+		}
+		if f.Type != frameCandidate {
+			continue
+		}
+		var m candidateMsg
+		if err := json.Unmarshal(f.Data, &m); err != nil || m.Session != t.ID {
+			continue
+		}
+		if err := s.openCandidate(&m); err != nil {
+			continue
+		}
+		t.push(m.Candidate)
+	}
+}
+
+// sendCandidate 发送 candidate 帧, eventID 是接收方回复的 offer 的事件 id
+func (c *wsConn) sendCandidate(msg candidateMsg, eventID string, to []byte) (ierr error) {
+	b, ierr := candidateBody(msg, to)
+	if ierr != nil {
+		return
+	}
+	return c.send(wsFrame{Type: frameCandidate, ID: eventID, Data: b})
+}
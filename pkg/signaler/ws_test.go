@@ -0,0 +1,124 @@
+package signaler
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/signaler"
+	"golang.org/x/net/websocket"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// testWSHub 是一个最简单的 WebSocket hub, 总是支持转发 candidate
+type testWSHub struct {
+	locker    *sync.Mutex
+	nextID    int
+	peers     map[string]*websocket.Conn // pubkey -> 订阅的连接
+	initiator map[string]*websocket.Conn // 事件 id -> 发起方的连接
+}
+
+func newTestWSHub() *testWSHub {
+	return &testWSHub{
+		locker:    &sync.Mutex{},
+		peers:     make(map[string]*websocket.Conn),
+		initiator: make(map[string]*websocket.Conn),
+	}
+}
+
+func (h *testWSHub) serve(ws *websocket.Conn) {
+	q := ws.Request().URL.Query()
+	target := q.Get("peer")
+	if target == "" {
+		h.locker.Lock()
+		h.peers[ws.Request().Header.Get(HeaderPubkey)] = ws
+		h.locker.Unlock()
+		websocket.JSON.Send(ws, wsFrame{Type: frameHello, Trickle: true})
+	}
+	for {
+		var f wsFrame
+		if err := websocket.JSON.Receive(ws, &f); err != nil {
+			return
+		}
+		h.locker.Lock()
+		switch {
+		case f.Type == frameOffer:
+			h.nextID++
+			f.ID = fmt.Sprint(h.nextID)
+			h.initiator[f.ID] = ws
+			websocket.JSON.Send(h.peers[target], f)
+		case f.Type == frameCandidate && f.ID == "":
+			websocket.JSON.Send(h.peers[target], f)
+		case f.Type == frameCandidate || f.Type == frameAnswer:
+			websocket.JSON.Send(h.initiator[f.ID], f)
+		case f.Type == framePing:
+			websocket.JSON.Send(ws, wsFrame{Type: framePong})
+		}
+		h.locker.Unlock()
+	}
+}
+
+func (h *testWSHub) subscribed() bool {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	return len(h.peers) > 0
+}
+
+func TestWebSocket(t *testing.T) {
+	hub := newTestWSHub()
+	server := httptest.NewServer(websocket.Handler(hub.serve))
+	defer server.Close()
+	link := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	key1 := try.To1(wgtypes.GeneratePrivateKey())
+	key2 := try.To1(wgtypes.GeneratePrivateKey())
+	s1 := New(key1[:], []string{link})
+	defer s1.Close()
+	s2 := New(key2[:], nil)
+
+	ch := try.To1(s1.Accept())
+	// 等待 hub 登记订阅的连接
+	for i := 0; i < 100 && !hub.subscribed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	go func() {
+		for sess := range ch {
+			if sess.Description().SDP == "reject" {
+				sess.Reject(Reject(RejectBusy, nil))
+				continue
+			}
+			tr := sess.(*Session).Trickle()
+			tr.Send(testCandidate("a1"))
+			tr.Send(nil)
+			sess.Resolve(&signaler.SDP{Type: webrtc.SDPTypeAnswer, SDP: "answer"})
+		}
+	}()
+
+	pubkey := key1.PublicKey()
+	endpoint := link + "?peer=" + hex.EncodeToString(pubkey[:])
+	for i := 0; i < 2; i++ {
+		tr := s2.Trickle(endpoint)
+		answer := try.To1(s2.HandshakeTrickle(endpoint, signaler.SDP{Type: webrtc.SDPTypeOffer, SDP: "offer"}, tr))
+		assert.Equal(answer.SDP, "answer")
+		var remote []string
+		for c := range tr.Remote() {
+			remote = append(remote, c.Candidate)
+		}
+		assert.SLen(remote, 1)
+		assert.Equal(remote[0], "a1")
+		tr.Close()
+	}
+
+	_, err := s2.Handshake(endpoint, signaler.SDP{Type: webrtc.SDPTypeOffer, SDP: "reject"})
+	var rejection *RejectError
+	assert.That(errors.As(err, &rejection))
+	assert.Equal(rejection.Code, RejectBusy)
+}
@@ -14,21 +14,32 @@ import (
 )
 
 func NewSocks5Server(vtun GetStack) *socks5.Server {
-	s := vtun.GetStack()
-	nic := vtun.NIC()
 	conf := socks5.Config{
-		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			ap, err := netip.ParseAddrPort(addr)
-			if err != nil {
-				return nil, err
-			}
-			fa, pn := convertToFullAddr(nic, ap)
-			return gonet.DialContextTCP(ctx, s, fa, pn)
-		},
+		Dial: Dialer(vtun),
 	}
 	return try.To1(socks5.New(&conf))
 }
 
+// Dialer 返回通过 vtun 的网络栈建立 tcp 连接的函数, addr 只能是 ip:port
+func Dialer(vtun GetStack) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	s := vtun.GetStack()
+	nic := vtun.NIC()
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		fa, pn := convertToFullAddr(nic, ap)
+		return gonet.DialContextTCP(ctx, s, fa, pn)
+	}
+}
+
+// ListenTCP 在 vtun 的网络栈上监听 addr
+func ListenTCP(vtun GetStack, addr netip.AddrPort) (net.Listener, error) {
+	fa, pn := convertToFullAddr(vtun.NIC(), addr)
+	return gonet.ListenTCP(vtun.GetStack(), fa, pn)
+}
+
 func convertToFullAddr(NICID tcpip.NICID, endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
 	var protoNumber tcpip.NetworkProtocolNumber
 	if endpoint.Addr().Is4() {
@@ -0,0 +1,171 @@
+package xhe
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/shynome/wgortc/endpoint"
+	"github.com/shynome/wgortc/signaler"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/device"
+	xsignaler "remoon.net/xhe/pkg/signaler"
+)
+
+// offerAuth 在创建 PeerConnection 之前检查 offer 发起方的 pubkey.
+// offer 里带着 WireGuard 握手的 initiation, 用自己的私钥按 Noise IK 解出发起方的静态公钥,
+// 再用静态密钥的 DH 解开时间戳, 证明发起方持有对应的私钥, 所以不需要信任 hub
+type offerAuth struct {
+	priv device.NoisePrivateKey
+	pub  device.NoisePublicKey
+
+	locker *sync.RWMutex
+	allow  map[device.NoisePublicKey]bool
+	// isPeer 判断是不是已经配置的 peer, 运行时增删的 peer 也会生效
+	isPeer func(pubkey device.NoisePublicKey) bool
+}
+
+func newOfferAuth(priv []byte, allow []string) (a *offerAuth, ierr error) {
+	a = &offerAuth{
+		locker: &sync.RWMutex{},
+		allow:  make(map[device.NoisePublicKey]bool),
+	}
+	copy(a.priv[:], priv)
+	pub, ierr := curve25519.X25519(a.priv[:], curve25519.Basepoint)
+	if ierr != nil {
+		return
+	}
+	copy(a.pub[:], pub)
+	for _, s := range allow {
+		b, ierr := str2pubkey(s)
+		if ierr != nil {
+			return nil, ierr
+		}
+		a.allow[device.NoisePublicKey(b)] = true
+	}
+	return
+}
+
+// signedSession 是验证过 offer 签名的会话, 见 xsignaler.Session
+type signedSession interface {
+	Initiator() []byte
+}
+
+// check 返回发起方的 pubkey, 不允许时返回 signaler.RejectError
+func (a *offerAuth) check(sess signaler.Session) (pubkey device.NoisePublicKey, ierr error) {
+	initiator, ierr := extractInitiator(sess.Description())
+	if ierr != nil {
+		return pubkey, xsignaler.Reject(xsignaler.RejectInvalidOffer, ierr)
+	}
+	pubkey, ierr = initiatorKey(a.priv, a.pub, initiator)
+	if ierr != nil {
+		return pubkey, xsignaler.Reject(xsignaler.RejectInvalidOffer, ierr)
+	}
+	// offer 的签名者必须是握手的发起方, 防止转发别人的握手
+	if ss, ok := sess.(signedSession); ok {
+		if from := ss.Initiator(); from != nil && !bytes.Equal(from, pubkey[:]) {
+			return pubkey, xsignaler.Reject(xsignaler.RejectForbidden, ErrInitiatorMismatch)
+		}
+	}
+	if !a.allowed(pubkey) {
+		return pubkey, xsignaler.Reject(xsignaler.RejectForbidden, ErrNotAllowed)
+	}
+	return
+}
+
+func (a *offerAuth) allowed(pubkey device.NoisePublicKey) bool {
+	a.locker.RLock()
+	ok := a.allow[pubkey]
+	a.locker.RUnlock()
+	if ok {
+		return true
+	}
+	return a.isPeer != nil && a.isPeer(pubkey)
+}
+
+func rejectReason(err error) string {
+	var rejection *xsignaler.RejectError
+	if errors.As(err, &rejection) {
+		return string(rejection.Code)
+	}
+	return string(xsignaler.RejectInternal)
+}
+
+// initiatorKey 按照 wireguard-go 的 ConsumeMessageInitiation 验证 initiation, 但不修改任何握手状态
+func initiatorKey(priv device.NoisePrivateKey, pub device.NoisePublicKey, b []byte) (peer device.NoisePublicKey, ierr error) {
+	if len(b) != device.MessageInitiationSize {
+		return peer, ErrBadInitiation
+	}
+	var msg device.MessageInitiation
+	ierr = binary.Read(bytes.NewReader(b), binary.LittleEndian, &msg)
+	if ierr != nil {
+		return
+	}
+	if msg.Type != device.MessageInitiationType {
+		return peer, ErrBadInitiation
+	}
+
+	var (
+		hash     [blake2s.Size]byte
+		chainKey [blake2s.Size]byte
+		key      [chacha20poly1305.KeySize]byte
+	)
+	mixHash(&hash, &device.InitialHash, pub[:])
+	mixHash(&hash, &hash, msg.Ephemeral[:])
+	device.KDF1(&chainKey, device.InitialChainKey[:], msg.Ephemeral[:])
+
+	// 解出发起方的静态公钥
+	ss, ierr := curve25519.X25519(priv[:], msg.Ephemeral[:])
+	if ierr != nil {
+		return
+	}
+	device.KDF2(&chainKey, &key, chainKey[:], ss)
+	aead, _ := chacha20poly1305.New(key[:])
+	if _, err := aead.Open(peer[:0], device.ZeroNonce[:], msg.Static[:], hash[:]); err != nil {
+		return peer, ErrBadInitiation
+	}
+	mixHash(&hash, &hash, msg.Static[:])
+
+	// 能解开时间戳说明发起方持有静态公钥对应的私钥
+	ss, ierr = curve25519.X25519(priv[:], peer[:])
+	if ierr != nil {
+		return
+	}
+	device.KDF2(&chainKey, &key, chainKey[:], ss)
+	aead, _ = chacha20poly1305.New(key[:])
+	var timestamp [12]byte
+	if _, err := aead.Open(timestamp[:0], device.ZeroNonce[:], msg.Timestamp[:], hash[:]); err != nil {
+		return peer, ErrBadInitiation
+	}
+	return
+}
+
+func mixHash(dst, h *[blake2s.Size]byte, data []byte) {
+	hash, _ := blake2s.New256(nil)
+	hash.Write(h[:])
+	hash.Write(data)
+	hash.Sum(dst[:0])
+}
+
+// extractInitiator 取出 offer SessionInformation 中的 WireGuard initiation
+func extractInitiator(offer signaler.SDP) (initiator []byte, ierr error) {
+	desc, ierr := offer.Unmarshal()
+	if ierr != nil {
+		return
+	}
+	if desc.SessionInformation == nil {
+		return nil, endpoint.ErrInitiatorRequired
+	}
+	return base64.StdEncoding.DecodeString(string(*desc.SessionInformation))
+}
+
+var (
+	ErrNotAllowed    = errors.New("pubkey is not a configured peer or in allow list")
+	ErrBadInitiation = errors.New("invalid WireGuard handshake initiation")
+
+	ErrInitiatorMismatch = errors.New("offer signer is not the handshake initiator")
+)
@@ -0,0 +1,47 @@
+package xhe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestInitiatorKey(t *testing.T) {
+	keyA := try.To1(wgtypes.GeneratePrivateKey())
+	keyB := try.To1(wgtypes.GeneratePrivateKey())
+	pubA, pubB := keyA.PublicKey(), keyB.PublicKey()
+
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), device.NewLogger(device.LogLevelSilent, ""))
+	defer dev.Close()
+	try.To(dev.IpcSet("private_key=" + hex.EncodeToString(keyA[:]) + "\npublic_key=" + hex.EncodeToString(pubB[:]) + "\n"))
+	msg := try.To1(dev.CreateMessageInitiation(dev.LookupPeer(device.NoisePublicKey(pubB))))
+	buf := new(bytes.Buffer)
+	try.To(binary.Write(buf, binary.LittleEndian, msg))
+
+	auth := try.To1(newOfferAuth(keyB[:], nil))
+	peer := try.To1(initiatorKey(auth.priv, auth.pub, buf.Bytes()))
+	assert.Equal(peer, device.NoisePublicKey(pubA))
+	assert.ThatNot(auth.allowed(peer))
+	auth = try.To1(newOfferAuth(keyB[:], []string{pubA.String()}))
+	assert.That(auth.allowed(peer))
+
+	// 篡改过的 initiation 无法通过验证
+	b := buf.Bytes()
+	b[len(b)-40] ^= 1
+	_, err := initiatorKey(auth.priv, auth.pub, b)
+	assert.Error(err)
+
+	// 发给别人的 initiation 也解不开
+	other := try.To1(newOfferAuth(keyA[:], nil))
+	b[len(b)-40] ^= 1
+	_, err = initiatorKey(other.priv, other.pub, b)
+	assert.Error(err)
+}
@@ -2,77 +2,437 @@ package xhe
 
 import (
 	"encoding/hex"
+	"errors"
+	"net"
 	"net/url"
+	"sync"
+	"sync/atomic"
 
-	"github.com/shynome/wgortc"
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
 	"github.com/shynome/wgortc/endpoint"
+	"github.com/shynome/wgortc/mux"
+	"github.com/shynome/wgortc/signaler"
 	"golang.org/x/exp/slog"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
-	"remoon.net/xhe/pkg/signaler"
+	xsignaler "remoon.net/xhe/pkg/signaler"
 )
 
+// Bind 基于 wgortc.Bind, 自己管理 PeerConnection 以便观察 ICE 状态
 type Bind struct {
-	conn.Bind
-	dev *device.Device
-	m   map[string]bool
+	signaler.Channel
+
+	ICEServers []webrtc.ICEServer
+
+	api    *webrtc.API
+	mux    ice.UDPMux
+	udp    *udpConn // 直接通过 UDP 通信的 endpoint, 和 ICE 共用, 见 udp.go
+	msgCh  chan packetMsg
+	closed bool
+	locker *sync.RWMutex
+
+	conns  *iceConns
+	states *connManager
+	paths  *pathTable // 同时有 WebRTC 和 UDP 两条路径的 peer, 见 path.go
+	// auth 不为空时只接受允许的 pubkey 发起的 offer
+	auth *offerAuth
+
+	epLocker  *sync.Mutex
+	outbounds map[string]*outbound
+	inbounds  map[uint64]*inbound // sdp origin session id -> inbound
+	unwatch   func()
+	// standby 为 true 时丢弃发出的数据, HA 模式下由另一个实例和 peer 通信
+	standby atomic.Bool
 }
 
+var (
+	_ conn.Bind    = (*Bind)(nil)
+	_ endpoint.Hub = (*Bind)(nil)
+)
+
 // 包一层实现快速重连
-func newBind(server *signaler.Signaler) *Bind {
-	bind := wgortc.NewBind(server)
+func newBind(server signaler.Channel) *Bind {
 	return &Bind{
-		Bind: bind,
-		m:    make(map[string]bool),
+		Channel: server,
+		locker:  &sync.RWMutex{},
+		conns:   newICEConns(),
+		states:  newConnManager(),
+		paths:   newPathTable(),
+
+		epLocker:  &sync.Mutex{},
+		outbounds: make(map[string]*outbound),
+		inbounds:  make(map[uint64]*inbound),
 	}
 }
 
 func (b *Bind) init(dev *device.Device) {
-	b.dev = dev
+	b.states.retry = func(pubkey string) {
+		key, err := hex.DecodeString(pubkey)
+		if err != nil || len(key) != device.NoisePublicKeySize {
+			return
+		}
+		peer := dev.LookupPeer(device.NoisePublicKey(key))
+		if peer == nil {
+			return
+		}
+		peer.ExpireCurrentKeypairs()
+		peer.SendHandshakeInitiation(false)
+	}
 }
 
-func (b *Bind) Send(bufs [][]byte, ep conn.Endpoint) error {
-	err := b.Bind.Send(bufs, ep)
-	go b.check(ep, err)
-	return err
+type packetMsg struct {
+	data []byte
+	ep   conn.Endpoint
 }
 
-func (b *Bind) check(_ep conn.Endpoint, err error) {
-	if b.dev == nil {
-		return
+func (b *Bind) Open(port uint16) (fns []conn.ReceiveFunc, actualPort uint16, ierr error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	fns = append(fns, b.receiveFunc)
+	b.msgCh = make(chan packetMsg, b.BatchSize()-1)
+
+	settingEngine := webrtc.SettingEngine{}
+	if mux.WithUDPMux != nil {
+		actualPort, ierr = b.openUDP(&settingEngine, port)
+		if ierr != nil {
+			return
+		}
 	}
-	ep, ok := _ep.(*endpoint.Outbound)
-	if !ok {
+	b.api = webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
+
+	ch, ierr := b.Accept()
+	if ierr != nil {
 		return
 	}
+	go func() {
+		for sess := range ch {
+			go b.handleConnect(sess)
+		}
+	}()
+	b.closed = false
+	return
+}
 
-	id := string(ep.DstToBytes())
+func (b *Bind) receiveFunc(packets [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+	if b.isClosed() {
+		return 0, net.ErrClosed
+	}
+	for i := 0; i < b.BatchSize(); i++ {
+		msg, ok := <-b.msgCh
+		if !ok {
+			return 0, net.ErrClosed
+		}
+		sizes[i] = copy(packets[i], msg.data)
+		eps[i] = msg.ep
+		n += 1
+	}
+	return
+}
 
-	if err == nil {
-		if _, ok := b.m[id]; !ok {
+func (b *Bind) handleConnect(sess signaler.Session) {
+	var ierr error
+	logger := slog.With("act", "handle connect")
+	defer then(&ierr, nil, func() {
+		logger.Warn("failed", "err", ierr)
+		sess.Reject(ierr)
+	})
+
+	b.epLocker.Lock()
+	restart := restartOf(b.inbounds, sess.Description())
+	b.epLocker.Unlock()
+	if restart != nil {
+		restart.restart(sess)
+		return
+	}
+	// 在分配 PeerConnection 之前检查发起方
+	var pubkey device.NoisePublicKey
+	if b.auth != nil {
+		pubkey, ierr = b.auth.check(sess)
+		if ierr != nil {
+			offersDropped.Inc(rejectReason(ierr))
 			return
 		}
-		b.m[id] = false
-		return
+		logger = logger.With("peer", hex.EncodeToString(pubkey[:]))
+	}
+
+	var path *pathEndpoint
+	if b.auth != nil {
+		path = b.paths.get(hex.EncodeToString(pubkey[:]))
 	}
 
-	if removed, ok := b.m[id]; ok && removed {
+	var in *inbound
+	pc, ierr := b.newPeerConnection(directionInbound, "", func(state webrtc.ICEConnectionState) {
+		if in != nil {
+			in.onICEState(state)
+		}
+	})
+	if ierr != nil {
+		return
+	}
+	in = newInbound(b, sess, pc)
+	defer in.close()
+	initiator, ierr := in.ExtractInitiator()
+	if ierr != nil {
+		ierr = xsignaler.Reject(xsignaler.RejectInvalidOffer, ierr)
 		return
 	}
-	b.m[id] = true
+	if in.origin != 0 {
+		b.epLocker.Lock()
+		b.inbounds[in.origin] = in
+		b.epLocker.Unlock()
+	}
+	// 有两条路径的 peer 收到的包报告为 pathEndpoint, 回复也由它选择路径
+	var ep conn.Endpoint = in
+	if path != nil {
+		path.setInbound(in)
+		defer path.forgetInbound(in)
+		ep = path
+	}
+	b.pipe(initiator, ep)
+	for {
+		select {
+		case d := <-in.Message():
+			if b.isClosed() {
+				return
+			}
+			if isProbe(d) {
+				b.handleProbe(d, in.Send)
+				continue
+			}
+			b.pipe(d, ep)
+		case <-in.done:
+			return
+		}
+	}
+}
 
-	var ierr error
-	_ = ierr
-	slog.With("connect", id).Warn("连接已关闭, 需要重新握手")
-	link, ierr := url.Parse(id)
+func (b *Bind) forgetInbound(in *inbound) {
+	b.epLocker.Lock()
+	defer b.epLocker.Unlock()
+	if b.inbounds[in.origin] == in {
+		delete(b.inbounds, in.origin)
+	}
+}
+
+// restartAll 网络变化后对所有主动连接做 ICE restart
+func (b *Bind) restartAll(reason string) {
+	b.epLocker.Lock()
+	eps := make([]*outbound, 0, len(b.outbounds))
+	for _, ep := range b.outbounds {
+		eps = append(eps, ep)
+	}
+	b.epLocker.Unlock()
+	for _, ep := range eps {
+		ep.Restart(reason)
+	}
+}
+
+// watchNetwork 监听本机网络变化, ignore 是 xhe 自己的网卡
+func (b *Bind) watchNetwork(ignore string) (ierr error) {
+	unwatch, ierr := watchNetwork(ignore, func() {
+		b.restartAll("network changed")
+	})
 	if ierr != nil {
 		return
 	}
-	pubkey, ierr := hex.DecodeString(link.Fragment)
+	b.locker.Lock()
+	b.unwatch = unwatch
+	b.locker.Unlock()
+	return
+}
+
+func (b *Bind) pipeUDP(data []byte, ep *udpEndpoint) {
+	if b.isClosed() {
+		return
+	}
+	if isProbe(data) {
+		b.handleProbe(data, func(buf []byte) error {
+			return b.udp.send([][]byte{buf}, ep)
+		})
+		return
+	}
+	if p := b.paths.byAddr(ep.AddrPort); p != nil {
+		b.pipe(data, p)
+		return
+	}
+	b.pipe(data, ep)
+}
+
+func (b *Bind) pipe(data []byte, ep conn.Endpoint) {
+	b.msgCh <- packetMsg{data: data, ep: ep}
+}
+
+func (b *Bind) isClosed() bool {
+	b.locker.RLock()
+	defer b.locker.RUnlock()
+	return b.closed
+}
+
+func (b *Bind) Close() (ierr error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	b.closed = true
+	if b.unwatch != nil {
+		b.unwatch()
+		b.unwatch = nil
+	}
+	if b.mux != nil {
+		ierr = b.mux.Close()
+		if ierr != nil {
+			return
+		}
+	}
+	if b.Channel != nil {
+		ierr = b.Channel.Close()
+		if ierr != nil {
+			return
+		}
+	}
+	if b.msgCh != nil {
+		close(b.msgCh)
+	}
+	return
+}
+
+func (b *Bind) ParseEndpoint(s string) (ep conn.Endpoint, err error) {
+	if isUDPEndpoint(s) {
+		return parseUDPEndpoint(s)
+	}
+	if id, udp, ok := splitPathEndpoint(s); ok {
+		return b.newPath(id, udp)
+	}
+	out := b.addOutbound(s)
+	out.setOwner(nil)
+	if out.peer != "" {
+		// 去掉了 udp 参数, 不再需要选择路径
+		b.paths.remove(out.peer)
+	}
+	return out, nil
+}
+
+// addOutbound 返回 s 对应的 outbound. 重新解析同一个 endpoint 时复用已有的连接,
+// 同一个 peer 换了 endpoint 时关闭旧的, 避免遗留 PeerConnection
+func (b *Bind) addOutbound(s string) *outbound {
+	b.epLocker.Lock()
+	if out, ok := b.outbounds[s]; ok && !out.isClosed() {
+		b.epLocker.Unlock()
+		return out
+	}
+	out := newOutbound(s, b)
+	var stale []*outbound
+	for id, old := range b.outbounds {
+		if id == s || (out.peer != "" && old.peer == out.peer) {
+			stale = append(stale, old)
+			delete(b.outbounds, id)
+		}
+	}
+	b.outbounds[s] = out
+	b.epLocker.Unlock()
+	for _, old := range stale {
+		old.Close()
+	}
+	go b.pipeOutbound(out)
+	return out
+}
+
+// pipeOutbound 把 out 收到的包报告为它的 owner 交给 WireGuard
+func (b *Bind) pipeOutbound(out *outbound) {
+	for {
+		var d []byte
+		select {
+		case d = <-out.Message():
+		case <-out.done:
+			return
+		}
+		if b.isClosed() {
+			return
+		}
+		if isProbe(d) {
+			b.handleProbe(d, out.Send)
+			continue
+		}
+		b.pipe(d, out.getOwner())
+	}
+}
+
+func (b *Bind) NewPeerConnection() (*webrtc.PeerConnection, error) {
+	return b.newPeerConnection(directionOutbound, "", nil)
+}
+
+func (b *Bind) newPeerConnection(direction string, peer string, notify func(webrtc.ICEConnectionState)) (pc *webrtc.PeerConnection, ierr error) {
+	config := webrtc.Configuration{
+		ICEServers: b.ICEServers,
+	}
+	pc, ierr = b.api.NewPeerConnection(config)
 	if ierr != nil {
 		return
 	}
-	pk := device.NoisePublicKey(pubkey)
-	peer := b.dev.LookupPeer(pk)
-	peer.ExpireCurrentKeypairs()
+	b.conns.track(pc, direction, peer, notify)
+	return
+}
+
+func (b *Bind) Send(bufs [][]byte, ep conn.Endpoint) (err error) {
+	if b.standby.Load() {
+		return nil
+	}
+	if p, ok := ep.(*pathEndpoint); ok {
+		return p.send(bufs)
+	}
+	return b.sendWebRTC(bufs, ep)
 }
+
+func (b *Bind) sendWebRTC(bufs [][]byte, ep conn.Endpoint) (err error) {
+	out, ok := ep.(*outbound)
+	if !ok {
+		return b.send(bufs, ep)
+	}
+	peer := out.peer
+	if len(bufs) > 0 && out.connecting(bufs[0]) && !b.states.allow(peer) {
+		// 交给 WireGuard 自己的重传, 等退避结束再真正发起连接
+		return nil
+	}
+	err = b.send(bufs, ep)
+	if err != nil {
+		bindSendFailures.Inc(peer)
+		b.states.sendFailed(peer, err)
+	}
+	return err
+}
+
+func (b *Bind) send(bufs [][]byte, ep conn.Endpoint) (err error) {
+	if b.isClosed() {
+		return net.ErrClosed
+	}
+	if ep, ok := ep.(*udpEndpoint); ok {
+		if b.udp == nil {
+			return ErrUDPUnavailable
+		}
+		return b.udp.send(bufs, ep)
+	}
+	sender, ok := ep.(endpoint.Sender)
+	if !ok {
+		return ErrEndpointImpl
+	}
+	for _, buf := range bufs {
+		if err := sender.Send(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bind) SetMark(mark uint32) error { return nil }
+func (b *Bind) BatchSize() int            { return 1 }
+
+// endpointPeer 从 endpoint 的 fragment 中取出 pubkey
+func endpointPeer(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return u.Fragment
+}
+
+var ErrEndpointImpl = errors.New("endpoint is not wgortc.Endpoint")
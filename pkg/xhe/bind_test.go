@@ -0,0 +1,39 @@
+package xhe
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestBindOutbounds(t *testing.T) {
+	b := newBind(nil)
+	ep1 := try.To1(b.ParseEndpoint("https://hub/?peer=a#a"))
+	ep2 := try.To1(b.ParseEndpoint("https://hub/?peer=a#a"))
+	assert.Equal(ep1, ep2)
+	assert.MLen(b.outbounds, 1)
+
+	// 同一个 peer 换了 endpoint, 旧的被关闭
+	ep3 := try.To1(b.ParseEndpoint("https://hub2/?peer=a#a"))
+	assert.NotEqual(ep1, ep3)
+	assert.MLen(b.outbounds, 1)
+	out1 := ep1.(*outbound)
+	assert.That(out1.isClosed())
+	assert.That(errors.Is(out1.Send([]byte{1}), net.ErrClosed))
+
+	// 加上 udp 参数后复用 WebRTC 的连接, 收到的包报告为 pathEndpoint
+	p := try.To1(b.ParseEndpoint("https://hub2/?peer=a&udp=127.0.0.1:51820#a")).(*pathEndpoint)
+	assert.Equal(p.out, ep3.(*outbound))
+	assert.Equal(p.out.getOwner(), conn.Endpoint(p))
+	assert.Equal(b.paths.get("a"), p)
+
+	// 去掉 udp 参数后不再选择路径
+	ep4 := try.To1(b.ParseEndpoint("https://hub2/?peer=a#a"))
+	assert.Equal(ep4, ep3)
+	assert.Equal(ep3.(*outbound).getOwner(), ep4)
+	assert.That(b.paths.get("a") == nil)
+}
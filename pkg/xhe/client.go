@@ -0,0 +1,122 @@
+package xhe
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// HTTPConfig 是访问 signaler 和 DoH 使用的 http 客户端配置
+type HTTPConfig struct {
+	// Proxy 是 http, https 或者 socks5 代理, 为空时使用 HTTPS_PROXY 等环境变量
+	Proxy string `json:"proxy"`
+	// CA 是额外信任的 CA 证书文件 (PEM), 和系统的 CA 一起使用
+	CA string `json:"ca"`
+	// Cert 和 Key 是双向 TLS 的客户端证书和私钥文件 (PEM)
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// Pins 是证书链中必须出现的公钥, base64(sha256(SPKI)).
+	// 写成 {host}={pin} 时只对这个 host 生效, 否则对所有 host 生效
+	Pins []string `json:"pins"`
+}
+
+// NewClient 按配置创建 http 客户端, 没有任何配置时返回 http.DefaultClient
+func (c HTTPConfig) NewClient() (client *http.Client, ierr error) {
+	if c.Proxy == "" && c.CA == "" && c.Cert == "" && c.Key == "" && len(c.Pins) == 0 {
+		return http.DefaultClient, nil
+	}
+	tlsConfig := &tls.Config{}
+	if c.CA != "" {
+		b, ierr := os.ReadFile(c.CA)
+		if ierr != nil {
+			return nil, ierr
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, ierr := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if ierr != nil {
+			return nil, ierr
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.Pins) > 0 {
+		pins, ierr := parsePins(c.Pins)
+		if ierr != nil {
+			return nil, ierr
+		}
+		tlsConfig.VerifyConnection = pins.verify
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if c.Proxy != "" {
+		u, ierr := url.Parse(c.Proxy)
+		if ierr != nil {
+			return nil, ierr
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupport proxy schema %s", u.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// spkiPins 是 host 到 pin 的集合, 空 host 对所有 host 生效
+type spkiPins map[string]map[string]bool
+
+func parsePins(list []string) (pins spkiPins, ierr error) {
+	pins = spkiPins{}
+	for _, s := range list {
+		host, pin, ok := strings.Cut(s, "=")
+		// base64 的 pin 也可能以 = 结尾
+		if !ok || strings.Trim(pin, "=") == "" {
+			host, pin = "", s
+		}
+		b, ierr := base64.StdEncoding.DecodeString(pin)
+		if ierr != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("pin %q is not base64 of sha256", s)
+		}
+		if pins[host] == nil {
+			pins[host] = map[string]bool{}
+		}
+		pins[host][pin] = true
+	}
+	return
+}
+
+// verify 要求证书链中至少有一个公钥在 pin 里, 在正常的证书验证之后执行
+func (pins spkiPins) verify(cs tls.ConnectionState) error {
+	set := pins[cs.ServerName]
+	if set == nil {
+		set = pins[""]
+	}
+	if set == nil {
+		return nil
+	}
+	for _, cert := range cs.PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if set[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrPinMismatch, cs.ServerName)
+}
+
+var ErrPinMismatch = errors.New("no pinned public key in certificate chain")
@@ -0,0 +1,49 @@
+package xhe
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestHTTPClientPins(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	cert := server.Certificate()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	try.To(os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600))
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	// 没有配置时使用默认客户端
+	client := try.To1(HTTPConfig{}.NewClient())
+	assert.Equal(client, http.DefaultClient)
+
+	client = try.To1(HTTPConfig{CA: ca, Pins: []string{pin}}.NewClient())
+	resp := try.To1(client.Get(server.URL))
+	resp.Body.Close()
+
+	// 只对 example.com 生效的 pin 不影响其他 host
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	client = try.To1(HTTPConfig{CA: ca, Pins: []string{"example.com=" + other}}.NewClient())
+	resp = try.To1(client.Get(server.URL))
+	resp.Body.Close()
+
+	client = try.To1(HTTPConfig{CA: ca, Pins: []string{other}}.NewClient())
+	_, err := client.Get(server.URL)
+	assert.That(errors.Is(err, ErrPinMismatch))
+
+	_, err = HTTPConfig{Pins: []string{"not-a-pin"}}.NewClient()
+	assert.Error(err)
+	_, err = HTTPConfig{Proxy: "ftp://127.0.0.1"}.NewClient()
+	assert.Error(err)
+}
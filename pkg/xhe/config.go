@@ -3,7 +3,9 @@ package xhe
 import (
 	"log/slog"
 
+	"github.com/shynome/wgortc/signaler"
 	"golang.zx2c4.com/wireguard/tun"
+	xsignaler "remoon.net/xhe/pkg/signaler"
 )
 
 type Config struct {
@@ -15,6 +17,32 @@ type Config struct {
 	Port       uint16     `json:"port"`
 	MTU        int        `json:"mtu"`
 	GoTun      tun.Device
+
+	// Allow 是除了 Peers 之外允许发起连接的 pubkey
+	Allow []string `json:"allow"`
+	// AllowUnsigned 接受旧版本发起的没有签名的 offer
+	AllowUnsigned bool `json:"allow_unsigned"`
+	// PlainSDP 不加密发出的 offer
+	PlainSDP bool `json:"plain_sdp"`
+	// SignMode 是请求 hub 的签名方式, 见 signaler.SignMode
+	SignMode string `json:"sign_mode"`
+	// RequireLinks 是启动时至少要连上的 Links 数量, 见 signaler.Signaler.RequireLinks
+	RequireLinks int `json:"require_links"`
+	// LAN 不为 0 时通过 mDNS 发现局域网内的 peer, 并在这个端口直接交换 offer
+	LAN uint16 `json:"lan"`
+	// Relay 不为 0 时在隧道内的这个端口为已经连接的 peer 转发 offer, hub 不可用时也通过它们发起连接
+	Relay uint16 `json:"relay"`
+	// HA 为 true 时可以用同一个 key 运行两个实例, 订阅被另一个实例锁定时作为 standby, 不配置路由也不发送数据,
+	// active 消失后自动接管. 见 signaler.Signaler.HA
+	HA bool `json:"ha"`
+	// Priority 是 HA 模式下接管的优先级, 0 到 10, 高的先接管
+	Priority int `json:"priority"`
+	// OfferLimits 不为空时替换接收 offer 的默认限制 xsignaler.DefaultOfferLimits
+	OfferLimits *xsignaler.OfferLimits `json:"offer_limits"`
+	// HTTP 是访问 Links 和 DoH 使用的 http 客户端配置
+	HTTP HTTPConfig `json:"http"`
+	// Channel 替换默认的 signaler, 比如手动交换的 signaler.Pair. 设置后 Links 和上面的 signaler 选项不生效
+	Channel signaler.Channel `json:"-"`
 }
 
 func (cfg Config) Normalize() {
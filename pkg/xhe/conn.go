@@ -0,0 +1,327 @@
+package xhe
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/exp/slog"
+	xsignaler "remoon.net/xhe/pkg/signaler"
+)
+
+type ConnState int
+
+const (
+	ConnIdle ConnState = iota
+	ConnResolving
+	ConnSignaling
+	ConnChecking
+	ConnConnected
+	ConnRestarting
+	ConnBackoff
+)
+
+var connStateNames = [...]string{
+	ConnIdle:       "idle",
+	ConnResolving:  "resolving",
+	ConnSignaling:  "signaling",
+	ConnChecking:   "checking",
+	ConnConnected:  "connected",
+	ConnRestarting: "restarting",
+	ConnBackoff:    "backoff",
+}
+
+func (s ConnState) String() string {
+	if int(s) < len(connStateNames) {
+		return connStateNames[s]
+	}
+	return "unknown"
+}
+
+type peerConn struct {
+	state   ConnState
+	since   time.Time
+	attempt uint64
+	// failures 是连上之前连续失败的次数, err 是最后一次失败的原因, 连上后清空
+	failures int
+	retryAt  time.Time
+	err      error
+}
+
+// connManager 管理主动连接的 peer 的连接状态.
+// 每次连接尝试有一个 attempt 编号, 旧尝试的回调不会影响新的状态
+type connManager struct {
+	locker *sync.Mutex
+	peers  map[string]*peerConn
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// 超过这个时间还没连上的尝试可以被新的握手替换
+	attemptTimeout time.Duration
+	// 每失败 resolveEvery 次重新解析一次 peer link
+	resolveEvery int
+
+	// retry 在退避结束后调用, 用于让 WireGuard 立即重新握手
+	retry func(pubkey string)
+	// resolve 重新解析 peer link, 更新 endpoint
+	resolve func(pubkey string) error
+
+	now       func() time.Time
+	afterFunc func(d time.Duration, f func())
+}
+
+func newConnManager() *connManager {
+	return &connManager{
+		locker:         &sync.Mutex{},
+		peers:          make(map[string]*peerConn),
+		minBackoff:     time.Second,
+		maxBackoff:     2 * time.Minute,
+		attemptTimeout: 20 * time.Second,
+		resolveEvery:   3,
+		now:            time.Now,
+		afterFunc:      func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+	}
+}
+
+// get 调用时需持有 locker
+func (m *connManager) get(pubkey string) *peerConn {
+	p, ok := m.peers[pubkey]
+	if !ok {
+		p = &peerConn{state: ConnIdle, since: m.now()}
+		m.peers[pubkey] = p
+	}
+	return p
+}
+
+// set 调用时需持有 locker
+func (m *connManager) set(pubkey string, p *peerConn, state ConnState) {
+	if p.state == state {
+		return
+	}
+	slog.Debug("peer connection state", "peer", pubkey, "from", p.state.String(), "to", state.String())
+	p.state = state
+	p.since = m.now()
+}
+
+// allow 判断现在是否可以发起新的握手.
+// 退避期间和连接进行中丢弃 WireGuard 重传的握手包, 避免握手风暴
+func (m *connManager) allow(pubkey string) bool {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	p := m.get(pubkey)
+	switch p.state {
+	case ConnResolving:
+		return false
+	case ConnBackoff:
+		return !m.now().Before(p.retryAt)
+	case ConnSignaling, ConnChecking, ConnRestarting:
+		return m.now().Sub(p.since) >= m.attemptTimeout
+	}
+	return true
+}
+
+// begin 开始一次新的连接尝试
+func (m *connManager) begin(pubkey string) (attempt uint64) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	p := m.get(pubkey)
+	p.attempt++
+	m.set(pubkey, p, ConnSignaling)
+	return p.attempt
+}
+
+// signaled 信令交换完成
+func (m *connManager) signaled(pubkey string, attempt uint64, err error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	p := m.get(pubkey)
+	if p.attempt != attempt || p.state != ConnSignaling {
+		return
+	}
+	if err != nil {
+		m.fail(pubkey, p, err)
+		return
+	}
+	m.set(pubkey, p, ConnChecking)
+}
+
+func (m *connManager) ice(pubkey string, attempt uint64, state webrtc.ICEConnectionState) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	p := m.get(pubkey)
+	if p.attempt != attempt {
+		return
+	}
+	switch state {
+	case webrtc.ICEConnectionStateChecking:
+		if p.state == ConnSignaling {
+			m.set(pubkey, p, ConnChecking)
+		}
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		p.failures, p.err = 0, nil
+		m.set(pubkey, p, ConnConnected)
+	case webrtc.ICEConnectionStateFailed,
+		webrtc.ICEConnectionStateDisconnected:
+		// restarting 时由 ICE restart 的结果决定
+		switch p.state {
+		case ConnSignaling, ConnChecking, ConnConnected:
+			m.fail(pubkey, p, errICEState(state))
+		}
+	case webrtc.ICEConnectionStateClosed:
+		switch p.state {
+		case ConnSignaling, ConnChecking, ConnConnected, ConnRestarting:
+			m.fail(pubkey, p, errICEState(state))
+		}
+	}
+}
+
+// restart 已连接的 peer 开始 ICE restart
+func (m *connManager) restart(pubkey string, attempt uint64) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	p := m.get(pubkey)
+	if p.attempt != attempt {
+		return
+	}
+	m.set(pubkey, p, ConnRestarting)
+}
+
+// failed 连接尝试或 ICE restart 出错
+func (m *connManager) failed(pubkey string, attempt uint64, err error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	p := m.get(pubkey)
+	if p.attempt != attempt {
+		return
+	}
+	switch p.state {
+	case ConnSignaling, ConnChecking, ConnConnected, ConnRestarting:
+		m.fail(pubkey, p, err)
+	}
+}
+
+// sendFailed 已连接的 peer 发送失败, 说明 DataChannel 已经断开
+func (m *connManager) sendFailed(pubkey string, err error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	p := m.get(pubkey)
+	if p.state != ConnConnected {
+		return
+	}
+	m.fail(pubkey, p, err)
+}
+
+// fail 调用时需持有 locker, 失败的次数和原因记录在 peerConn 中, 状态直接进入退避
+func (m *connManager) fail(pubkey string, p *peerConn, err error) {
+	p.failures++
+	p.err = err
+
+	d := m.backoffDelay(p.failures)
+	// 对方明确拒绝了连接, 重试也没用, 直接等最长的时间
+	var rejection *xsignaler.RejectError
+	if errors.As(err, &rejection) && rejection.Permanent() {
+		d = m.maxBackoff
+	}
+	p.retryAt = m.now().Add(d)
+	m.set(pubkey, p, ConnBackoff)
+	slog.Warn("peer connection failed, retry later",
+		"peer", pubkey,
+		"failures", p.failures,
+		"retry", d.Truncate(time.Millisecond).String(),
+		"err", err,
+	)
+
+	attempt := p.attempt
+	resolve := m.resolve != nil && m.resolveEvery > 0 && p.failures%m.resolveEvery == 0
+	if resolve {
+		m.set(pubkey, p, ConnResolving)
+		go m.doResolve(pubkey, attempt)
+	}
+	m.afterFunc(d, func() {
+		m.locker.Lock()
+		p := m.get(pubkey)
+		ok := p.attempt == attempt && p.state == ConnBackoff
+		m.locker.Unlock()
+		if ok && m.retry != nil {
+			m.retry(pubkey)
+		}
+	})
+}
+
+func (m *connManager) doResolve(pubkey string, attempt uint64) {
+	err := m.resolve(pubkey)
+	if err != nil {
+		slog.Warn("re-resolve peer link failed", "peer", pubkey, "err", err)
+	}
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	p := m.get(pubkey)
+	if p.attempt != attempt || p.state != ConnResolving {
+		return
+	}
+	m.set(pubkey, p, ConnBackoff)
+	// 解析期间退避已经结束, 定时器不会再触发重试
+	if !m.now().Before(p.retryAt) && m.retry != nil {
+		go m.retry(pubkey)
+	}
+}
+
+func (m *connManager) backoffDelay(failures int) time.Duration {
+	d := m.minBackoff
+	for i := 1; i < failures && d < m.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > m.maxBackoff {
+		d = m.maxBackoff
+	}
+	// 加 20% 以内的抖动, 避免多个 peer 同时重连
+	if jitter := int64(d) / 5; jitter > 0 {
+		d += time.Duration(rand.Int63n(jitter))
+	}
+	return d
+}
+
+func (m *connManager) state(pubkey string) (state ConnState, ok bool) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	p, ok := m.peers[pubkey]
+	if !ok {
+		return ConnIdle, false
+	}
+	return p.state, true
+}
+
+// status 返回 peer 连接状态的副本, 包括连续失败的次数和最后的错误
+func (m *connManager) status(pubkey string) (p peerConn, ok bool) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	c, ok := m.peers[pubkey]
+	if !ok {
+		return peerConn{}, false
+	}
+	return *c, true
+}
+
+func (m *connManager) remove(pubkey string) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	delete(m.peers, pubkey)
+}
+
+func (m *connManager) list() map[string]peerConn {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	peers := make(map[string]peerConn, len(m.peers))
+	for k, p := range m.peers {
+		peers[k] = *p
+	}
+	return peers
+}
+
+type errICEState webrtc.ICEConnectionState
+
+func (e errICEState) Error() string {
+	return "ice connection state is " + webrtc.ICEConnectionState(e).String()
+}
@@ -0,0 +1,164 @@
+package xhe
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/pion/webrtc/v3"
+	xsignaler "remoon.net/xhe/pkg/signaler"
+)
+
+type fakeClock struct {
+	now    time.Time
+	timers []func()
+}
+
+func newTestConnManager() (*connManager, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	m := newConnManager()
+	m.now = func() time.Time { return clock.now }
+	m.afterFunc = func(d time.Duration, f func()) { clock.timers = append(clock.timers, f) }
+	return m, clock
+}
+
+func TestConnManager(t *testing.T) {
+	m, clock := newTestConnManager()
+	retried := 0
+	m.retry = func(pubkey string) { retried++ }
+	const peer = "peer"
+
+	assert.That(m.allow(peer))
+	a1 := m.begin(peer)
+	assert.Equal(mustState(m, peer), ConnSignaling)
+	// 连接进行中丢弃重传的握手
+	assert.ThatNot(m.allow(peer))
+
+	m.signaled(peer, a1, nil)
+	assert.Equal(mustState(m, peer), ConnChecking)
+	m.ice(peer, a1, webrtc.ICEConnectionStateConnected)
+	assert.Equal(mustState(m, peer), ConnConnected)
+
+	m.sendFailed(peer, errors.New("closed"))
+	assert.Equal(mustState(m, peer), ConnBackoff)
+	assert.ThatNot(m.allow(peer))
+	assert.SLen(clock.timers, 1)
+
+	// 旧尝试的回调不影响新的状态
+	clock.now = clock.now.Add(time.Minute)
+	assert.That(m.allow(peer))
+	a2 := m.begin(peer)
+	m.ice(peer, a1, webrtc.ICEConnectionStateFailed)
+	assert.Equal(mustState(m, peer), ConnSignaling)
+	// 重新连接时仍然报告上次失败的原因
+	p, _ := m.status(peer)
+	assert.Equal(p.failures, 1)
+	assert.Equal(p.err.Error(), "closed")
+
+	// 旧的定时器也不会触发重试
+	clock.timers[0]()
+	assert.Equal(retried, 0)
+
+	m.signaled(peer, a2, errors.New("hub unreachable"))
+	assert.Equal(mustState(m, peer), ConnBackoff)
+	clock.timers[1]()
+	assert.Equal(retried, 1)
+	p, _ = m.status(peer)
+	assert.Equal(p.failures, 2)
+	assert.Equal(p.err.Error(), "hub unreachable")
+
+	// 连上后清空
+	a3 := m.begin(peer)
+	m.signaled(peer, a3, nil)
+	m.ice(peer, a3, webrtc.ICEConnectionStateConnected)
+	p, _ = m.status(peer)
+	assert.Equal(p.failures, 0)
+	assert.That(p.err == nil)
+
+	m.remove(peer)
+	_, ok := m.state(peer)
+	assert.ThatNot(ok)
+}
+
+func TestConnManagerRestart(t *testing.T) {
+	m, _ := newTestConnManager()
+	const peer = "peer"
+	a := m.begin(peer)
+	m.signaled(peer, a, nil)
+	m.ice(peer, a, webrtc.ICEConnectionStateConnected)
+
+	m.restart(peer, a)
+	assert.Equal(mustState(m, peer), ConnRestarting)
+	// restart 期间的断开不算失败
+	m.ice(peer, a, webrtc.ICEConnectionStateDisconnected)
+	m.ice(peer, a, webrtc.ICEConnectionStateFailed)
+	assert.Equal(mustState(m, peer), ConnRestarting)
+	assert.ThatNot(m.allow(peer))
+	m.ice(peer, a, webrtc.ICEConnectionStateConnected)
+	assert.Equal(mustState(m, peer), ConnConnected)
+
+	m.restart(peer, a)
+	m.failed(peer, a, ErrRestartTimeout)
+	assert.Equal(mustState(m, peer), ConnBackoff)
+}
+
+func TestConnManagerAttemptTimeout(t *testing.T) {
+	m, clock := newTestConnManager()
+	const peer = "peer"
+	m.begin(peer)
+	assert.ThatNot(m.allow(peer))
+	clock.now = clock.now.Add(m.attemptTimeout)
+	assert.That(m.allow(peer))
+}
+
+func TestConnManagerResolve(t *testing.T) {
+	m, _ := newTestConnManager()
+	resolved := make(chan string, 1)
+	m.resolve = func(pubkey string) error {
+		resolved <- pubkey
+		return nil
+	}
+	const peer = "peer"
+	for i := 0; i < m.resolveEvery; i++ {
+		a := m.begin(peer)
+		m.signaled(peer, a, errors.New("hub unreachable"))
+	}
+	select {
+	case p := <-resolved:
+		assert.Equal(p, peer)
+	case <-time.After(time.Second):
+		t.Fatal("peer link is not resolved")
+	}
+}
+
+func TestConnManagerRejected(t *testing.T) {
+	m, clock := newTestConnManager()
+	const peer = "peer"
+	// 没有验证签名的 forbidden 可能是 hub 伪造的, 按普通的失败退避
+	a := m.begin(peer)
+	m.signaled(peer, a, xsignaler.Reject(xsignaler.RejectForbidden, nil))
+	assert.Equal(mustState(m, peer), ConnBackoff)
+	clock.now = clock.now.Add(m.maxBackoff / 2)
+	assert.That(m.allow(peer))
+
+	a = m.begin(peer)
+	m.signaled(peer, a, xsignaler.Reject(xsignaler.RejectBusy, nil))
+	clock.now = clock.now.Add(m.maxBackoff / 2)
+	assert.That(m.allow(peer))
+}
+
+func TestBackoffDelay(t *testing.T) {
+	m := newConnManager()
+	for failures := 1; failures < 20; failures++ {
+		d := m.backoffDelay(failures)
+		assert.That(d >= m.minBackoff)
+		assert.That(d <= m.maxBackoff+m.maxBackoff/5)
+	}
+	assert.That(m.backoffDelay(2) >= 2*m.minBackoff)
+}
+
+func mustState(m *connManager, pubkey string) ConnState {
+	state, _ := m.state(pubkey)
+	return state
+}
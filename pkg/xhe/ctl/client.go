@@ -0,0 +1,75 @@
+package ctl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"remoon.net/xhe/pkg/signaler"
+	"remoon.net/xhe/pkg/xhe"
+)
+
+type Client struct {
+	client *http.Client
+}
+
+func NewClient(dial func() (net.Conn, error)) *Client {
+	return &Client{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dial()
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) Peers() (peers []xhe.PeerStatus, ierr error) {
+	ierr = c.do(http.MethodGet, "/peers", nil, &peers)
+	return
+}
+
+func (c *Client) Links() (links []signaler.LinkStatus, ierr error) {
+	ierr = c.do(http.MethodGet, "/links", nil, &links)
+	return
+}
+
+func (c *Client) AddPeer(link string) (peer xhe.PeerStatus, ierr error) {
+	q := url.Values{"link": {link}}
+	ierr = c.do(http.MethodPost, "/peers", q, &peer)
+	return
+}
+
+func (c *Client) RemovePeer(s string) (peer xhe.PeerStatus, ierr error) {
+	q := url.Values{"peer": {s}}
+	ierr = c.do(http.MethodDelete, "/peers", q, &peer)
+	return
+}
+
+func (c *Client) do(method string, path string, q url.Values, v any) (ierr error) {
+	u := url.URL{Scheme: "http", Host: "xhe", Path: path, RawQuery: q.Encode()}
+	req, ierr := http.NewRequest(method, u.String(), nil)
+	if ierr != nil {
+		return
+	}
+	resp, ierr := c.client.Do(req)
+	if ierr != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	ierr = json.NewDecoder(resp.Body).Decode(v)
+	if ierr != nil {
+		return
+	}
+	return
+}
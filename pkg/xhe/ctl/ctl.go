@@ -0,0 +1,94 @@
+package ctl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"remoon.net/xhe/pkg/signaler"
+	"remoon.net/xhe/pkg/xhe"
+)
+
+// 控制接口, 通过 unix socket 上的 http 调用
+//
+//	GET    /peers            列出 peers
+//	POST   /peers?link=...   添加 peer
+//	DELETE /peers?peer=...   移除 peer, peer 可以是 pubkey 或 link
+//	GET    /links            列出 signaler 链接的状态
+func NewHandler(dev *xhe.Device) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/links", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		links := dev.Links()
+		if links == nil {
+			links = []signaler.LinkStatus{}
+		}
+		writeJSON(w, links)
+	})
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+		defer cancel()
+		switch r.Method {
+		case http.MethodGet:
+			peers, err := dev.Peers()
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, peers)
+		case http.MethodPost:
+			link := r.URL.Query().Get("link")
+			if link == "" {
+				http.Error(w, "link is required", http.StatusBadRequest)
+				return
+			}
+			peer, err := dev.AddPeer(ctx, link)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, xhe.PeerStatus{
+				PublicKey:  peer.PublicKey,
+				Link:       link,
+				Endpoint:   peer.Endpoint,
+				AllowedIPs: peer.AllowedIPs,
+			})
+		case http.MethodDelete:
+			s := r.URL.Query().Get("peer")
+			if s == "" {
+				http.Error(w, "peer is required", http.StatusBadRequest)
+				return
+			}
+			pubkey, link, err := dev.RemovePeer(ctx, s)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, xhe.PeerStatus{
+				PublicKey: pubkey,
+				Link:      link,
+			})
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, xhe.ErrPeerNotFound) {
+		code = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,280 @@
+package xhe
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+	"remoon.net/xhe/pkg/config"
+	"remoon.net/xhe/pkg/signaler"
+	"remoon.net/xhe/pkg/xhe/ipconf"
+)
+
+type Device struct {
+	*device.Device
+	tun tun.Device
+	doh *DoH
+
+	ip         netip.Prefix
+	states     *connManager
+	paths      *pathTable
+	linkStatus func() []signaler.LinkStatus
+	role       *haRole
+
+	locker   *sync.RWMutex
+	links    map[string]string // hex pubkey -> peer link
+	watchers []func()
+}
+
+func newDevice(dev *device.Device, tdev tun.Device, doh *DoH) *Device {
+	return &Device{
+		Device: dev,
+		tun:    tdev,
+		doh:    doh,
+		role:   newHARole(),
+		locker: &sync.RWMutex{},
+		links:  make(map[string]string),
+	}
+}
+
+// AddPeer 解析 peer link 并添加到 WireGuard
+func (d *Device) AddPeer(ctx context.Context, link string) (peer config.Peer, ierr error) {
+	logger := slog.With(
+		"act", "add peer",
+		"link", link,
+	)
+	logger.Debug("pending")
+	defer then(&ierr, func() {
+		logger.Info("successful", "pubkey", peer.PublicKey)
+	}, func() {
+		logger.Warn("failed", "err", ierr)
+	})
+
+	peer, ierr = d.doh.ParsePeer(ctx, link)
+	if ierr != nil {
+		return
+	}
+	ierr = d.IpcSet(peer.String())
+	if ierr != nil {
+		return
+	}
+	d.setLink(peer.PublicKey, link)
+	if d.routed() {
+		ierr = ipconf.AddPeerRoutes(d.tun, parsePrefixes(peer.AllowedIPs))
+		if ierr != nil {
+			return
+		}
+	}
+	d.notify()
+	return
+}
+
+// RemovePeer 移除 peer, s 可以是 pubkey 或者添加时使用的 peer link
+func (d *Device) RemovePeer(ctx context.Context, s string) (pubkey string, link string, ierr error) {
+	logger := slog.With(
+		"act", "remove peer",
+		"peer", s,
+	)
+	logger.Debug("pending")
+	defer then(&ierr, func() {
+		logger.Info("successful", "pubkey", pubkey)
+	}, func() {
+		logger.Warn("failed", "err", ierr)
+	})
+
+	pubkey, ierr = d.lookupPubkey(ctx, s)
+	if ierr != nil {
+		return
+	}
+	key, ierr := hex.DecodeString(pubkey)
+	if ierr != nil {
+		return
+	}
+	if d.LookupPeer(device.NoisePublicKey(key)) == nil {
+		return "", "", ErrPeerNotFound
+	}
+	var allowedIPs []string
+	if peers, err := d.Peers(); err == nil {
+		for _, p := range peers {
+			if p.PublicKey == pubkey {
+				allowedIPs = p.AllowedIPs
+			}
+		}
+	}
+	ierr = d.IpcSet(fmt.Sprintf("public_key=%s\nremove=true\n", pubkey))
+	if ierr != nil {
+		return
+	}
+	ierr = ipconf.RemovePeerRoutes(d.tun, parsePrefixes(allowedIPs))
+	if ierr != nil {
+		return
+	}
+	d.locker.Lock()
+	link = d.links[pubkey]
+	delete(d.links, pubkey)
+	d.locker.Unlock()
+	if d.states != nil {
+		d.states.remove(pubkey)
+	}
+	if d.paths != nil {
+		d.paths.remove(pubkey)
+	}
+	d.notify()
+	return
+}
+
+// refreshEndpoint 重新解析 peer link, endpoint 变化时更新到 WireGuard
+func (d *Device) refreshEndpoint(pubkey string) (ierr error) {
+	d.locker.RLock()
+	link, ok := d.links[pubkey]
+	d.locker.RUnlock()
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	peer, ierr := d.doh.ParsePeer(ctx, link)
+	if ierr != nil {
+		return
+	}
+	if peer.PublicKey != pubkey || peer.Endpoint == "" {
+		return
+	}
+	peers, ierr := d.Peers()
+	if ierr != nil {
+		return
+	}
+	for _, p := range peers {
+		if p.PublicKey == pubkey && p.Endpoint == peer.Endpoint {
+			return
+		}
+	}
+	return d.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", pubkey, peer.Endpoint))
+}
+
+// Peers 返回当前所有 peer 的状态
+func (d *Device) Peers() (peers []PeerStatus, ierr error) {
+	s, ierr := d.IpcGet()
+	if ierr != nil {
+		return
+	}
+	peers = parseIpcGet(s)
+	d.locker.RLock()
+	defer d.locker.RUnlock()
+	for i := range peers {
+		peers[i].Link = d.links[peers[i].PublicKey]
+		peers[i].Name = PeerName(peers[i].Link)
+		if d.states != nil {
+			if p, ok := d.states.status(peers[i].PublicKey); ok {
+				peers[i].State = p.state.String()
+				peers[i].Failures = p.failures
+				if p.err != nil {
+					peers[i].LastError = p.err.Error()
+				}
+			}
+		}
+		if d.paths != nil {
+			if p := d.paths.get(peers[i].PublicKey); p != nil {
+				peers[i].Path = p.Path().String()
+			}
+		}
+	}
+	return
+}
+
+// connectedPeers 返回最近完成过握手的 peer, WireGuard 的会话密钥最多使用 3 分钟
+func (d *Device) connectedPeers() (pubkeys [][]byte) {
+	peers, err := d.Peers()
+	if err != nil {
+		return
+	}
+	for _, p := range peers {
+		if time.Since(p.LastHandshake) > device.RejectAfterTime {
+			continue
+		}
+		if pubkey, err := hex.DecodeString(p.PublicKey); err == nil {
+			pubkeys = append(pubkeys, pubkey)
+		}
+	}
+	return
+}
+
+// Links 返回 signaler 每个订阅链接的状态, 没有使用 signaler 时为空
+func (d *Device) Links() []signaler.LinkStatus {
+	if d.linkStatus == nil {
+		return nil
+	}
+	return d.linkStatus()
+}
+
+// IP 返回本机在 xhe 网络中的地址
+func (d *Device) IP() netip.Addr { return d.ip.Addr() }
+
+// OnChange 注册 peer 增删时的回调
+func (d *Device) OnChange(fn func()) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	d.watchers = append(d.watchers, fn)
+}
+
+func (d *Device) notify() {
+	d.locker.RLock()
+	watchers := d.watchers
+	d.locker.RUnlock()
+	for _, fn := range watchers {
+		fn()
+	}
+}
+
+// Close 清理 ipconf 添加的地址和路由后关闭 WireGuard
+func (d *Device) Close() {
+	if err := ipconf.Cleanup(d.tun); err != nil {
+		slog.Warn("ipconf cleanup failed", "err", err)
+	}
+	d.Device.Close()
+}
+
+func (d *Device) lookupPubkey(ctx context.Context, s string) (pubkey string, ierr error) {
+	if b, err := str2pubkey(s); err == nil {
+		return hex.EncodeToString(b), nil
+	}
+	d.locker.RLock()
+	for k, link := range d.links {
+		if link == s {
+			d.locker.RUnlock()
+			return k, nil
+		}
+	}
+	d.locker.RUnlock()
+	peer, ierr := d.doh.ParsePeer(ctx, s)
+	if ierr != nil {
+		return
+	}
+	return peer.PublicKey, nil
+}
+
+func (d *Device) setLink(pubkey string, link string) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	d.links[pubkey] = link
+}
+
+func parsePrefixes(ips []string) (pfs []netip.Prefix) {
+	for _, ip := range ips {
+		pf, err := netip.ParsePrefix(ip)
+		if err != nil {
+			continue
+		}
+		pfs = append(pfs, pf)
+	}
+	return
+}
+
+var ErrPeerNotFound = errors.New("peer not found")
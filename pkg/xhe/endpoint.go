@@ -0,0 +1,678 @@
+package xhe
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"github.com/shynome/wgortc/endpoint"
+	"github.com/shynome/wgortc/signaler"
+	"golang.org/x/exp/slog"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	xsignaler "remoon.net/xhe/pkg/signaler"
+)
+
+// outbound 和 inbound 基于 wgortc 的 endpoint.
+// 区别是 ICE 断开时不会直接关闭 PeerConnection, 而是由主动方通过信令做 ICE restart,
+// DTLS/SCTP 连接和 DataChannel 都保持不变, 失败了才重新建立连接
+
+const (
+	dcLabel = "wgortc"
+	// 主动方等待 ICE restart 完成的时间
+	restartTimeout = 15 * time.Second
+	// 被动方等待对方 ICE restart 的时间, 超时后关闭连接
+	inboundGrace = 30 * time.Second
+)
+
+// trickleChannel 是支持 trickle ICE 的信令, 见 xsignaler.Signaler
+type trickleChannel interface {
+	Trickle(endpoint string) *xsignaler.Trickle
+	HandshakeTrickle(endpoint string, offer signaler.SDP, t *xsignaler.Trickle) (answer *signaler.SDP, err error)
+}
+
+// trickleSession 是支持 trickle ICE 的会话, 见 xsignaler.Session
+type trickleSession interface {
+	Trickle() *xsignaler.Trickle
+}
+
+type baseEndpoint struct {
+	id string
+}
+
+// used for mac2 cookie calculations
+func (ep *baseEndpoint) DstToBytes() []byte { return []byte(ep.id) }
+func (*baseEndpoint) ClearSrc()             {}
+func (*baseEndpoint) SrcToString() string   { return "" }
+func (*baseEndpoint) DstIP() netip.Addr     { return netip.Addr{} }
+func (*baseEndpoint) SrcIP() netip.Addr     { return netip.Addr{} }
+
+func dcIsOpen(dc *webrtc.DataChannel) bool {
+	return dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen
+}
+
+type outbound struct {
+	baseEndpoint
+	bind *Bind
+	peer string
+	ch   chan []byte
+	done chan struct{}
+
+	locker *sync.Mutex
+	// owner 是收到的包报告给 WireGuard 时使用的 endpoint, 默认是自己, 有两条路径时是 pathEndpoint
+	owner       conn.Endpoint
+	closeOnce   *sync.Once
+	pc          *webrtc.PeerConnection
+	dc          *webrtc.DataChannel
+	attempt     uint64
+	restarting  bool
+	reconnected chan struct{}
+}
+
+var (
+	_ conn.Endpoint   = (*outbound)(nil)
+	_ endpoint.Sender = (*outbound)(nil)
+)
+
+func newOutbound(id string, bind *Bind) *outbound {
+	return &outbound{
+		baseEndpoint: baseEndpoint{id: id},
+		bind:         bind,
+		peer:         endpointPeer(id),
+		ch:           make(chan []byte),
+		done:         make(chan struct{}),
+		locker:       &sync.Mutex{},
+		closeOnce:    &sync.Once{},
+	}
+}
+
+func (ep *outbound) setOwner(owner conn.Endpoint) {
+	ep.locker.Lock()
+	defer ep.locker.Unlock()
+	ep.owner = owner
+}
+
+func (ep *outbound) getOwner() conn.Endpoint {
+	ep.locker.Lock()
+	defer ep.locker.Unlock()
+	if ep.owner == nil {
+		return ep
+	}
+	return ep.owner
+}
+
+func (ep *outbound) isClosed() bool {
+	select {
+	case <-ep.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver 把收到的包交给 pipeOutbound, 关闭之后丢弃
+func (ep *outbound) deliver(data []byte) {
+	select {
+	case ep.ch <- data:
+	case <-ep.done:
+	}
+}
+
+// Send 返回后 WireGuard 会复用 buf, 交给 goroutine 之前要复制一份
+func (ep *outbound) Send(buf []byte) (err error) {
+	if ep.isClosed() {
+		return net.ErrClosed
+	}
+	if ep.connecting(buf) {
+		go ep.Connect(clone(buf))
+		return
+	}
+	ep.locker.Lock()
+	dc := ep.dc
+	ep.locker.Unlock()
+	if !dcIsOpen(dc) {
+		return net.ErrClosed
+	}
+	go dc.Send(clone(buf))
+	return
+}
+
+// connecting 判断发送这个包是否会建立新的连接
+func (ep *outbound) connecting(buf []byte) bool {
+	if len(buf) == 0 || buf[0] != device.MessageInitiationType {
+		return false
+	}
+	ep.locker.Lock()
+	defer ep.locker.Unlock()
+	return !dcIsOpen(ep.dc)
+}
+
+func (ep *outbound) Connect(buf []byte) (ierr error) {
+	states := ep.bind.states
+	attempt := states.begin(ep.peer)
+
+	ep.locker.Lock()
+	old := ep.pc
+	ep.locker.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	var pc *webrtc.PeerConnection
+	var tr *xsignaler.Trickle
+	tc, _ := ep.bind.Channel.(trickleChannel)
+	if tc != nil {
+		tr = tc.Trickle(ep.id)
+	}
+	defer then(&ierr, nil, func() {
+		if pc != nil {
+			pc.Close()
+		}
+		if tr != nil {
+			tr.Close()
+		}
+		states.failed(ep.peer, attempt, ierr)
+	})
+	pc, ierr = ep.bind.newPeerConnection(directionOutbound, ep.peer, func(state webrtc.ICEConnectionState) {
+		ep.onICEState(pc, attempt, state)
+	})
+	if ierr != nil {
+		return
+	}
+
+	dcinit := webrtc.DataChannelInit{
+		Ordered:        refVal(false),
+		MaxRetransmits: refVal(uint16(0)),
+	}
+	dc, ierr := pc.CreateDataChannel(dcLabel, &dcinit)
+	if ierr != nil {
+		return
+	}
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		ep.deliver(msg.Data)
+	})
+
+	ep.locker.Lock()
+	ep.pc, ep.dc, ep.attempt = pc, dc, attempt
+	ep.locker.Unlock()
+
+	// 已知对方支持 trickle ICE 时, 不等 candidate 收集完成就发送 offer
+	partial := tr != nil && tr.Partial
+	if partial {
+		pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+			tr.Send(candidateInit(c))
+		})
+	}
+	offer, ierr := pc.CreateOffer(nil)
+	if ierr != nil {
+		return
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	ierr = pc.SetLocalDescription(offer)
+	if ierr != nil {
+		return
+	}
+	// offer 的 session information 中带上 WireGuard 的握手包
+	withInitiator := func() (offer signaler.SDP, ierr error) {
+		offer = *pc.LocalDescription()
+		initiator := sdp.Information(base64.StdEncoding.EncodeToString(buf))
+		desc, ierr := offer.Unmarshal()
+		if ierr != nil {
+			return
+		}
+		desc.SessionInformation = &initiator
+		rsdp, ierr := desc.Marshal()
+		if ierr != nil {
+			return
+		}
+		offer.SDP = string(rsdp)
+		return
+	}
+	if partial {
+		// 对方不再支持 trickle ICE 时等 candidate 收集完成再重试
+		tr.Full = func() (signaler.SDP, error) {
+			<-gatherComplete
+			return withInitiator()
+		}
+	} else {
+		<-gatherComplete
+	}
+	offer, ierr = withInitiator()
+	if ierr != nil {
+		return
+	}
+
+	var answer *signaler.SDP
+	if tr != nil {
+		answer, ierr = tc.HandshakeTrickle(ep.id, offer, tr)
+	} else {
+		answer, ierr = ep.bind.Handshake(ep.id, offer)
+	}
+	states.signaled(ep.peer, attempt, ierr)
+	if ierr != nil {
+		return
+	}
+	ierr = pc.SetRemoteDescription(*answer)
+	if ierr != nil {
+		return
+	}
+	if tr != nil {
+		go addCandidates(pc, tr)
+	}
+
+	desc2, ierr := answer.Unmarshal()
+	if ierr != nil {
+		return
+	}
+	if desc2.SessionInformation == nil {
+		return endpoint.ErrInitiatorResponderRequired
+	}
+	responder, ierr := base64.StdEncoding.DecodeString(string(*desc2.SessionInformation))
+	if ierr != nil {
+		return
+	}
+
+	ierr = endpoint.WaitDC(dc, 5*time.Second)
+	if ierr != nil {
+		return
+	}
+	ep.deliver(responder)
+	return
+}
+
+func (ep *outbound) onICEState(pc *webrtc.PeerConnection, attempt uint64, state webrtc.ICEConnectionState) {
+	switch state {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		ep.locker.Lock()
+		if ep.pc == pc && ep.reconnected != nil {
+			close(ep.reconnected)
+			ep.reconnected = nil
+		}
+		ep.locker.Unlock()
+	case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+		ep.startRestart(pc, attempt, "ice "+state.String())
+	}
+	// 先进入 restarting 状态, connManager 就不会把这次断开当成失败
+	ep.bind.states.ice(ep.peer, attempt, state)
+}
+
+// Restart 在网络变化时主动做 ICE restart
+func (ep *outbound) Restart(reason string) {
+	ep.locker.Lock()
+	pc, attempt := ep.pc, ep.attempt
+	ep.locker.Unlock()
+	if pc == nil || pc.ICEConnectionState() == webrtc.ICEConnectionStateNew {
+		return
+	}
+	ep.startRestart(pc, attempt, reason)
+}
+
+func (ep *outbound) startRestart(pc *webrtc.PeerConnection, attempt uint64, reason string) bool {
+	ep.locker.Lock()
+	defer ep.locker.Unlock()
+	// 还没建立起 DataChannel 的连接没有可以保留的东西
+	if ep.pc != pc || ep.restarting || !dcIsOpen(ep.dc) {
+		return false
+	}
+	ep.restarting = true
+	ep.reconnected = make(chan struct{})
+	ep.bind.states.restart(ep.peer, attempt)
+	go ep.restart(pc, attempt, reason, ep.reconnected)
+	return true
+}
+
+func (ep *outbound) restart(pc *webrtc.PeerConnection, attempt uint64, reason string, reconnected <-chan struct{}) (ierr error) {
+	logger := slog.With(
+		"act", "ice restart",
+		"peer", ep.peer,
+		"reason", reason,
+	)
+	logger.Debug("pending")
+	defer func() {
+		ep.locker.Lock()
+		ep.restarting = false
+		if ep.pc == pc {
+			ep.reconnected = nil
+		}
+		ep.locker.Unlock()
+	}()
+	defer then(&ierr, func() {
+		logger.Info("successful")
+		iceRestarts.Inc("success")
+	}, func() {
+		logger.Warn("failed, fallback to new connection", "err", ierr)
+		iceRestarts.Inc("failure")
+		pc.Close()
+		ep.bind.states.failed(ep.peer, attempt, ierr)
+	})
+
+	offer, ierr := pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if ierr != nil {
+		return
+	}
+	// CreateOffer 已经开始重新收集 candidate, 所以要在这之后等待
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	ierr = pc.SetLocalDescription(offer)
+	if ierr != nil {
+		return
+	}
+	<-gatherComplete
+	// 不带 initiator, 对方据此识别这是 ICE restart 而不是新连接
+	answer, ierr := ep.bind.Handshake(ep.id, *pc.LocalDescription())
+	if ierr != nil {
+		return
+	}
+	ierr = pc.SetRemoteDescription(*answer)
+	if ierr != nil {
+		return
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(restartTimeout):
+		return ErrRestartTimeout
+	}
+	return
+}
+
+// Close 关闭 PeerConnection 并停止 pipeOutbound, 之后的 Send 都返回 net.ErrClosed
+func (ep *outbound) Close() (err error) {
+	ep.closeOnce.Do(func() { close(ep.done) })
+	ep.locker.Lock()
+	pc := ep.pc
+	ep.locker.Unlock()
+	if pc != nil {
+		return pc.Close()
+	}
+	return
+}
+
+func (ep *outbound) Message() (ch <-chan []byte) {
+	return ep.ch
+}
+
+func (ep *outbound) DstToString() string {
+	ep.locker.Lock()
+	pc := ep.pc
+	ep.locker.Unlock()
+	return pcRemote(pc)
+}
+
+type inbound struct {
+	baseEndpoint
+	bind *Bind
+	sess signaler.Session
+	pc   *webrtc.PeerConnection
+	ch   chan []byte
+	done chan struct{}
+
+	// 用于识别 ICE restart 的 offer
+	origin      uint64
+	fingerprint string
+
+	locker    *sync.Mutex
+	dc        *webrtc.DataChannel
+	grace     *time.Timer
+	closeOnce *sync.Once
+}
+
+var (
+	_ conn.Endpoint   = (*inbound)(nil)
+	_ endpoint.Sender = (*inbound)(nil)
+)
+
+func newInbound(bind *Bind, sess signaler.Session, pc *webrtc.PeerConnection) *inbound {
+	offer := sess.Description()
+	in := &inbound{
+		baseEndpoint: baseEndpoint{id: offer.SDP},
+		bind:         bind,
+		sess:         sess,
+		pc:           pc,
+		ch:           make(chan []byte),
+		done:         make(chan struct{}),
+		locker:       &sync.Mutex{},
+		closeOnce:    &sync.Once{},
+	}
+	if desc, err := offer.Unmarshal(); err == nil {
+		in.origin = desc.Origin.SessionID
+		in.fingerprint = sdpFingerprint(desc)
+	}
+	return in
+}
+
+func (in *inbound) Send(buf []byte) (err error) {
+	in.locker.Lock()
+	dc := in.dc
+	in.locker.Unlock()
+	closed := !dcIsOpen(dc)
+	if buf[0] == device.MessageResponseType && closed {
+		go in.HandleConnect(clone(buf))
+		return
+	}
+	if closed {
+		return net.ErrClosed
+	}
+	go dc.Send(clone(buf))
+	return
+}
+
+func (in *inbound) ExtractInitiator() (initiator []byte, ierr error) {
+	return extractInitiator(in.sess.Description())
+}
+
+func (in *inbound) HandleConnect(buf []byte) (ierr error) {
+	defer then(&ierr, nil, func() {
+		in.sess.Reject(ierr)
+		in.close()
+	})
+
+	pc := in.pc
+	var tr *xsignaler.Trickle
+	if ts, ok := in.sess.(trickleSession); ok {
+		tr = ts.Trickle()
+	}
+	if tr != nil {
+		pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+			tr.Send(candidateInit(c))
+		})
+	}
+	ierr = pc.SetRemoteDescription(in.sess.Description())
+	if ierr != nil {
+		return
+	}
+	if tr != nil {
+		go addCandidates(pc, tr)
+	}
+	answer, ierr := pc.CreateAnswer(nil)
+	if ierr != nil {
+		return
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	ierr = pc.SetLocalDescription(answer)
+	if ierr != nil {
+		return
+	}
+	// trickle ICE 时 candidate 随后发送, 不用等待收集完成
+	if tr == nil {
+		<-gatherComplete
+	}
+	roffer := pc.LocalDescription()
+
+	responder := sdp.Information(base64.StdEncoding.EncodeToString(buf))
+	desc, ierr := roffer.Unmarshal()
+	if ierr != nil {
+		return
+	}
+	desc.SessionInformation = &responder
+	rsdp, ierr := desc.Marshal()
+	if ierr != nil {
+		return
+	}
+	roffer.SDP = string(rsdp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx, cause := context.WithCancelCause(ctx)
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() != dcLabel {
+			return
+		}
+		defer cause(nil)
+		in.locker.Lock()
+		in.dc = dc
+		in.locker.Unlock()
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			select {
+			case in.ch <- msg.Data:
+			case <-in.done:
+			}
+		})
+	})
+
+	ierr = in.sess.Resolve(roffer)
+	if ierr != nil {
+		return
+	}
+
+	<-ctx.Done()
+	if err := context.Cause(ctx); err != context.Canceled {
+		return err
+	}
+	return
+}
+
+// restart 回应对方的 ICE restart offer
+func (in *inbound) restart(sess signaler.Session) (ierr error) {
+	logger := slog.With("act", "answer ice restart")
+	logger.Debug("pending")
+	defer then(&ierr, func() {
+		logger.Debug("successful")
+	}, func() {
+		logger.Warn("failed", "err", ierr)
+		sess.Reject(ierr)
+	})
+
+	pc := in.pc
+	ierr = pc.SetRemoteDescription(sess.Description())
+	if ierr != nil {
+		return
+	}
+	answer, ierr := pc.CreateAnswer(nil)
+	if ierr != nil {
+		return
+	}
+	// SetRemoteDescription 已经开始重新收集 candidate
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	ierr = pc.SetLocalDescription(answer)
+	if ierr != nil {
+		return
+	}
+	<-gatherComplete
+	return sess.Resolve(pc.LocalDescription())
+}
+
+func (in *inbound) onICEState(state webrtc.ICEConnectionState) {
+	switch state {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		in.locker.Lock()
+		if in.grace != nil {
+			in.grace.Stop()
+			in.grace = nil
+		}
+		in.locker.Unlock()
+	case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+		in.locker.Lock()
+		if in.grace == nil {
+			in.grace = time.AfterFunc(inboundGrace, in.close)
+		}
+		in.locker.Unlock()
+	case webrtc.ICEConnectionStateClosed:
+		in.close()
+	}
+}
+
+func (in *inbound) close() {
+	in.closeOnce.Do(func() {
+		in.pc.Close()
+		close(in.done)
+		in.bind.forgetInbound(in)
+	})
+}
+
+func (in *inbound) Message() (ch <-chan []byte) {
+	return in.ch
+}
+
+func (in *inbound) DstToString() string {
+	return pcRemote(in.pc)
+}
+
+// restartOf 找到 offer 要做 ICE restart 的 inbound, 新连接返回 nil.
+// restart offer 不带 initiator, 并且和原来的 offer 有相同的 origin 和 DTLS fingerprint
+func restartOf(inbounds map[uint64]*inbound, offer signaler.SDP) *inbound {
+	desc, err := offer.Unmarshal()
+	if err != nil || desc.SessionInformation != nil {
+		return nil
+	}
+	in, ok := inbounds[desc.Origin.SessionID]
+	if !ok || in.fingerprint == "" || in.fingerprint != sdpFingerprint(desc) {
+		return nil
+	}
+	return in
+}
+
+func sdpFingerprint(desc *sdp.SessionDescription) string {
+	if v, ok := desc.Attribute("fingerprint"); ok {
+		return v
+	}
+	for _, m := range desc.MediaDescriptions {
+		if v, ok := m.Attribute("fingerprint"); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func pcRemote(pc *webrtc.PeerConnection) (addr string) {
+	addr = "[fdd9:f800::]:80"
+	if pc == nil {
+		return
+	}
+	pair := selectedCandidatePair(pc)
+	if pair == nil || pair.Remote == nil {
+		return
+	}
+	remote := pair.Remote
+	if ip := net.ParseIP(remote.Address); ip != nil && ip.To4() != nil {
+		return fmt.Sprintf("%s:%d", remote.Address, remote.Port)
+	}
+	return fmt.Sprintf("[%s]:%d", remote.Address, remote.Port)
+}
+
+func candidateInit(c *webrtc.ICECandidate) *webrtc.ICECandidateInit {
+	if c == nil {
+		return nil
+	}
+	init := c.ToJSON()
+	return &init
+}
+
+func addCandidates(pc *webrtc.PeerConnection, tr *xsignaler.Trickle) {
+	for c := range tr.Remote() {
+		if err := pc.AddICECandidate(c); err != nil {
+			slog.Debug("add remote candidate failed", "candidate", c.Candidate, "err", err)
+		}
+	}
+}
+
+func refVal[T any](v T) *T { return &v }
+
+func clone(buf []byte) []byte { return append([]byte(nil), buf...) }
+
+var ErrRestartTimeout = errors.New("ice restart timeout")
@@ -0,0 +1,110 @@
+package xhe
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	directionInbound  = "inbound"
+	directionOutbound = "outbound"
+)
+
+type iceConn struct {
+	direction string
+	peer      string
+	state     webrtc.ICEConnectionState
+	local     string
+	remote    string
+}
+
+// iceConns 记录所有 PeerConnection 的 ICE 状态
+type iceConns struct {
+	locker *sync.Mutex
+	conns  map[*webrtc.PeerConnection]*iceConn
+}
+
+func newICEConns() *iceConns {
+	return &iceConns{
+		locker: &sync.Mutex{},
+		conns:  make(map[*webrtc.PeerConnection]*iceConn),
+	}
+}
+
+func (c *iceConns) track(pc *webrtc.PeerConnection, direction string, peer string, notify func(webrtc.ICEConnectionState)) {
+	c.locker.Lock()
+	c.conns[pc] = &iceConn{
+		direction: direction,
+		peer:      peer,
+		state:     webrtc.ICEConnectionStateNew,
+	}
+	c.locker.Unlock()
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if notify != nil {
+			notify(state)
+		}
+		local, remote := selectedCandidateTypes(pc)
+		c.locker.Lock()
+		defer c.locker.Unlock()
+		if state == webrtc.ICEConnectionStateClosed {
+			delete(c.conns, pc)
+			return
+		}
+		conn, ok := c.conns[pc]
+		if !ok {
+			return
+		}
+		conn.state = state
+		conn.local, conn.remote = local, remote
+	})
+}
+
+func (c *iceConns) list() (conns []iceConn) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	for pc, conn := range c.conns {
+		// pc.Close 不一定会触发 ICE closed 事件
+		if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			delete(c.conns, pc)
+			continue
+		}
+		conns = append(conns, *conn)
+	}
+	return
+}
+
+func selectedCandidateTypes(pc *webrtc.PeerConnection) (local string, remote string) {
+	pair := selectedCandidatePair(pc)
+	if pair == nil {
+		return
+	}
+	if pair.Local != nil {
+		local = pair.Local.Typ.String()
+	}
+	if pair.Remote != nil {
+		remote = pair.Remote.Typ.String()
+	}
+	return
+}
+
+func selectedCandidatePair(pc *webrtc.PeerConnection) *webrtc.ICECandidatePair {
+	sctp := pc.SCTP()
+	if sctp == nil {
+		return nil
+	}
+	dtls := sctp.Transport()
+	if dtls == nil {
+		return nil
+	}
+	ice := dtls.ICETransport()
+	if ice == nil {
+		return nil
+	}
+	pair, err := ice.GetSelectedCandidatePair()
+	if err != nil {
+		return nil
+	}
+	return pair
+}
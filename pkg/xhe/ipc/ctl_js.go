@@ -0,0 +1,18 @@
+package ipc
+
+import (
+	"errors"
+	"net"
+)
+
+func CtlPath(name string) string {
+	return ""
+}
+
+func CtlListen(path string) (net.Listener, error) {
+	return nil, nil
+}
+
+func CtlDial(path string) (net.Conn, error) {
+	return nil, errors.ErrUnsupported
+}
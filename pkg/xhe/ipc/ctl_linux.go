@@ -0,0 +1,52 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const ctlDirectory = "/var/run/xhe"
+
+// CtlPath 返回控制 socket 的默认路径, 非 root 用户放到临时目录下
+func CtlPath(name string) string {
+	if os.Geteuid() == 0 {
+		return filepath.Join(ctlDirectory, name+".sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("xhe-%s.sock", name))
+}
+
+func CtlListen(path string) (l net.Listener, ierr error) {
+	ierr = os.MkdirAll(filepath.Dir(path), 0o755)
+	if ierr != nil {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// socket 创建时就只有自己能访问, 避免 Chmod 之前被其他用户连接.
+	// umask 是进程级的, 077 只去掉 group/other 的权限, 不影响其他 goroutine 创建的文件对自己可用
+	mask := syscall.Umask(0o077)
+	l, ierr = net.Listen("unix", path)
+	syscall.Umask(mask)
+	if ierr != nil {
+		return
+	}
+	ierr = os.Chmod(path, 0o600)
+	if ierr != nil {
+		l.Close()
+		return nil, ierr
+	}
+	return
+}
+
+func CtlDial(path string) (net.Conn, error) {
+	return net.Dial("unix", path)
+}
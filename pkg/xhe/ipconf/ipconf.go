@@ -40,3 +40,88 @@ func Up(dev tun.Device) (err error) {
 	}
 	return up(dev)
 }
+
+// AddPeerRoutes 为 peer 的 AllowedIPs 添加路由
+func AddPeerRoutes(dev tun.Device, ips []netip.Prefix) (err error) {
+	logger := slog.With(
+		slog.String("act", "add peer routes"),
+		slog.Int("count", len(ips)),
+	)
+	logger.Debug("pending")
+	defer then(&err, func() {
+		logger.Debug("successful")
+	}, nil)
+
+	if _, ok := dev.(vtun.GetStack); ok {
+		logger.Debug("vtun mode")
+		return nil
+	}
+	for _, ip := range ips {
+		if err = addPeerRoute(dev, ip); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func RemovePeerRoutes(dev tun.Device, ips []netip.Prefix) (err error) {
+	logger := slog.With(
+		slog.String("act", "remove peer routes"),
+		slog.Int("count", len(ips)),
+	)
+	logger.Debug("pending")
+	defer then(&err, func() {
+		logger.Debug("successful")
+	}, nil)
+
+	if _, ok := dev.(vtun.GetStack); ok {
+		logger.Debug("vtun mode")
+		return nil
+	}
+	for _, ip := range ips {
+		if err = removePeerRoute(dev, ip); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Cleanup 按日志撤销 ipconf 在网卡上添加的地址和路由
+func Cleanup(dev tun.Device) (err error) {
+	logger := slog.With(
+		slog.String("act", "ipconf cleanup"),
+	)
+	logger.Debug("pending")
+	defer then(&err, func() {
+		logger.Debug("successful")
+	}, nil)
+
+	if _, ok := dev.(vtun.GetStack); ok {
+		logger.Debug("vtun mode")
+		return nil
+	}
+	name, err := dev.Name()
+	if err != nil {
+		return
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	j, ok := journals[name]
+	if !ok {
+		return nil
+	}
+	delete(journals, name)
+	return j.undo()
+}
+
+// Recover 撤销上次运行(比如崩溃)时留下的修改, 需要在修改网卡前调用
+func Recover(dev tun.Device) (err error) {
+	if _, ok := dev.(vtun.GetStack); ok {
+		return nil
+	}
+	name, err := dev.Name()
+	if err != nil {
+		return
+	}
+	return recoverJournal(name)
+}
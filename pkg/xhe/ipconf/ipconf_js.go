@@ -13,3 +13,19 @@ func addRoute(dev tun.Device, ip netip.Prefix) error {
 func up(dev tun.Device) error {
 	return nil
 }
+
+func addPeerRoute(dev tun.Device, ip netip.Prefix) error {
+	return nil
+}
+
+func removePeerRoute(dev tun.Device, ip netip.Prefix) error {
+	return nil
+}
+
+func journalPath(name string) string {
+	return ""
+}
+
+func undoEntry(name string, e entry) error {
+	return nil
+}
@@ -1,29 +1,180 @@
 package ipconf
 
 import (
+	"errors"
+	"net"
 	"net/netip"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"syscall"
 
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
-func addRoute(dev tun.Device, ip netip.Prefix) error {
-	name, err := dev.Name()
-	if err != nil {
-		return err
+const journalDirectory = "/var/run/xhe"
+
+// journalPath 返回 journal 文件的路径. 非 root 用户(比如只有 CAP_NET_ADMIN)放到
+// $XDG_RUNTIME_DIR/xhe, 没有时放到用户缓存目录下, 都没有时不记录
+func journalPath(name string) string {
+	dir := journalDirectory
+	if os.Geteuid() != 0 {
+		dir = userJournalDirectory()
+		if dir == "" {
+			return ""
+		}
+	}
+	return filepath.Join(dir, name+".journal")
+}
+
+func userJournalDirectory() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "xhe")
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "xhe")
+	}
+	return ""
+}
+
+func linkOf(dev tun.Device) (name string, link netlink.Link, ierr error) {
+	name, ierr = dev.Name()
+	if ierr != nil {
+		return
+	}
+	link, ierr = netlink.LinkByName(name)
+	if ierr != nil {
+		return
+	}
+	return
+}
+
+func addRoute(dev tun.Device, ip netip.Prefix) (ierr error) {
+	name, link, ierr := linkOf(dev)
+	if ierr != nil {
+		return
+	}
+	addr := &netlink.Addr{IPNet: toIPNet(ip)}
+	if ip.Addr().Is6() {
+		// 跳过 DAD, 地址添加后马上就能监听
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	ierr = netlink.AddrAdd(link, addr)
+	if errors.Is(ierr, syscall.EEXIST) {
+		return nil
+	}
+	if ierr != nil {
+		return
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	return journalOf(name).record(entry{Op: opAddr, Prefix: ip})
+}
+
+func up(dev tun.Device) (ierr error) {
+	_, link, ierr := linkOf(dev)
+	if ierr != nil {
+		return
+	}
+	mtu, ierr := dev.MTU()
+	if ierr != nil {
+		return
+	}
+	if link.Attrs().MTU != mtu {
+		ierr = netlink.LinkSetMTU(link, mtu)
+		if ierr != nil {
+			return
+		}
+	}
+	ierr = netlink.LinkSetUp(link)
+	if ierr != nil {
+		return
+	}
+	return
+}
+
+func addPeerRoute(dev tun.Device, ip netip.Prefix) (ierr error) {
+	name, link, ierr := linkOf(dev)
+	if ierr != nil {
+		return
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	j := journalOf(name)
+	for _, e := range j.entries {
+		// 地址所在的网段内核已经添加了路由
+		if e.Op == opAddr && e.Prefix.Masked().Contains(ip.Addr()) && e.Prefix.Bits() <= ip.Bits() {
+			return nil
+		}
+	}
+	ierr = netlink.RouteAdd(toRoute(link, ip))
+	if errors.Is(ierr, syscall.EEXIST) {
+		return nil
+	}
+	if ierr != nil {
+		return
+	}
+	return j.record(entry{Op: opRoute, Prefix: ip})
+}
+
+func removePeerRoute(dev tun.Device, ip netip.Prefix) (ierr error) {
+	name, link, ierr := linkOf(dev)
+	if ierr != nil {
+		return
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	j := journalOf(name)
+	e := entry{Op: opRoute, Prefix: ip}
+	if !j.contains(e) {
+		return nil
+	}
+	ierr = ignoreGone(netlink.RouteDel(toRoute(link, ip)))
+	if ierr != nil {
+		return
+	}
+	return j.forget(e)
+}
+
+func undoEntry(name string, e entry) (ierr error) {
+	link, ierr := netlink.LinkByName(name)
+	if ierr != nil {
+		// 网卡已经不在了, 上面的地址和路由也随之删除
+		return ignoreGone(ierr)
+	}
+	switch e.Op {
+	case opAddr:
+		return ignoreGone(netlink.AddrDel(link, &netlink.Addr{IPNet: toIPNet(e.Prefix)}))
+	case opRoute:
+		return ignoreGone(netlink.RouteDel(toRoute(link, e.Prefix)))
+	}
+	return nil
+}
+
+func toIPNet(ip netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   ip.Addr().AsSlice(),
+		Mask: net.CIDRMask(ip.Bits(), ip.Addr().BitLen()),
+	}
+}
+
+func toRoute(link netlink.Link, ip netip.Prefix) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       toIPNet(ip.Masked()),
+		Scope:     netlink.SCOPE_LINK,
 	}
-	cmd := exec.Command("ip", "addr", "add", ip.String(), "dev", name)
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
 }
 
-func up(dev tun.Device) error {
-	name, err := dev.Name()
-	if err != nil {
-		return err
+func ignoreGone(err error) error {
+	var notFound netlink.LinkNotFoundError
+	switch {
+	case errors.As(err, &notFound),
+		errors.Is(err, syscall.ESRCH),
+		errors.Is(err, syscall.ENODEV),
+		errors.Is(err, syscall.EADDRNOTAVAIL):
+		return nil
 	}
-	cmd := exec.Command("ip", "link", "set", name, "up")
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return err
 }
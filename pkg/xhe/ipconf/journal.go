@@ -0,0 +1,195 @@
+package ipconf
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	opAddr  = "addr"
+	opRoute = "route"
+)
+
+type entry struct {
+	Op     string       `json:"op"`
+	Prefix netip.Prefix `json:"prefix"`
+}
+
+// journal 记录 ipconf 对网卡做的每一项修改, 并同步写入文件,
+// 这样即使程序崩溃, 下次启动时也能撤销上次留下的修改
+type journal struct {
+	name    string
+	path    string
+	entries []entry
+}
+
+var (
+	locker   = &sync.Mutex{}
+	journals = map[string]*journal{}
+)
+
+// journalOf 调用时需持有 locker
+func journalOf(name string) *journal {
+	j, ok := journals[name]
+	if !ok {
+		j = &journal{name: name, path: journalPath(name)}
+		journals[name] = j
+	}
+	return j
+}
+
+func (j *journal) contains(e entry) bool {
+	for _, e2 := range j.entries {
+		if e2 == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *journal) record(e entry) (ierr error) {
+	j.entries = append(j.entries, e)
+	if j.path == "" {
+		return
+	}
+	ierr = os.MkdirAll(filepath.Dir(j.path), 0o755)
+	if ierr != nil {
+		return
+	}
+	f, ierr := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if ierr != nil {
+		return
+	}
+	defer f.Close()
+	b, ierr := json.Marshal(e)
+	if ierr != nil {
+		return
+	}
+	_, ierr = f.Write(append(b, '\n'))
+	if ierr != nil {
+		return
+	}
+	return f.Sync()
+}
+
+// forget 移除一项记录, 用于单独撤销某项修改后
+func (j *journal) forget(e entry) (ierr error) {
+	for i, e2 := range j.entries {
+		if e2 == e {
+			j.entries = append(j.entries[:i], j.entries[i+1:]...)
+			return j.rewrite()
+		}
+	}
+	return nil
+}
+
+func (j *journal) rewrite() (ierr error) {
+	if j.path == "" {
+		return
+	}
+	if len(j.entries) == 0 {
+		return removeFile(j.path)
+	}
+	tmp := j.path + ".tmp"
+	f, ierr := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if ierr != nil {
+		return
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range j.entries {
+		if ierr = enc.Encode(e); ierr != nil {
+			f.Close()
+			return
+		}
+	}
+	if ierr = f.Sync(); ierr != nil {
+		f.Close()
+		return
+	}
+	if ierr = f.Close(); ierr != nil {
+		return
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// undo 按相反的顺序撤销所有修改
+func (j *journal) undo() error {
+	var errs []error
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		e := j.entries[i]
+		if err := undoEntry(j.name, e); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Debug("ipconf undo", "op", e.Op, "prefix", e.Prefix.String())
+	}
+	j.entries = nil
+	if j.path != "" {
+		errs = append(errs, removeFile(j.path))
+	}
+	return errors.Join(errs...)
+}
+
+func loadJournal(name string) (j *journal, ierr error) {
+	j = &journal{name: name, path: journalPath(name)}
+	ierr = j.load()
+	return
+}
+
+func (j *journal) load() (ierr error) {
+	if j.path == "" {
+		return
+	}
+	f, ierr := os.Open(j.path)
+	if errors.Is(ierr, os.ErrNotExist) {
+		return nil
+	}
+	if ierr != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e entry
+		// 崩溃时最后一行可能没写完整, 跳过
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		j.entries = append(j.entries, e)
+	}
+	ierr = scanner.Err()
+	if ierr != nil {
+		return
+	}
+	return
+}
+
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// recoverJournal 撤销上次运行留下的修改
+func recoverJournal(name string) (ierr error) {
+	locker.Lock()
+	defer locker.Unlock()
+	delete(journals, name)
+	j, ierr := loadJournal(name)
+	if ierr != nil {
+		return
+	}
+	if len(j.entries) == 0 {
+		return
+	}
+	slog.Warn("found changes left by previous run, undo them", "tun", name, "count", len(j.entries))
+	return j.undo()
+}
@@ -0,0 +1,40 @@
+package ipconf
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestJournal(t *testing.T) {
+	name := "xhe-test-not-exists"
+	path := filepath.Join(t.TempDir(), name+".journal")
+	j := &journal{name: name, path: path}
+
+	addr := entry{Op: opAddr, Prefix: netip.MustParsePrefix("fdd9:f800:b4e8:cb59:95e3:c464:9fff:b8c8/24")}
+	route := entry{Op: opRoute, Prefix: netip.MustParsePrefix("10.0.0.0/24")}
+	route2 := entry{Op: opRoute, Prefix: netip.MustParsePrefix("10.0.1.0/24")}
+	try.To(j.record(addr))
+	try.To(j.record(route))
+	try.To(j.record(route2))
+	try.To(j.forget(route))
+
+	f := try.To1(os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600))
+	try.To1(f.WriteString(`{"op":"rou`)) // 模拟崩溃时没写完整
+	try.To(f.Close())
+
+	loaded := &journal{name: name, path: path}
+	try.To(loaded.load())
+	assert.SLen(loaded.entries, 2)
+	assert.Equal(loaded.entries[0], addr)
+	assert.Equal(loaded.entries[1], route2)
+
+	try.To(loaded.forget(addr))
+	try.To(loaded.forget(route2))
+	_, err := os.Stat(path)
+	assert.That(os.IsNotExist(err))
+}
@@ -0,0 +1,148 @@
+package xhe
+
+import (
+	"log/slog"
+
+	"remoon.net/xhe/pkg/metrics"
+)
+
+var (
+	bindSendFailures = metrics.NewCounterVec(
+		"xhe_bind_send_failures_total",
+		"Bind send failures by peer",
+		"peer",
+	)
+	iceRestarts = metrics.NewCounterVec(
+		"xhe_ice_restarts_total",
+		"ICE restarts of outbound connections by result",
+		"result",
+	)
+	offersDropped = metrics.NewCounterVec(
+		"xhe_offers_dropped_total",
+		"Inbound offers dropped before creating a PeerConnection by reason",
+		"reason",
+	)
+	udpPackets = metrics.NewCounterVec(
+		"xhe_bind_udp_packets_total",
+		"WireGuard packets sent and received directly over UDP by direction",
+		"direction",
+	)
+	pathSwitches = metrics.NewCounterVec(
+		"xhe_peer_path_switches_total",
+		"Switches between direct UDP and WebRTC paths by the new path",
+		"path",
+	)
+	dohErrors = metrics.NewCounterVec(
+		"xhe_doh_errors_total",
+		"DoH resolution errors",
+	)
+)
+
+func registerMetrics(dev *Device, bind *Bind) {
+	peers := func(emit func(p PeerStatus)) {
+		list, err := dev.Peers()
+		if err != nil {
+			slog.Warn("collect peers metrics failed", "err", err)
+			return
+		}
+		for _, p := range list {
+			emit(p)
+		}
+	}
+	metrics.NewCounterFunc(
+		"xhe_peer_rx_bytes_total",
+		"Bytes received from peer",
+		[]string{"peer"},
+		func(emit func(v float64, values ...string)) {
+			peers(func(p PeerStatus) { emit(float64(p.RxBytes), p.PublicKey) })
+		},
+	)
+	metrics.NewCounterFunc(
+		"xhe_peer_tx_bytes_total",
+		"Bytes sent to peer",
+		[]string{"peer"},
+		func(emit func(v float64, values ...string)) {
+			peers(func(p PeerStatus) { emit(float64(p.TxBytes), p.PublicKey) })
+		},
+	)
+	metrics.NewGaugeFunc(
+		"xhe_peer_last_handshake_seconds",
+		"Unix time of the last handshake with peer, 0 means never",
+		[]string{"peer"},
+		func(emit func(v float64, values ...string)) {
+			peers(func(p PeerStatus) {
+				var t float64
+				if !p.LastHandshake.IsZero() {
+					t = float64(p.LastHandshake.UnixNano()) / 1e9
+				}
+				emit(t, p.PublicKey)
+			})
+		},
+	)
+	metrics.NewGaugeFunc(
+		"xhe_peer_connection_state",
+		"Connection state of outbound peers, 1 for the current state",
+		[]string{"peer", "state"},
+		func(emit func(v float64, values ...string)) {
+			for peer, p := range bind.states.list() {
+				emit(1, peer, p.state.String())
+			}
+		},
+	)
+	metrics.NewGaugeFunc(
+		"xhe_peer_connection_failures",
+		"Consecutive failed connection attempts of outbound peers, reset when connected",
+		[]string{"peer"},
+		func(emit func(v float64, values ...string)) {
+			for peer, p := range bind.states.list() {
+				emit(float64(p.failures), peer)
+			}
+		},
+	)
+	metrics.NewGaugeFunc(
+		"xhe_peer_path",
+		"Path used by peers reachable over both direct UDP and WebRTC, 1 for the current path",
+		[]string{"peer", "path"},
+		func(emit func(v float64, values ...string)) {
+			for peer, p := range bind.paths.list() {
+				emit(1, peer, p.Path().String())
+			}
+		},
+	)
+	metrics.NewGaugeFunc(
+		"xhe_peer_path_rtt_seconds",
+		"Average probe RTT of each path, only paths with answered probes",
+		[]string{"peer", "path"},
+		func(emit func(v float64, values ...string)) {
+			for peer, p := range bind.paths.list() {
+				for _, q := range p.quality() {
+					if q.ok {
+						emit(q.rtt.Seconds(), peer, q.path.String())
+					}
+				}
+			}
+		},
+	)
+	metrics.NewGaugeFunc(
+		"xhe_peer_path_loss_ratio",
+		"Probe loss of each path in the recent window",
+		[]string{"peer", "path"},
+		func(emit func(v float64, values ...string)) {
+			for peer, p := range bind.paths.list() {
+				for _, q := range p.quality() {
+					emit(q.loss, peer, q.path.String())
+				}
+			}
+		},
+	)
+	metrics.NewGaugeFunc(
+		"xhe_ice_connection_info",
+		"ICE state and selected candidate types of each PeerConnection",
+		[]string{"direction", "peer", "state", "local_candidate", "remote_candidate"},
+		func(emit func(v float64, values ...string)) {
+			for _, c := range bind.conns.list() {
+				emit(1, c.direction, c.peer, c.state.String(), c.local, c.remote)
+			}
+		},
+	)
+}
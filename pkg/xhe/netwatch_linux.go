@@ -0,0 +1,72 @@
+package xhe
+
+import (
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// 网络变化往往是一连串事件, 合并后再通知
+const netwatchDebounce = 2 * time.Second
+
+// watchNetwork 通过 netlink 监听本机地址和网卡变化
+func watchNetwork(ignore string, fn func()) (unwatch func(), ierr error) {
+	done := make(chan struct{})
+	addrs := make(chan netlink.AddrUpdate)
+	links := make(chan netlink.LinkUpdate)
+	ierr = netlink.AddrSubscribe(addrs, done)
+	if ierr != nil {
+		return
+	}
+	ierr = netlink.LinkSubscribe(links, done)
+	if ierr != nil {
+		close(done)
+		return
+	}
+	ignoreIndex := 0
+	if link, err := netlink.LinkByName(ignore); err == nil {
+		ignoreIndex = link.Attrs().Index
+	}
+	go func() {
+		var timer *time.Timer
+		trigger := func() {
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(netwatchDebounce, fn)
+		}
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+		for {
+			select {
+			case <-done:
+				return
+			case u, ok := <-addrs:
+				if !ok {
+					return
+				}
+				if u.LinkIndex == ignoreIndex || u.LinkAddress.IP.IsLinkLocalUnicast() {
+					continue
+				}
+				trigger()
+			case u, ok := <-links:
+				if !ok {
+					return
+				}
+				if int(u.Index) == ignoreIndex {
+					continue
+				}
+				// 只关心网卡 up/down, 忽略统计信息之类的更新
+				if u.Header.Type == unix.RTM_NEWLINK && u.Change&unix.IFF_UP == 0 {
+					continue
+				}
+				trigger()
+			}
+		}
+	}()
+	return func() { close(done) }, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package xhe
+
+// watchNetwork 其他平台暂不支持, 只依赖 ICE 状态触发 restart
+func watchNetwork(ignore string, fn func()) (unwatch func(), ierr error) {
+	return func() {}, nil
+}
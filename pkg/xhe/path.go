@@ -0,0 +1,558 @@
+package xhe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// peer link 加上 udp={host}:{port} 参数后, 这个 peer 同时有 WebRTC 和直接 UDP 两条路径:
+//   - 两条路径每 probeInterval 发送一次探测, 对方原样回复, 记录最近 probeWindow 次的 RTT 和丢包
+//   - 另一条路径明显更好(分数低于当前的 pathSwitchRatio)时才切换, 避免来回切换
+//   - 当前路径连续丢失 pathDownProbes 次探测或者发送失败时立即切换到另一条路径
+//   - WebRTC 只在 DataChannel 打开时探测, 探测不会发起连接; 切换到没有连接的 WebRTC 时让 WireGuard 重新握手
+// 收到的包都报告为同一个 pathEndpoint, WireGuard 的 roaming 不会把它换成其中一条路径.
+// 探测包以 'x'(0x78) 开头, 在 RFC 7983 中没有分配, 不会和 WireGuard/STUN/DTLS 混淆
+
+const (
+	probeInterval   = 2 * time.Second
+	probeWindow     = 10
+	pathDownProbes  = 3
+	pathSwitchRatio = 0.8
+
+	probeMagic = "xhep"
+	probeLen   = len(probeMagic) + 2 + 8 + 8
+
+	probePing byte = 1
+	probePong byte = 2
+)
+
+type pathKind uint8
+
+const (
+	pathWebRTC pathKind = iota
+	pathUDP
+)
+
+func (k pathKind) String() string {
+	if k == pathUDP {
+		return "udp"
+	}
+	return "webrtc"
+}
+
+func (k pathKind) other() pathKind { return 1 - k }
+
+type probe struct {
+	kind byte
+	path pathKind
+	id   uint64
+	seq  uint64
+}
+
+func isProbe(b []byte) bool {
+	return len(b) == probeLen && string(b[:len(probeMagic)]) == probeMagic
+}
+
+func (p probe) marshal() []byte {
+	b := make([]byte, probeLen)
+	n := copy(b, probeMagic)
+	b[n], b[n+1] = p.kind, byte(p.path)
+	binary.BigEndian.PutUint64(b[n+2:], p.id)
+	binary.BigEndian.PutUint64(b[n+10:], p.seq)
+	return b
+}
+
+func parseProbe(b []byte) (p probe, ok bool) {
+	if !isProbe(b) {
+		return
+	}
+	n := len(probeMagic)
+	p.kind, p.path = b[n], pathKind(b[n+1])
+	p.id = binary.BigEndian.Uint64(b[n+2:])
+	p.seq = binary.BigEndian.Uint64(b[n+10:])
+	return p, p.path <= pathUDP
+}
+
+// pathStats 是一条路径最近的探测结果, 丢失的记为 -1
+type pathStats struct {
+	results []time.Duration
+	seq     uint64 // 等待回复的探测, 0 表示没有
+	sent    time.Time
+}
+
+func (s *pathStats) record(d time.Duration) {
+	s.results = append(s.results, d)
+	if len(s.results) > probeWindow {
+		s.results = s.results[len(s.results)-probeWindow:]
+	}
+}
+
+// expire 把上一轮没有回复的探测记为丢失
+func (s *pathStats) expire() {
+	if s.seq != 0 {
+		s.record(-1)
+		s.seq = 0
+	}
+}
+
+func (s *pathStats) reset() { *s = pathStats{} }
+
+// down 最近 pathDownProbes 次探测都丢失
+func (s *pathStats) down() bool {
+	if len(s.results) < pathDownProbes {
+		return false
+	}
+	for _, d := range s.results[len(s.results)-pathDownProbes:] {
+		if d >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// quality 返回平均 RTT 和丢包率, ok 为 false 表示还没有成功的探测
+func (s *pathStats) quality() (rtt time.Duration, loss float64, ok bool) {
+	var lost int
+	for _, d := range s.results {
+		if d < 0 {
+			lost++
+			continue
+		}
+		rtt += d
+	}
+	received := len(s.results) - lost
+	if received == 0 {
+		return 0, 0, false
+	}
+	return rtt / time.Duration(received), float64(lost) / float64(len(s.results)), true
+}
+
+func (s *pathStats) good() bool {
+	_, _, ok := s.quality()
+	return ok && !s.down()
+}
+
+// score 越小越好, 丢包按 RTT 的倍数惩罚
+func (s *pathStats) score() float64 {
+	rtt, loss, _ := s.quality()
+	return float64(rtt) * (1 + 4*loss)
+}
+
+// pathEndpoint 是同时有 WebRTC 和 UDP 两条路径的 endpoint
+type pathEndpoint struct {
+	bind *Bind
+	out  *outbound
+	udp  *udpEndpoint
+	peer string
+	id   uint64
+
+	locker  *sync.Mutex
+	current pathKind
+	in      *inbound // 对方通过 WebRTC 发起的连接
+	stats   [2]pathStats
+	seq     uint64
+	done    chan struct{}
+}
+
+var _ conn.Endpoint = (*pathEndpoint)(nil)
+
+func (p *pathEndpoint) ClearSrc()           {}
+func (p *pathEndpoint) SrcToString() string { return "" }
+func (p *pathEndpoint) DstIP() netip.Addr   { return netip.Addr{} }
+func (p *pathEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+func (p *pathEndpoint) DstToBytes() []byte  { return p.out.DstToBytes() }
+func (p *pathEndpoint) DstToString() string {
+	p.locker.Lock()
+	current, in := p.current, p.in
+	p.locker.Unlock()
+	switch {
+	case current == pathUDP:
+		return p.udp.DstToString()
+	case in != nil && in.open():
+		return in.DstToString()
+	}
+	return p.out.DstToString()
+}
+
+// splitPathEndpoint 取出 endpoint 中的 udp 参数, 剩下的是 WebRTC 的 endpoint
+func splitPathEndpoint(s string) (id string, udp string, ok bool) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return
+	}
+	q := u.Query()
+	udp = q.Get("udp")
+	if udp == "" || !isUDPEndpoint(udp) {
+		return
+	}
+	q.Del("udp")
+	u.RawQuery = q.Encode()
+	return u.String(), udp, true
+}
+
+func (b *Bind) newPath(id string, udp string) (p *pathEndpoint, ierr error) {
+	uep, ierr := parseUDPEndpoint(udp)
+	if ierr != nil {
+		return
+	}
+	var idb [8]byte
+	if _, ierr = rand.Read(idb[:]); ierr != nil {
+		return
+	}
+	out := b.addOutbound(id)
+	p = &pathEndpoint{
+		bind: b,
+		out:  out,
+		udp:  uep,
+		peer: out.peer,
+		id:   binary.BigEndian.Uint64(idb[:]),
+
+		locker: &sync.Mutex{},
+		done:   make(chan struct{}),
+	}
+	out.setOwner(p)
+	b.paths.put(p)
+	go p.probe()
+	return
+}
+
+func (p *pathEndpoint) stop() {
+	close(p.done)
+}
+
+// Path 返回当前使用的路径
+func (p *pathEndpoint) Path() pathKind {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	return p.current
+}
+
+func (p *pathEndpoint) setInbound(in *inbound) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.in = in
+}
+
+func (p *pathEndpoint) forgetInbound(in *inbound) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	if p.in == in {
+		p.in = nil
+	}
+}
+
+// rtc 返回 WebRTC 路径上用于发送的 endpoint, 优先使用对方发起的连接
+func (p *pathEndpoint) rtc(buf []byte) conn.Endpoint {
+	p.locker.Lock()
+	in := p.in
+	p.locker.Unlock()
+	if in == nil || in.isDone() {
+		return p.out
+	}
+	if in.open() || (len(buf) > 0 && buf[0] == device.MessageResponseType) {
+		// 握手的回复要通过 answer 发给发起方
+		return in
+	}
+	return p.out
+}
+
+func (p *pathEndpoint) rtcOpen() bool {
+	ep := p.rtc(nil)
+	if in, ok := ep.(*inbound); ok {
+		return in.open()
+	}
+	return p.out.open()
+}
+
+func (p *pathEndpoint) send(bufs [][]byte) (err error) {
+	b := p.bind
+	var head []byte
+	if len(bufs) > 0 {
+		head = bufs[0]
+	}
+	rtc := p.rtc(head)
+	current := p.Path()
+	if in, ok := rtc.(*inbound); ok && !in.open() {
+		// 对方通过 WebRTC 发起的握手, 回复要通过 answer 发送
+		current = pathWebRTC
+	}
+	if current == pathWebRTC {
+		err = b.sendWebRTC(bufs, rtc)
+		if err != nil && p.failover(pathWebRTC, err) {
+			return b.send(bufs, p.udp)
+		}
+		return
+	}
+	err = b.send(bufs, p.udp)
+	if err != nil && p.failover(pathUDP, err) {
+		// WebRTC 还没有连接时由 WireGuard 的重传或者重新握手发送
+		return b.sendWebRTC(bufs, rtc)
+	}
+	return
+}
+
+// failover 在 from 发送失败后尝试切换到另一条路径, 返回是否切换
+func (p *pathEndpoint) failover(from pathKind, err error) bool {
+	to := from.other()
+	p.locker.Lock()
+	if p.current != from {
+		p.locker.Unlock()
+		return true
+	}
+	usable := p.stats[to].good()
+	p.locker.Unlock()
+	if to == pathWebRTC {
+		usable = usable && p.rtcOpen()
+	}
+	if !usable {
+		return false
+	}
+	p.switchTo(to, "send failed: "+err.Error())
+	return true
+}
+
+func (p *pathEndpoint) switchTo(to pathKind, reason string) {
+	p.locker.Lock()
+	if p.current == to {
+		p.locker.Unlock()
+		return
+	}
+	p.current = to
+	p.locker.Unlock()
+	pathSwitches.Inc(to.String())
+	slog.Info("switch path", "act", "select path", "peer", p.peer, "path", to.String(), "reason", reason)
+	if to == pathWebRTC && !p.rtcOpen() {
+		// 让 WireGuard 重新握手, 握手会建立 WebRTC 连接
+		if retry := p.bind.states.retry; retry != nil {
+			go retry(p.peer)
+		}
+	}
+}
+
+// probe 定时探测两条路径并选择
+func (p *pathEndpoint) probe() {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		if p.bind.isClosed() {
+			return
+		}
+		if p.bind.standby.Load() {
+			continue
+		}
+		p.tick()
+	}
+}
+
+func (p *pathEndpoint) tick() {
+	b := p.bind
+	rtcOpen := p.rtcOpen()
+	p.locker.Lock()
+	for i := range p.stats {
+		p.stats[i].expire()
+	}
+	if !rtcOpen {
+		p.stats[pathWebRTC].reset()
+	}
+	p.locker.Unlock()
+
+	if b.udp != nil {
+		ping := p.ping(pathUDP)
+		if err := b.udp.send([][]byte{ping}, p.udp); err != nil {
+			slog.Debug("send udp probe failed", "act", "select path", "peer", p.peer, "err", err)
+		}
+	}
+	if rtcOpen {
+		if sender, ok := p.rtc(nil).(interface{ Send([]byte) error }); ok {
+			sender.Send(p.ping(pathWebRTC))
+		}
+	}
+	p.choose()
+}
+
+func (p *pathEndpoint) ping(kind pathKind) []byte {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.seq++
+	s := &p.stats[kind]
+	s.seq, s.sent = p.seq, time.Now()
+	return probe{kind: probePing, path: kind, id: p.id, seq: p.seq}.marshal()
+}
+
+func (p *pathEndpoint) pong(pr probe) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	s := &p.stats[pr.path]
+	if s.seq == 0 || s.seq != pr.seq {
+		return
+	}
+	s.record(time.Since(s.sent))
+	s.seq = 0
+}
+
+// choose 根据探测结果选择路径
+func (p *pathEndpoint) choose() {
+	p.locker.Lock()
+	current := p.current
+	other := current.other()
+	cs, os := p.stats[current], p.stats[other]
+	p.locker.Unlock()
+	switch {
+	case cs.down() && !os.down():
+		p.switchTo(other, current.String()+" is down")
+	case os.good() && (!cs.good() || os.score() < cs.score()*pathSwitchRatio):
+		p.switchTo(other, other.String()+" is better")
+	}
+}
+
+// pathQuality 是一条路径的探测结果
+type pathQuality struct {
+	path pathKind
+	rtt  time.Duration
+	loss float64
+	ok   bool
+}
+
+func (p *pathEndpoint) quality() (list []pathQuality) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	for _, kind := range []pathKind{pathWebRTC, pathUDP} {
+		rtt, loss, ok := p.stats[kind].quality()
+		list = append(list, pathQuality{path: kind, rtt: rtt, loss: loss, ok: ok})
+	}
+	return
+}
+
+// handleProbe 回复对方的探测, 或者把回复交给对应的 pathEndpoint
+func (b *Bind) handleProbe(data []byte, reply func([]byte) error) {
+	pr, ok := parseProbe(data)
+	if !ok || b.standby.Load() {
+		return
+	}
+	switch pr.kind {
+	case probePing:
+		pr.kind = probePong
+		reply(pr.marshal())
+	case probePong:
+		if p := b.paths.byID(pr.id); p != nil {
+			p.pong(pr)
+		}
+	}
+}
+
+// pathTable 记录所有 pathEndpoint, 同一个 peer 重新设置 endpoint 时替换旧的
+type pathTable struct {
+	locker *sync.Mutex
+	peers  map[string]*pathEndpoint // hex pubkey
+	ids    map[uint64]*pathEndpoint
+	addrs  map[netip.AddrPort]*pathEndpoint
+}
+
+func newPathTable() *pathTable {
+	return &pathTable{
+		locker: &sync.Mutex{},
+		peers:  make(map[string]*pathEndpoint),
+		ids:    make(map[uint64]*pathEndpoint),
+		addrs:  make(map[netip.AddrPort]*pathEndpoint),
+	}
+}
+
+func (t *pathTable) put(p *pathEndpoint) {
+	t.locker.Lock()
+	old := t.peers[p.peer]
+	if old != nil {
+		t.forget(old)
+	}
+	t.peers[p.peer] = p
+	t.ids[p.id] = p
+	t.addrs[p.udp.AddrPort] = p
+	t.locker.Unlock()
+	if old != nil {
+		old.stop()
+	}
+}
+
+func (t *pathTable) remove(pubkey string) {
+	t.locker.Lock()
+	p := t.peers[pubkey]
+	if p != nil {
+		t.forget(p)
+	}
+	t.locker.Unlock()
+	if p != nil {
+		p.stop()
+	}
+}
+
+// forget 调用时需持有 locker
+func (t *pathTable) forget(p *pathEndpoint) {
+	if t.peers[p.peer] == p {
+		delete(t.peers, p.peer)
+	}
+	delete(t.ids, p.id)
+	if t.addrs[p.udp.AddrPort] == p {
+		delete(t.addrs, p.udp.AddrPort)
+	}
+}
+
+func (t *pathTable) get(pubkey string) *pathEndpoint {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.peers[pubkey]
+}
+
+func (t *pathTable) byID(id uint64) *pathEndpoint {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.ids[id]
+}
+
+func (t *pathTable) byAddr(addr netip.AddrPort) *pathEndpoint {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.addrs[addr]
+}
+
+func (t *pathTable) list() map[string]*pathEndpoint {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	peers := make(map[string]*pathEndpoint, len(t.peers))
+	for k, p := range t.peers {
+		peers[k] = p
+	}
+	return peers
+}
+
+func (ep *outbound) open() bool {
+	ep.locker.Lock()
+	defer ep.locker.Unlock()
+	return dcIsOpen(ep.dc)
+}
+
+func (in *inbound) open() bool {
+	in.locker.Lock()
+	defer in.locker.Unlock()
+	return dcIsOpen(in.dc)
+}
+
+func (in *inbound) isDone() bool {
+	select {
+	case <-in.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,303 @@
+package xhe
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/shynome/wgortc/signaler/local"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const ms = time.Millisecond
+
+// newTestPath 返回没有开始探测的 pathEndpoint, WebRTC 路径没有连接
+func newTestPath(b *Bind, peer string, id uint64, udp string) *pathEndpoint {
+	return &pathEndpoint{
+		bind: b,
+		out:  newOutbound("https://hub/?peer="+peer+"#"+peer, b),
+		udp:  try.To1(parseUDPEndpoint(udp)),
+		peer: peer,
+		id:   id,
+
+		locker: &sync.Mutex{},
+		done:   make(chan struct{}),
+	}
+}
+
+func statsOf(results ...time.Duration) pathStats {
+	return pathStats{results: results}
+}
+
+func isStopped(p *pathEndpoint) bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestProbe(t *testing.T) {
+	pr := probe{kind: probePong, path: pathUDP, id: 1 << 60, seq: 42}
+	b := pr.marshal()
+	assert.SLen(b, probeLen)
+	got, ok := parseProbe(b)
+	assert.That(ok)
+	assert.Equal(got, pr)
+
+	_, ok = parseProbe(b[:probeLen-1])
+	assert.ThatNot(ok)
+	b[len(probeMagic)+1] = 2 // 未知的路径
+	_, ok = parseProbe(b)
+	assert.ThatNot(ok)
+}
+
+func TestPathStats(t *testing.T) {
+	cases := []struct {
+		name  string
+		stats pathStats
+		down  bool
+		ok    bool
+		rtt   time.Duration
+		loss  float64
+		score float64
+	}{
+		{name: "empty"},
+		{name: "two lost", stats: statsOf(-1, -1)},
+		{name: "three lost", stats: statsOf(-1, -1, -1), down: true},
+		{name: "down after success", stats: statsOf(10*ms, -1, -1, -1), down: true, ok: true, rtt: 10 * ms, loss: 0.75, score: float64(40 * ms)},
+		{name: "recovered", stats: statsOf(-1, -1, -1, 10*ms), ok: true, rtt: 10 * ms, loss: 0.75, score: float64(40 * ms)},
+		{name: "average", stats: statsOf(10*ms, 20*ms), ok: true, rtt: 15 * ms, score: float64(15 * ms)},
+		{name: "loss", stats: statsOf(10*ms, -1), ok: true, rtt: 10 * ms, loss: 0.5, score: float64(30 * ms)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := c.stats
+			rtt, loss, ok := s.quality()
+			assert.Equal(s.down(), c.down)
+			assert.Equal(ok, c.ok)
+			assert.Equal(rtt, c.rtt)
+			assert.Equal(loss, c.loss)
+			assert.Equal(s.score(), c.score)
+			assert.Equal(s.good(), c.ok && !c.down)
+		})
+	}
+
+	// 只保留最近 probeWindow 次
+	var s pathStats
+	for i := 0; i < probeWindow+2; i++ {
+		s.record(time.Duration(i) * ms)
+	}
+	assert.SLen(s.results, probeWindow)
+	assert.Equal(s.results[0], 2*ms)
+
+	// 没有回复的探测在下一轮记为丢失
+	s.seq = 1
+	s.expire()
+	assert.Equal(s.results[probeWindow-1], time.Duration(-1))
+	assert.Equal(s.seq, uint64(0))
+	assert.Equal(s.results[0], 3*ms)
+	// 已经收到回复的不记录
+	s.expire()
+	assert.SLen(s.results, probeWindow)
+	assert.Equal(s.results[0], 3*ms)
+}
+
+func TestPathChoose(t *testing.T) {
+	cases := []struct {
+		name    string
+		current pathKind
+		rtc     pathStats
+		udp     pathStats
+		want    pathKind
+	}{
+		{"no probes", pathWebRTC, statsOf(), statsOf(), pathWebRTC},
+		{"only udp answers", pathWebRTC, statsOf(), statsOf(10 * ms), pathUDP},
+		{"udp is not better enough", pathWebRTC, statsOf(10 * ms), statsOf(9 * ms), pathWebRTC},
+		{"udp is better", pathWebRTC, statsOf(10 * ms), statsOf(7 * ms), pathUDP},
+		{"webrtc is not better enough", pathUDP, statsOf(9 * ms), statsOf(10 * ms), pathUDP},
+		{"webrtc is better", pathUDP, statsOf(7 * ms), statsOf(10 * ms), pathWebRTC},
+		{"loss makes udp worse", pathUDP, statsOf(20 * ms), statsOf(10*ms, -1), pathWebRTC},
+		{"udp is down", pathUDP, statsOf(), statsOf(10*ms, -1, -1, -1), pathWebRTC},
+		{"both are down", pathUDP, statsOf(-1, -1, -1), statsOf(-1, -1, -1), pathUDP},
+		{"other is down", pathWebRTC, statsOf(-1, -1, -1), statsOf(1*ms, -1, -1, -1), pathWebRTC},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := newBind(nil)
+			retried := make(chan string, 1)
+			b.states.retry = func(pubkey string) { retried <- pubkey }
+			p := newTestPath(b, "a", 1, "127.0.0.1:51820")
+			p.current = c.current
+			p.stats[pathWebRTC], p.stats[pathUDP] = c.rtc, c.udp
+			p.choose()
+			assert.Equal(p.Path(), c.want)
+			if c.current == pathUDP && c.want == pathWebRTC {
+				// WebRTC 没有连接, 让 WireGuard 重新握手
+				select {
+				case peer := <-retried:
+					assert.Equal(peer, "a")
+				case <-time.After(time.Second):
+					t.Fatal("handshake is not retried")
+				}
+			}
+		})
+	}
+}
+
+func TestPathFailover(t *testing.T) {
+	cases := []struct {
+		name     string
+		current  pathKind
+		from     pathKind
+		rtc      pathStats
+		udp      pathStats
+		switched bool
+		want     pathKind
+	}{
+		{"already switched", pathWebRTC, pathUDP, statsOf(), statsOf(), true, pathWebRTC},
+		{"to udp", pathWebRTC, pathWebRTC, statsOf(), statsOf(10 * ms), true, pathUDP},
+		{"udp has no answer", pathWebRTC, pathWebRTC, statsOf(), statsOf(), false, pathWebRTC},
+		{"udp is down", pathWebRTC, pathWebRTC, statsOf(), statsOf(10*ms, -1, -1, -1), false, pathWebRTC},
+		{"webrtc is not open", pathUDP, pathUDP, statsOf(10 * ms), statsOf(), false, pathUDP},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newTestPath(newBind(nil), "a", 1, "127.0.0.1:51820")
+			p.current = c.current
+			p.stats[pathWebRTC], p.stats[pathUDP] = c.rtc, c.udp
+			assert.Equal(p.failover(c.from, net.ErrClosed), c.switched)
+			assert.Equal(p.Path(), c.want)
+		})
+	}
+}
+
+func TestPathPong(t *testing.T) {
+	b := newBind(nil)
+	p := newTestPath(b, "a", 7, "127.0.0.1:51820")
+	b.paths.put(p)
+
+	ping, _ := parseProbe(p.ping(pathUDP))
+	assert.Equal(ping.kind, probePing)
+	assert.Equal(ping.id, uint64(7))
+
+	// 对方原样回复 ping
+	var reply []byte
+	b.handleProbe(ping.marshal(), func(data []byte) error {
+		reply = data
+		return nil
+	})
+	pong, ok := parseProbe(reply)
+	assert.That(ok)
+	assert.Equal(pong, probe{kind: probePong, path: pathUDP, id: 7, seq: ping.seq})
+
+	cases := []struct {
+		name string
+		pong probe
+	}{
+		{"other id", probe{kind: probePong, path: pathUDP, id: 8, seq: ping.seq}},
+		{"old seq", probe{kind: probePong, path: pathUDP, id: 7, seq: ping.seq - 1}},
+		{"other path", probe{kind: probePong, path: pathWebRTC, id: 7, seq: ping.seq}},
+	}
+	for _, c := range cases {
+		b.handleProbe(c.pong.marshal(), nil)
+		assert.SLen(p.stats[pathUDP].results, 0, c.name)
+		assert.SLen(p.stats[pathWebRTC].results, 0, c.name)
+	}
+
+	b.handleProbe(reply, nil)
+	assert.SLen(p.stats[pathUDP].results, 1)
+	assert.That(p.stats[pathUDP].results[0] >= 0)
+	// 重复的回复不再记录
+	b.handleProbe(reply, nil)
+	assert.SLen(p.stats[pathUDP].results, 1)
+
+	// standby 时不回复也不记录
+	b.standby.Store(true)
+	reply = nil
+	b.handleProbe(ping.marshal(), func(data []byte) error {
+		reply = data
+		return nil
+	})
+	assert.SLen(reply, 0)
+}
+
+func TestPathTable(t *testing.T) {
+	tab := newPathTable()
+	p1 := newTestPath(nil, "a", 1, "203.0.113.1:51820")
+	p2 := newTestPath(nil, "a", 2, "203.0.113.2:51820")
+	p3 := newTestPath(nil, "b", 3, "203.0.113.3:51820")
+	tab.put(p1)
+	tab.put(p3)
+	assert.Equal(tab.get("a"), p1)
+	assert.Equal(tab.byID(1), p1)
+	assert.Equal(tab.byAddr(netip.MustParseAddrPort("203.0.113.1:51820")), p1)
+
+	// 同一个 peer 换了 endpoint, 旧的被替换并停止探测
+	tab.put(p2)
+	assert.Equal(tab.get("a"), p2)
+	assert.That(tab.byID(1) == nil)
+	assert.That(tab.byAddr(netip.MustParseAddrPort("203.0.113.1:51820")) == nil)
+	assert.Equal(tab.byID(2), p2)
+	assert.Equal(tab.byAddr(netip.MustParseAddrPort("203.0.113.2:51820")), p2)
+	assert.That(isStopped(p1))
+	assert.ThatNot(isStopped(p2))
+	assert.MLen(tab.list(), 2)
+
+	tab.remove("a")
+	assert.That(tab.get("a") == nil)
+	assert.That(tab.byID(2) == nil)
+	assert.That(tab.byAddr(netip.MustParseAddrPort("203.0.113.2:51820")) == nil)
+	assert.That(isStopped(p2))
+	assert.Equal(tab.get("b"), p3)
+	assert.MLen(tab.list(), 1)
+
+	// 不存在的 peer
+	tab.remove("c")
+	assert.MLen(tab.list(), 1)
+}
+
+// TestPathUDPFailover WebRTC 连不上时切换到直接 UDP
+func TestPathUDPFailover(t *testing.T) {
+	tdev, tnet, _ := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("192.168.4.29")}, nil, 1420)
+	b1 := newBind(local.NewServer())
+	dev := device.NewDevice(tdev, b1, device.NewLogger(device.LogLevelError, "s "))
+	b1.init(dev)
+	try.To(dev.IpcSet("private_key=003ed5d73b55806c30de3f8a7bdab38af13539220533055e635690b8b87ad641\nlisten_port=0\npublic_key=f928d4f6c1b86c12f2562c10b07c555c5c57fd00f59e90c8d8d88767271cbf7c\nallowed_ip=192.168.4.28/32\n"))
+	try.To(dev.Up())
+	defer dev.Close()
+	ln := try.To1(tnet.ListenTCP(&net.TCPAddr{Port: 80}))
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hi") }))
+	port := b1.udp.port()
+
+	// hub 中没有 server, WebRTC 无法连接
+	hub := local.NewHub()
+	s2 := local.NewServer()
+	hub.Register("client", s2)
+	tdev2, tnet2, _ := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("192.168.4.28")}, nil, 1420)
+	b2 := newBind(s2)
+	dev2 := device.NewDevice(tdev2, b2, device.NewLogger(device.LogLevelError, "c "))
+	b2.init(dev2)
+	try.To(dev2.IpcSet(fmt.Sprintf("private_key=087ec6e14bbed210e7215cdc73468dfa23f080a1bfb8665b2fd809bd99d28379\npublic_key=c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28\nallowed_ip=0.0.0.0/0\nendpoint=server?udp=127.0.0.1:%d#c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28\n", port)))
+	try.To(dev2.Up())
+	defer dev2.Close()
+	c := http.Client{Transport: &http.Transport{DialContext: tnet2.DialContext}, Timeout: 20 * time.Second}
+	resp := try.To1(c.Get("http://192.168.4.29/"))
+	body := try.To1(io.ReadAll(resp.Body))
+	assert.Equal(string(body), "hi")
+	p := b2.paths.get("c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28")
+	assert.NotNil(p)
+	assert.Equal(p.Path(), pathUDP)
+	peers := parseIpcGet(try.To1(dev2.IpcGet()))
+	assert.SLen(peers, 1)
+	assert.Equal(peers[0].Endpoint, fmt.Sprintf("127.0.0.1:%d", port))
+}
@@ -24,9 +24,13 @@ type DoH struct {
 }
 
 // ParsePeer
-// peer://{domain.com}[/preshared_key]?[keepalive=15]
-// peer://{pubkey}[/preshared_key]?[keepalive=15]
-// http[s]://domain/path?peer={pubkey}[&preshared=preshared_key][&keepalive=15]
+// peer://{domain.com}[/preshared_key]?[keepalive=15][&name=peer_name]
+// peer://{pubkey}[/preshared_key]?[keepalive=15][&name=peer_name]
+// http[s]://domain/path?peer={pubkey}[&preshared=preshared_key][&keepalive=15][&name=peer_name]
+// lan://{pubkey}[/preshared_key]?[keepalive=15][&name=peer_name] 只通过局域网连接, 需要 --lan
+// pair://{pubkey}[/preshared_key]?[keepalive=15][&name=peer_name] 主动发起连接, offer 和 answer 手动交换, 见 xhe pair
+// udp://{host}:{port}?peer={pubkey}[&preshared=preshared_key][&keepalive=15][&name=peer_name] 像原版 WireGuard 一样直接通过 UDP 连接
+// 除了 udp:// 以外的链接都可以加上 udp={host}:{port}, 同时探测 WebRTC 和直接 UDP 并选择更好的路径, 见 path.go
 func (s *DoH) ParsePeer(ctx context.Context, link string) (peer config.Peer, ierr error) {
 	conn := doh.NewConn(s.Client, ctx, s.Server)
 	u, ierr := url.Parse(link)
@@ -46,6 +50,7 @@ func (s *DoH) ParsePeer(ctx context.Context, link string) (peer config.Peer, ier
 		} else {
 			endpoint, ierr = GetURI(conn, u.Hostname())
 			if ierr != nil {
+				dohErrors.Inc()
 				return
 			}
 			var uu *url.URL
@@ -58,11 +63,28 @@ func (s *DoH) ParsePeer(ctx context.Context, link string) (peer config.Peer, ier
 				return
 			}
 		}
+	case "pair", "lan":
+		pubkey, ierr = hex2pubkey(u.Hostname())
+		if ierr != nil {
+			return
+		}
+		endpoint = u.Scheme + "://" + u.Hostname()
 	case "http", "https":
 		q := u.Query()
 		pubkey, ierr = hex2pubkey(q.Get("peer"))
 		endpoint = link
 		preshared = q.Get("preshared")
+	case "udp":
+		q := u.Query()
+		pubkey, ierr = hex2pubkey(q.Get("peer"))
+		if ierr != nil {
+			return
+		}
+		if u.Port() == "" {
+			return peer, fmt.Errorf("udp link requires port: %s", link)
+		}
+		endpoint = u.Host
+		preshared = q.Get("preshared")
 	default:
 		ierr = fmt.Errorf("unsupport schema %s", u.Scheme)
 	}
@@ -77,14 +99,23 @@ func (s *DoH) ParsePeer(ctx context.Context, link string) (peer config.Peer, ier
 	if ierr != nil {
 		return
 	}
-	if endpoint != "" {
-		var u *url.URL
-		u, ierr = url.Parse(endpoint)
+	if endpoint != "" && !isUDPEndpoint(endpoint) {
+		var eu *url.URL
+		eu, ierr = url.Parse(endpoint)
 		if ierr != nil {
 			return
 		}
-		u.Fragment = hex.EncodeToString(pubkey)
-		endpoint = u.String()
+		if udp := u.Query().Get("udp"); udp != "" && u.Scheme != "udp" {
+			if !isUDPEndpoint(udp) {
+				return peer, fmt.Errorf("udp param requires {host}:{port}: %s", link)
+			}
+			if q := eu.Query(); q.Get("udp") != udp {
+				q.Set("udp", udp)
+				eu.RawQuery = q.Encode()
+			}
+		}
+		eu.Fragment = hex.EncodeToString(pubkey)
+		endpoint = eu.String()
 	}
 	peer = config.Peer{
 		PublicKey:    hex.EncodeToString(pubkey),
@@ -97,6 +128,27 @@ func (s *DoH) ParsePeer(ctx context.Context, link string) (peer config.Peer, ier
 	return
 }
 
+// PeerName 返回 peer 在 DNS 中的名字.
+// 优先使用 link 中的 name 参数, 其次是 cname link 的第一段域名
+func PeerName(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	name := u.Query().Get("name")
+	if name == "" && u.Scheme == "peer" {
+		host := u.Hostname()
+		if i := strings.Index(host, "."); i != -1 {
+			name = host[:i]
+		}
+	}
+	name = strings.ToLower(name)
+	if _, ok := dns.IsDomainName(name); !ok || strings.Contains(name, ".") {
+		return ""
+	}
+	return name
+}
+
 const Subnet = "fdd9:f800::/24"
 
 func GetIP(pubkey []byte) (pf netip.Prefix, ierr error) {
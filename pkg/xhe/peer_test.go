@@ -36,3 +36,29 @@ func TestGetEndpoint(t *testing.T) {
 		t.Log(endpoint)
 	})
 }
+
+func TestParsePairPeer(t *testing.T) {
+	pubkey := "81dea2c5c077bf78b34a518eda9851cfbe718656fdc470970bde057cbceef23e"
+	peer := try.To1(new(DoH).ParsePeer(nil, "pair://"+pubkey+"?keepalive=15"))
+	assert.Equal(peer.PublicKey, pubkey)
+	assert.Equal(peer.Endpoint, "pair://"+pubkey+"#"+pubkey)
+	assert.Equal(peer.PersistentKeepalive, "15")
+}
+
+func TestParseUDPPeer(t *testing.T) {
+	pubkey := "81dea2c5c077bf78b34a518eda9851cfbe718656fdc470970bde057cbceef23e"
+	peer := try.To1(new(DoH).ParsePeer(nil, "udp://203.0.113.1:51820?peer="+pubkey+"&keepalive=25"))
+	assert.Equal(peer.PublicKey, pubkey)
+	assert.Equal(peer.Endpoint, "203.0.113.1:51820")
+	assert.Equal(peer.PersistentKeepalive, "25")
+
+	_, err := new(DoH).ParsePeer(nil, "udp://203.0.113.1?peer="+pubkey)
+	assert.Error(err)
+
+	peer = try.To1(new(DoH).ParsePeer(nil, "lan://"+pubkey+"?udp=203.0.113.1:51820"))
+	assert.Equal(peer.Endpoint, "lan://"+pubkey+"?udp=203.0.113.1%3A51820#"+pubkey)
+	id, udp, ok := splitPathEndpoint(peer.Endpoint)
+	assert.That(ok)
+	assert.Equal(id, "lan://"+pubkey+"#"+pubkey)
+	assert.Equal(udp, "203.0.113.1:51820")
+}
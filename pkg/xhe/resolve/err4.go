@@ -0,0 +1,5 @@
+package resolve
+
+import "remoon.net/xhe/internal/err4"
+
+var then = err4.Then
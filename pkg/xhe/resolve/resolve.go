@@ -0,0 +1,225 @@
+// Package resolve 让系统可以通过 {name}.{domain} 访问 peer
+package resolve
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slog"
+	"remoon.net/xhe/pkg/xhe"
+)
+
+type Resolver struct {
+	dev    *xhe.Device
+	ifname string
+	domain string // fqdn, 如 xhe.
+
+	server *dns.Server
+	host   hostConfig
+
+	locker *sync.Mutex
+}
+
+// hostConfig 是系统 DNS 的配置方式
+type hostConfig interface {
+	// Update 在 peer 变化时调用
+	Update(records []record) error
+	Restore() error
+}
+
+type record struct {
+	name string
+	ip   netip.Addr
+}
+
+// Start 在 xhe 地址的 53 端口上启动 DNS 服务, 并配置系统 DNS 把 domain 下的查询交给它.
+// HA 的 standby 没有配置 xhe 地址, 成为 active 之后才启动, 成为 standby 时停止.
+// 不支持的平台上只给出警告, 返回的 r 为 nil
+func Start(dev *xhe.Device, ifname string, domain string) (r *Resolver, ierr error) {
+	domain = dns.Fqdn(strings.TrimPrefix(domain, "~"))
+	logger := slog.With(
+		"act", "dns integration",
+		"domain", domain,
+	)
+	if !hostSupported {
+		logger.Warn("dns integration is not supported on this platform, skip")
+		return nil, nil
+	}
+	logger.Debug("pending")
+	defer then(&ierr, func() {
+		logger.Info("successful")
+	}, func() {
+		logger.Warn("failed", "err", ierr)
+	})
+
+	r = &Resolver{
+		dev:    dev,
+		ifname: ifname,
+		domain: domain,
+		locker: &sync.Mutex{},
+	}
+	active := dev.Active()
+	if !active {
+		logger.Info("standby, start dns server after become active")
+	} else {
+		r.locker.Lock()
+		ierr = r.start()
+		r.locker.Unlock()
+		if ierr != nil {
+			return
+		}
+	}
+	// 启动成功后才注册回调, 失败时不会在 dev 上留下回调
+	dev.OnRole(r.onRole)
+	dev.OnChange(r.refresh)
+	if dev.Active() != active {
+		// 注册之前角色已经变了, 补上这次切换
+		r.onRole(!active)
+	}
+	r.refresh()
+	return
+}
+
+// start 调用时需持有 locker
+func (r *Resolver) start() (ierr error) {
+	if r.server != nil {
+		return
+	}
+	addr := netip.AddrPortFrom(r.dev.IP(), 53)
+	pc, ierr := net.ListenPacket("udp", addr.String())
+	if ierr != nil {
+		return
+	}
+	server := &dns.Server{PacketConn: pc, Handler: r}
+	go func() {
+		if err := server.ActivateAndServe(); err != nil {
+			slog.Warn("dns server stopped", "act", "dns integration", "err", err)
+		}
+	}()
+
+	r.host, ierr = configureHost(r.ifname, r.dev.IP(), r.domain)
+	if ierr != nil {
+		server.Shutdown()
+		return
+	}
+	r.server = server
+	return
+}
+
+// stop 调用时需持有 locker
+func (r *Resolver) stop() error {
+	var errs []error
+	if r.host != nil {
+		errs = append(errs, r.host.Restore())
+		r.host = nil
+	}
+	if r.server != nil {
+		errs = append(errs, r.server.Shutdown())
+		r.server = nil
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Resolver) onRole(active bool) {
+	r.locker.Lock()
+	var err error
+	if active {
+		err = r.start()
+	} else {
+		err = r.stop()
+	}
+	r.locker.Unlock()
+	if err != nil {
+		slog.Warn("switch dns server with role failed", "act", "dns integration", "active", active, "err", err)
+		return
+	}
+	if active {
+		r.refresh()
+	}
+}
+
+func (r *Resolver) refresh() {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if r.host == nil {
+		return
+	}
+	records, err := r.records()
+	if err != nil {
+		slog.Warn("list dns records failed", "err", err)
+		return
+	}
+	if err := r.host.Update(records); err != nil {
+		slog.Warn("update host dns failed", "err", err)
+	}
+}
+
+func (r *Resolver) records() (records []record, ierr error) {
+	peers, ierr := r.dev.Peers()
+	if ierr != nil {
+		return
+	}
+	for _, p := range peers {
+		if p.Name == "" {
+			continue
+		}
+		pubkey, err := hex.DecodeString(p.PublicKey)
+		if err != nil {
+			continue
+		}
+		ip, err := xhe.GetIP(pubkey)
+		if err != nil {
+			continue
+		}
+		records = append(records, record{name: p.Name + "." + r.domain, ip: ip.Addr()})
+	}
+	return
+}
+
+func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	defer w.WriteMsg(m)
+
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		return
+	}
+	q := req.Question[0]
+	qname := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(r.domain, qname) {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	records, err := r.records()
+	if err != nil {
+		m.Rcode = dns.RcodeServerFailure
+		return
+	}
+	for _, rec := range records {
+		if rec.name != qname {
+			continue
+		}
+		if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+				AAAA: rec.ip.AsSlice(),
+			})
+		}
+		return
+	}
+	m.Rcode = dns.RcodeNameError
+}
+
+// Close 停止 DNS 服务并恢复系统 DNS 配置
+func (r *Resolver) Close() error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return r.stop()
+}
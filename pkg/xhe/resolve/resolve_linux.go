@@ -0,0 +1,166 @@
+package resolve
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/exp/slog"
+)
+
+const hostSupported = true
+
+// configureHost 优先使用 systemd-resolved, 否则在 /etc/hosts 中维护一段带标记的记录.
+// 不修改 /etc/resolv.conf: 其中的 nameserver 对所有域名生效, 没法只把 domain 交给 xhe
+func configureHost(ifname string, addr netip.Addr, domain string) (hostConfig, error) {
+	r, err := newResolved(ifname, addr, domain)
+	if err == nil {
+		return r, nil
+	}
+	slog.Warn("systemd-resolved is not available, fallback to /etc/hosts", "err", err)
+	return &hosts{path: hostsFile, ifname: ifname}, nil
+}
+
+// resolved 通过 systemd-resolved 的 D-Bus 接口为网卡设置 split DNS
+type resolved struct {
+	conn    *dbus.Conn
+	ifindex int32
+}
+
+const (
+	resolvedDest = "org.freedesktop.resolve1"
+	resolvedPath = "/org/freedesktop/resolve1"
+	resolvedIf   = "org.freedesktop.resolve1.Manager"
+)
+
+type resolvedDNS struct {
+	Family  int32
+	Address []byte
+}
+
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+func newResolved(ifname string, addr netip.Addr, domain string) (r *resolved, ierr error) {
+	iface, ierr := net.InterfaceByName(ifname)
+	if ierr != nil {
+		return
+	}
+	conn, ierr := dbus.ConnectSystemBus()
+	if ierr != nil {
+		return
+	}
+	r = &resolved{conn: conn, ifindex: int32(iface.Index)}
+	defer then(&ierr, nil, func() {
+		conn.Close()
+	})
+
+	family := int32(syscall.AF_INET6)
+	if addr.Is4() {
+		family = syscall.AF_INET
+	}
+	ierr = r.call("SetLinkDNS", []resolvedDNS{{Family: family, Address: addr.AsSlice()}})
+	if ierr != nil {
+		return
+	}
+	ierr = r.call("SetLinkDomains", []resolvedDomain{{Domain: domain, RoutingOnly: true}})
+	if ierr != nil {
+		return
+	}
+	// 不要让这个网卡接管其他域名的查询, 旧版本没有这个方法, 忽略错误
+	_ = r.call("SetLinkDefaultRoute", false)
+	return
+}
+
+func (r *resolved) call(method string, args ...any) error {
+	obj := r.conn.Object(resolvedDest, resolvedPath)
+	args = append([]any{r.ifindex}, args...)
+	return obj.Call(resolvedIf+"."+method, 0, args...).Err
+}
+
+// resolved 的记录由我们的 DNS 服务实时提供, 无需更新
+func (r *resolved) Update(records []record) error { return nil }
+
+func (r *resolved) Restore() error {
+	defer r.conn.Close()
+	return r.call("RevertLink")
+}
+
+const hostsFile = "/etc/hosts"
+
+// hosts 在 /etc/hosts 中维护一段带标记的记录
+type hosts struct {
+	path   string
+	ifname string
+}
+
+func (h *hosts) markers() (begin string, end string) {
+	return fmt.Sprintf("# BEGIN xhe %s", h.ifname), fmt.Sprintf("# END xhe %s", h.ifname)
+}
+
+func (h *hosts) Update(records []record) error {
+	begin, end := h.markers()
+	var block bytes.Buffer
+	if len(records) > 0 {
+		fmt.Fprintln(&block, begin)
+		for _, r := range records {
+			fmt.Fprintf(&block, "%s\t%s\n", r.ip, strings.TrimSuffix(r.name, "."))
+		}
+		fmt.Fprintln(&block, end)
+	}
+	return h.write(block.Bytes())
+}
+
+func (h *hosts) Restore() error {
+	return h.write(nil)
+}
+
+func (h *hosts) write(block []byte) (ierr error) {
+	b, ierr := os.ReadFile(h.path)
+	if ierr != nil {
+		return
+	}
+	begin, end := h.markers()
+	b = replaceBlock(b, block, begin, end)
+	stat, ierr := os.Stat(h.path)
+	if ierr != nil {
+		return
+	}
+	// /etc/hosts 在容器里常常是 bind mount, 不能 rename, 只能原地写入
+	return os.WriteFile(h.path, b, stat.Mode().Perm())
+}
+
+// replaceBlock 移除旧的标记块(包括上次崩溃留下的), 然后追加新的
+func replaceBlock(content []byte, block []byte, begin string, end string) []byte {
+	var out bytes.Buffer
+	skip := false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == begin:
+			skip = true
+			continue
+		case trimmed == end:
+			skip = false
+			continue
+		case skip:
+			continue
+		}
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n")
+		}
+	}
+	out.Write(block)
+	return out.Bytes()
+}
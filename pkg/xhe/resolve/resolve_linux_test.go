@@ -0,0 +1,21 @@
+package resolve
+
+import (
+	"testing"
+
+	"github.com/lainio/err2/assert"
+)
+
+func TestReplaceBlock(t *testing.T) {
+	begin, end := "# BEGIN xhe xhe", "# END xhe xhe"
+	content := "127.0.0.1\tlocalhost\n" +
+		begin + "\nfdd9:f800::1\told.xhe\n" + end + "\n" +
+		"::1\tlocalhost"
+	block := begin + "\nfdd9:f800::2\tnew.xhe\n" + end + "\n"
+
+	b := replaceBlock([]byte(content), []byte(block), begin, end)
+	assert.Equal(string(b), "127.0.0.1\tlocalhost\n::1\tlocalhost\n"+block)
+
+	b = replaceBlock(b, nil, begin, end)
+	assert.Equal(string(b), "127.0.0.1\tlocalhost\n::1\tlocalhost\n")
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package resolve
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// hostSupported 表示这个平台能否配置系统 DNS
+const hostSupported = false
+
+func configureHost(ifname string, addr netip.Addr, domain string) (hostConfig, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,128 @@
+package xhe
+
+import (
+	"log/slog"
+	"net/netip"
+	"sync"
+
+	"remoon.net/xhe/pkg/vtun"
+	"remoon.net/xhe/pkg/xhe/ipconf"
+)
+
+// HA 模式下 standby 不配置地址和路由, Bind 也不向 peer 发送数据, 接管订阅之后再配置.
+// 角色由 signaler 根据 hub 的 423 Locked 判断, 见 signaler/standby.go
+
+type haRole struct {
+	locker *sync.Mutex
+	// ready 表示 Run 已经完成 WireGuard 的配置, 之前的角色变化留到 Run 结束时处理
+	ready      bool
+	active     bool
+	configured bool
+	watchers   []func(active bool)
+}
+
+func newHARole() *haRole {
+	return &haRole{locker: &sync.Mutex{}, active: true}
+}
+
+// Active 返回这个实例是否是 active, 没有开启 HA 时总是 true
+func (d *Device) Active() bool {
+	d.role.locker.Lock()
+	defer d.role.locker.Unlock()
+	return d.role.active
+}
+
+// OnRole 注册角色变化的回调, 在地址和路由按新角色配置之后调用
+func (d *Device) OnRole(fn func(active bool)) {
+	d.role.locker.Lock()
+	defer d.role.locker.Unlock()
+	d.role.watchers = append(d.role.watchers, fn)
+}
+
+// setActive 切换角色, Run 完成前只记录
+func (d *Device) setActive(active bool) {
+	r := d.role
+	r.locker.Lock()
+	changed := r.active != active
+	r.active = active
+	if r.ready {
+		d.applyRole()
+	}
+	notify := changed && r.ready
+	watchers := r.watchers
+	r.locker.Unlock()
+	if !notify {
+		return
+	}
+	for _, fn := range watchers {
+		fn(active)
+	}
+}
+
+// start 在 Run 结束时按当前角色配置地址和路由
+func (d *Device) start() (ierr error) {
+	r := d.role
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.ready = true
+	if !r.active {
+		slog.Info("start as standby, wait for the active instance to go away")
+		return
+	}
+	ierr = d.configureIP()
+	r.configured = ierr == nil
+	return
+}
+
+// applyRole 调用时需持有 role.locker
+func (d *Device) applyRole() {
+	r := d.role
+	if r.active == r.configured {
+		return
+	}
+	if r.active {
+		if err := d.configureIP(); err != nil {
+			slog.Error("configure ip after become active failed", "err", err)
+			return
+		}
+		r.configured = true
+		return
+	}
+	if _, ok := d.tun.(vtun.GetStack); ok {
+		// vtun 的地址在 gVisor 中, 外部看不到, 保留即可
+		return
+	}
+	if err := ipconf.Cleanup(d.tun); err != nil {
+		slog.Warn("ipconf cleanup after become standby failed", "err", err)
+	}
+	r.configured = false
+}
+
+// configureIP 添加本机地址和 peer 的路由
+func (d *Device) configureIP() (ierr error) {
+	pf := netip.PrefixFrom(d.ip.Addr(), 24)
+	ierr = ipconf.AddRoute(d.tun, pf)
+	if ierr != nil {
+		return
+	}
+	ierr = ipconf.Up(d.tun)
+	if ierr != nil {
+		return
+	}
+	peers, ierr := d.Peers()
+	if ierr != nil {
+		return
+	}
+	var routes []netip.Prefix
+	for _, p := range peers {
+		routes = append(routes, parsePrefixes(p.AllowedIPs)...)
+	}
+	return ipconf.AddPeerRoutes(d.tun, routes)
+}
+
+// routed 返回现在是否需要维护 peer 的路由
+func (d *Device) routed() bool {
+	d.role.locker.Lock()
+	defer d.role.locker.Unlock()
+	return d.role.configured
+}
@@ -0,0 +1,70 @@
+package xhe
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PeerStatus struct {
+	PublicKey     string    `json:"public_key"`
+	Name          string    `json:"name,omitempty"`
+	Link          string    `json:"link,omitempty"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	State         string    `json:"state,omitempty"`
+	Failures      int       `json:"failures,omitempty"`   // 连上之前连续失败的次数
+	LastError     string    `json:"last_error,omitempty"` // 最后一次连接失败的原因, 连上后清空
+	Path          string    `json:"path,omitempty"`       // 同时有 WebRTC 和 UDP 两条路径时当前使用的路径
+	AllowedIPs    []string  `json:"allowed_ips,omitempty"`
+	RxBytes       uint64    `json:"rx_bytes"`
+	TxBytes       uint64    `json:"tx_bytes"`
+	LastHandshake time.Time `json:"last_handshake"`
+}
+
+// parseIpcGet 解析 IpcGet 的输出, 只关心 peer 部分
+func parseIpcGet(s string) (peers []PeerStatus) {
+	var peer *PeerStatus
+	var sec, nsec int64
+	flush := func() {
+		if peer == nil {
+			return
+		}
+		if sec != 0 || nsec != 0 {
+			peer.LastHandshake = time.Unix(sec, nsec)
+		}
+		peers = append(peers, *peer)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if key == "public_key" {
+			flush()
+			peer = &PeerStatus{PublicKey: value}
+			sec, nsec = 0, 0
+			continue
+		}
+		if peer == nil {
+			continue
+		}
+		switch key {
+		case "endpoint":
+			peer.Endpoint = value
+		case "allowed_ip":
+			peer.AllowedIPs = append(peer.AllowedIPs, value)
+		case "rx_bytes":
+			peer.RxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "last_handshake_time_sec":
+			sec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsec, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	flush()
+	return
+}
@@ -0,0 +1,36 @@
+package xhe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+)
+
+func TestParseIpcGet(t *testing.T) {
+	s := `private_key=e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a
+listen_port=0
+public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33
+endpoint=[fdd9:f800::]:80
+last_handshake_time_sec=1694000000
+last_handshake_time_nsec=0
+tx_bytes=92
+rx_bytes=148
+persistent_keepalive_interval=0
+allowed_ip=fdd9:f800:b4e8:cb59:95e3:c464:9fff:b8c8/128
+public_key=58402e695ba1772b1cc9309755f043251ea77fdcf10fbe63989ceb7e19321376
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+tx_bytes=0
+rx_bytes=0
+`
+	peers := parseIpcGet(s)
+	assert.SLen(peers, 2)
+	assert.Equal(peers[0].PublicKey, "b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33")
+	assert.Equal(peers[0].Endpoint, "[fdd9:f800::]:80")
+	assert.Equal(peers[0].RxBytes, uint64(148))
+	assert.Equal(peers[0].TxBytes, uint64(92))
+	assert.SLen(peers[0].AllowedIPs, 1)
+	assert.Equal(peers[0].LastHandshake, time.Unix(1694000000, 0))
+	assert.That(peers[1].LastHandshake.IsZero())
+}
@@ -0,0 +1,163 @@
+package xhe
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// 除了 WebRTC, Bind 也像原版 WireGuard 一样直接通过 UDP 和 {ip}:{port} 的 endpoint 通信.
+// ICE 和 WireGuard 共用 --port 上的同一个 socket, 收到的包按内容分开:
+//   - WireGuard 的消息第一个字节是类型 1-4, 之后三个字节是 0
+//   - STUN 的第一个字节是 0-3, 第 4-8 字节是 magic cookie; DTLS 的第一个字节是 20-63
+// 所以原版 WireGuard 的 peer 可以直接连接 xhe 的 --port, NAT 后面的 peer 继续使用 WebRTC
+
+const (
+	stunMagicCookie = 0x2112A442
+	// wgMinMessage 是最短的 WireGuard 消息, 空的 transport 消息(keepalive)
+	wgMinMessage = 32
+)
+
+var ErrUDPUnavailable = errors.New("udp endpoint is not supported on this platform")
+
+// isWireGuard 判断收到的包是不是 WireGuard 的消息
+func isWireGuard(b []byte) bool {
+	if len(b) < wgMinMessage || b[0] < 1 || b[0] > 4 || b[1] != 0 || b[2] != 0 || b[3] != 0 {
+		return false
+	}
+	return binary.BigEndian.Uint32(b[4:8]) != stunMagicCookie
+}
+
+// udpEndpoint 是 {ip}:{port} 的 endpoint
+type udpEndpoint struct {
+	netip.AddrPort
+}
+
+var _ conn.Endpoint = (*udpEndpoint)(nil)
+
+func (e *udpEndpoint) ClearSrc()           {}
+func (e *udpEndpoint) SrcToString() string { return "" }
+func (e *udpEndpoint) DstToString() string { return e.AddrPort.String() }
+func (e *udpEndpoint) DstIP() netip.Addr   { return e.Addr() }
+func (e *udpEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+func (e *udpEndpoint) DstToBytes() []byte {
+	b, _ := e.AddrPort.MarshalBinary()
+	return b
+}
+
+// isUDPEndpoint 判断 endpoint 是不是 {host}:{port}, 其他的都是 WebRTC 的链接
+func isUDPEndpoint(s string) bool {
+	if strings.Contains(s, "://") || strings.ContainsAny(s, "/?#") {
+		return false
+	}
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	return err == nil
+}
+
+func parseUDPEndpoint(s string) (ep *udpEndpoint, ierr error) {
+	ap, ierr := netip.ParseAddrPort(s)
+	if ierr != nil {
+		// 和 wg 命令一样允许域名, 解析一次
+		addr, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			return nil, err
+		}
+		ap, ierr = addr.AddrPort(), nil
+	}
+	return &udpEndpoint{netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())}, nil
+}
+
+type udpPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// udpConn 是 ICE 和 WireGuard 共用的 socket, ICE 通过 iceSide 读写
+type udpConn struct {
+	*net.UDPConn
+	ice  chan udpPacket
+	done chan struct{}
+}
+
+func listenUDP(port uint16) (c *udpConn, ierr error) {
+	uc, ierr := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if ierr != nil {
+		return
+	}
+	c = &udpConn{
+		UDPConn: uc,
+		ice:     make(chan udpPacket, 256),
+		done:    make(chan struct{}),
+	}
+	return
+}
+
+func (c *udpConn) port() uint16 {
+	return uint16(c.LocalAddr().(*net.UDPAddr).Port)
+}
+
+const (
+	// 连续读取失败这么多次后每次失败都等待 udpReadBackoff, 防止持续出错时空转
+	udpReadRetries = 10
+	udpReadBackoff = 100 * time.Millisecond
+)
+
+// serve 读取 socket, WireGuard 的消息和路径探测交给 wg, 其余的交给 ICE
+func (c *udpConn) serve(wg func(data []byte, ep *udpEndpoint)) {
+	defer close(c.done)
+	buf := make([]byte, 65535)
+	failures := 0
+	for {
+		n, addr, err := c.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// 和 wireguard-go 一样只在关闭时退出, 其他错误 (比如 Windows 收到 ICMP 后的 WSAECONNRESET) 不影响后面的包
+			slog.Debug("read udp failed", "act", "serve udp", "err", err)
+			if failures++; failures > udpReadRetries {
+				time.Sleep(udpReadBackoff)
+			}
+			continue
+		}
+		failures = 0
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if isWireGuard(data) {
+			udpPackets.Inc("rx")
+			wg(data, &udpEndpoint{addr})
+			continue
+		}
+		if isProbe(data) {
+			wg(data, &udpEndpoint{addr})
+			continue
+		}
+		select {
+		case c.ice <- udpPacket{data: data, addr: net.UDPAddrFromAddrPort(addr)}:
+		default:
+			// 和 UDP 一样, 处理不过来时丢弃
+		}
+	}
+}
+
+func (c *udpConn) send(bufs [][]byte, ep *udpEndpoint) error {
+	for _, buf := range bufs {
+		if _, err := c.WriteToUDPAddrPort(buf, ep.AddrPort); err != nil {
+			return err
+		}
+		udpPackets.Inc("tx")
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build js || wasip1
+
+package xhe
+
+import "github.com/pion/webrtc/v3"
+
+// openUDP 浏览器中不能直接使用 UDP, 只有 WebRTC
+func (b *Bind) openUDP(se *webrtc.SettingEngine, port uint16) (actualPort uint16, ierr error) {
+	return port, nil
+}
@@ -0,0 +1,69 @@
+//go:build !(js || wasip1)
+
+package xhe
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// openUDP 在 port 上监听 ICE 和 WireGuard 共用的 socket
+func (b *Bind) openUDP(se *webrtc.SettingEngine, port uint16) (actualPort uint16, ierr error) {
+	b.udp, ierr = listenUDP(port)
+	if ierr != nil {
+		return
+	}
+	b.mux = ice.NewUDPMuxDefault(ice.UDPMuxParams{UDPConn: &iceSide{udpConn: b.udp}})
+	se.SetICEUDPMux(b.mux)
+	go b.udp.serve(b.pipeUDP)
+	return b.udp.port(), nil
+}
+
+// iceSide 是交给 ICE UDPMux 的一半
+type iceSide struct {
+	*udpConn
+	// deadline 是读超时的 UnixNano, 0 表示没有超时. ICE 在别的 goroutine 里设置
+	deadline atomic.Int64
+}
+
+var _ net.PacketConn = (*iceSide)(nil)
+
+func (c *iceSide) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	var timeout <-chan time.Time
+	if d := c.deadline.Load(); d != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, d)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p := <-c.ice:
+		return copy(b, p.data), p.addr, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *iceSide) SetReadDeadline(t time.Time) error {
+	c.setDeadline(t)
+	return nil
+}
+
+func (c *iceSide) SetDeadline(t time.Time) error {
+	c.setDeadline(t)
+	return c.udpConn.SetWriteDeadline(t)
+}
+
+func (c *iceSide) setDeadline(t time.Time) {
+	if t.IsZero() {
+		c.deadline.Store(0)
+		return
+	}
+	c.deadline.Store(t.UnixNano())
+}
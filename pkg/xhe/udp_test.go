@@ -0,0 +1,220 @@
+package xhe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+	"github.com/shynome/wgortc/signaler/local"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// packet 返回 n 字节的包, 开头是 head
+func packet(n int, head ...byte) []byte {
+	b := make([]byte, n)
+	copy(b, head)
+	return b
+}
+
+// stunPacket 返回 n 字节的 STUN 消息, 第一个字节是 first
+func stunPacket(n int, first byte) []byte {
+	b := packet(n, first, 1)
+	binary.BigEndian.PutUint32(b[4:8], stunMagicCookie)
+	return b
+}
+
+func TestIsWireGuard(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"initiation", packet(148, 1), true},
+		{"response", packet(92, 2), true},
+		{"cookie reply", packet(64, 3), true},
+		{"keepalive", packet(wgMinMessage, 4), true},
+		{"short", packet(wgMinMessage-1, 4), false},
+		{"unknown type", packet(148, 5), false},
+		{"reserved bytes", packet(148, 1, 0, 1), false},
+		{"stun binding", stunPacket(wgMinMessage, 0), false},
+		{"stun with wireguard type", packet(wgMinMessage, 1, 0, 0, 0, 0x21, 0x12, 0xA4, 0x42), false},
+		{"dtls handshake", packet(64, 22, 0xfe, 0xfd), false},
+		{"dtls application data", packet(64, 23, 0xfe, 0xfd), false},
+		{"probe", probe{kind: probePing, path: pathUDP, id: 1, seq: 1}.marshal(), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(isWireGuard(c.data), c.ok)
+		})
+	}
+}
+
+func TestIsUDPEndpoint(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		ok       bool
+	}{
+		{"203.0.113.1:51820", true},
+		{"[::1]:51820", true},
+		{"[fdd9:f800::1]:51820", true},
+		{"example.com:51820", true},
+		{"localhost:51820", true},
+		{"203.0.113.1", false},
+		{"::1", false},
+		{"example.com:port", false},
+		{"example.com:65536", false},
+		{"example.com:51820?x", false},
+		{"example.com:51820#peer", false},
+		{"example.com:51820/path", false},
+		{"https://example.com:51820", false},
+		{"https://example.com/?peer=a#a", false},
+		{"server", false},
+		{"server?udp=127.0.0.1:51820#a", false},
+	}
+	for _, c := range cases {
+		t.Run(c.endpoint, func(t *testing.T) {
+			assert.Equal(isUDPEndpoint(c.endpoint), c.ok)
+		})
+	}
+}
+
+func TestParseUDPEndpoint(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		addr     string
+	}{
+		{"203.0.113.1:51820", "203.0.113.1:51820"},
+		{"[::1]:51820", "[::1]:51820"},
+		{"[::ffff:203.0.113.1]:51820", "203.0.113.1:51820"},
+		{"127.0.0.1:0", "127.0.0.1:0"},
+	}
+	for _, c := range cases {
+		t.Run(c.endpoint, func(t *testing.T) {
+			ep := try.To1(parseUDPEndpoint(c.endpoint))
+			assert.Equal(ep.DstToString(), c.addr)
+		})
+	}
+
+	// 域名解析一次
+	ep := try.To1(parseUDPEndpoint("localhost:51820"))
+	assert.That(ep.Addr().IsLoopback())
+	assert.Equal(ep.Port(), uint16(51820))
+
+	_, err := parseUDPEndpoint("203.0.113.1")
+	assert.Error(err)
+}
+
+func TestUDPServe(t *testing.T) {
+	c := try.To1(listenUDP(0))
+	type received struct {
+		data []byte
+		ep   *udpEndpoint
+	}
+	wg := make(chan received, 8)
+	go c.serve(func(data []byte, ep *udpEndpoint) {
+		wg <- received{data, ep}
+	})
+
+	sender := try.To1(net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	defer sender.Close()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(c.port())}
+	from := sender.LocalAddr().String()
+
+	cases := []struct {
+		name string
+		data []byte
+		wg   bool
+	}{
+		{"wireguard", packet(wgMinMessage, 4), true},
+		{"probe", probe{kind: probePing, path: pathUDP, id: 1, seq: 2}.marshal(), true},
+		{"stun", stunPacket(20, 0), false},
+		{"dtls", packet(64, 22, 0xfe, 0xfd), false},
+	}
+	for _, tc := range cases {
+		try.To1(sender.WriteTo(tc.data, to))
+		var data []byte
+		var addr string
+		select {
+		case r := <-wg:
+			assert.That(tc.wg, tc.name)
+			data, addr = r.data, r.ep.DstToString()
+		case p := <-c.ice:
+			assert.ThatNot(tc.wg, tc.name)
+			data, addr = p.data, p.addr.String()
+		case <-time.After(time.Second):
+			t.Fatal(tc.name, "is not received")
+		}
+		assert.DeepEqual(data, tc.data)
+		assert.Equal(addr, from)
+	}
+
+	c.Close()
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("serve is not stopped")
+	}
+}
+
+// TestUDPServeReadError 读取出错 (比如 Windows 上的 WSAECONNRESET) 后继续收包, 只在关闭时退出
+func TestUDPServeReadError(t *testing.T) {
+	c := try.To1(listenUDP(0))
+	defer c.Close()
+	wg := make(chan []byte, 1)
+	go c.serve(func(data []byte, ep *udpEndpoint) { wg <- data })
+
+	// 过期的 deadline 让读取一直返回超时错误
+	try.To(c.SetReadDeadline(time.Now()))
+	time.Sleep(50 * time.Millisecond)
+	try.To(c.SetReadDeadline(time.Time{}))
+
+	sender := try.To1(net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	defer sender.Close()
+	data := packet(wgMinMessage, 4)
+	try.To1(sender.WriteTo(data, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(c.port())}))
+	select {
+	case got := <-wg:
+		assert.DeepEqual(got, data)
+	case <-c.done:
+		t.Fatal("serve is stopped by the read error")
+	case <-time.After(2 * time.Second):
+		t.Fatal("packet is not received")
+	}
+}
+
+// TestBindUDP 原版 WireGuard 通过 UDP 直接连接 xhe
+func TestBindUDP(t *testing.T) {
+	tdev, tnet, _ := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("192.168.4.29")}, nil, 1420)
+	b1 := newBind(local.NewServer())
+	dev := device.NewDevice(tdev, b1, device.NewLogger(device.LogLevelError, "s "))
+	b1.init(dev)
+	try.To(dev.IpcSet("private_key=003ed5d73b55806c30de3f8a7bdab38af13539220533055e635690b8b87ad641\nlisten_port=0\npublic_key=f928d4f6c1b86c12f2562c10b07c555c5c57fd00f59e90c8d8d88767271cbf7c\nallowed_ip=192.168.4.28/32\n"))
+	try.To(dev.Up())
+	defer dev.Close()
+	ln := try.To1(tnet.ListenTCP(&net.TCPAddr{Port: 80}))
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hi") }))
+	port := b1.udp.port()
+
+	tdev2, tnet2, _ := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("192.168.4.28")}, nil, 1420)
+	dev2 := device.NewDevice(tdev2, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, "c "))
+	try.To(dev2.IpcSet(fmt.Sprintf("private_key=087ec6e14bbed210e7215cdc73468dfa23f080a1bfb8665b2fd809bd99d28379\npublic_key=c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28\nallowed_ip=0.0.0.0/0\nendpoint=127.0.0.1:%d\n", port)))
+	try.To(dev2.Up())
+	defer dev2.Close()
+	c := http.Client{Transport: &http.Transport{DialContext: tnet2.DialContext}, Timeout: 10 * time.Second}
+	resp := try.To1(c.Get("http://192.168.4.29/"))
+	body := try.To1(io.ReadAll(resp.Body))
+	assert.Equal(string(body), "hi")
+	// xhe 一侧的 endpoint 漫游到了 UDP 地址
+	peers := parseIpcGet(try.To1(dev.IpcGet()))
+	assert.SLen(peers, 1)
+	assert.That(isUDPEndpoint(peers[0].Endpoint))
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/lainio/err2/try"
@@ -14,24 +16,96 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"remoon.net/xhe/pkg/config"
 	"remoon.net/xhe/pkg/signaler"
+	"remoon.net/xhe/pkg/vtun"
 	"remoon.net/xhe/pkg/xhe/ipconf"
 )
 
-func Run(cfg Config) (dev *device.Device, ierr error) {
+func Run(cfg Config) (dev *Device, ierr error) {
 	cfg.Normalize()
 
 	key, ierr := str2pubkey(cfg.PrivateKey)
 	if ierr != nil {
 		return
 	}
-	server := signaler.New(key, cfg.Links)
-	bind := newBind(server)
+	client, ierr := cfg.HTTP.NewClient()
+	if ierr != nil {
+		return
+	}
+	channel := cfg.Channel
+	var relay *signaler.Relay
+	var server *signaler.Signaler
+	if channel == nil {
+		server = signaler.New(key, cfg.Links)
+		server.Client = client
+		server.RequireLinks = cfg.RequireLinks
+		server.AllowUnsigned = cfg.AllowUnsigned
+		server.PlainSDP = cfg.PlainSDP
+		server.LANPort = cfg.LAN
+		server.HA = cfg.HA
+		server.Priority = cfg.Priority
+		if cfg.OfferLimits != nil {
+			server.Limits = *cfg.OfferLimits
+		}
+		switch mode := signaler.SignMode(cfg.SignMode); mode {
+		case "", signaler.SignCompat, signaler.SignV2:
+			server.Signing = mode
+		default:
+			return nil, fmt.Errorf("unknown sign mode %q", cfg.SignMode)
+		}
+		channel = server
+		if cfg.Relay != 0 {
+			relay = signaler.NewRelay(server, cfg.Relay)
+			relay.Addr = func(pubkey []byte) netip.Addr {
+				pf, _ := GetIP(pubkey)
+				return pf.Addr()
+			}
+			if stack, ok := cfg.GoTun.(vtun.GetStack); ok {
+				relay.Dial = vtun.Dialer(stack)
+				relay.Listen = func(addr netip.AddrPort) (net.Listener, error) {
+					return vtun.ListenTCP(stack, addr)
+				}
+			}
+			channel = relay
+		}
+	}
+	bind := newBind(channel)
+	// 手动交换 offer 需要更长的时间, 期间不要重新发起
+	if c, ok := channel.(interface{ HandshakeTimeout() time.Duration }); ok {
+		bind.states.attemptTimeout = c.HandshakeTimeout()
+	}
+	bind.auth, ierr = newOfferAuth(key, cfg.Allow)
+	if ierr != nil {
+		return
+	}
 	logger := device.NewLogger(
 		toDeviceLogLv(cfg.LogLevel),
 		fmt.Sprintf("(%s) ", try.To1(cfg.GoTun.Name())),
 	)
-	dev = device.NewDevice(cfg.GoTun, bind, logger)
-	bind.init(dev)
+	doh := &DoH{Server: cfg.DoH, Client: client}
+	dev = newDevice(device.NewDevice(cfg.GoTun, bind, logger), cfg.GoTun, doh)
+	bind.init(dev.Device)
+	bind.states.resolve = dev.refreshEndpoint
+	dev.states = bind.states
+	dev.paths = bind.paths
+	bind.auth.isPeer = func(pubkey device.NoisePublicKey) bool {
+		return dev.LookupPeer(pubkey) != nil
+	}
+	if relay != nil {
+		relay.Peers = dev.connectedPeers
+	}
+	if server != nil {
+		dev.linkStatus = server.Links
+		if cfg.HA {
+			// 接管订阅之前是 standby
+			bind.standby.Store(true)
+			dev.role.active = false
+			server.OnRole = func(active bool) {
+				bind.standby.Store(!active)
+				dev.setActive(active)
+			}
+		}
+	}
+	registerMetrics(dev, bind)
 
 	ierr = func() (ierr error) { // 设置 WireGuard
 		logger := slog.With(slog.String("act", "configure WireGuard"))
@@ -62,19 +136,22 @@ func Run(cfg Config) (dev *device.Device, ierr error) {
 			logger.Debug("parse successful", "count", count)
 		}, nil)
 		conf := ""
-		s := &DoH{Server: cfg.DoH}
+		locker := &sync.Mutex{}
 		eg := new(errgroup.Group)
 		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 		defer cancel()
 		for _, _p := range cfg.Peers {
 			p := _p
 			eg.Go(func() (ierr error) {
-				peer, ierr := s.ParsePeer(ctx, p)
+				peer, ierr := doh.ParsePeer(ctx, p)
 				if ierr != nil {
 					return
 				}
+				locker.Lock()
+				defer locker.Unlock()
 				conf += peer.String()
 				count++
+				dev.setLink(peer.PublicKey, p)
 				return
 			})
 		}
@@ -120,15 +197,20 @@ func Run(cfg Config) (dev *device.Device, ierr error) {
 	if ierr != nil {
 		return
 	}
-	pf = netip.PrefixFrom(pf.Addr(), 24)
-	ierr = ipconf.AddRoute(cfg.GoTun, pf)
+	dev.ip = pf
+	ierr = ipconf.Recover(cfg.GoTun)
 	if ierr != nil {
 		return
 	}
-	ierr = ipconf.Up(cfg.GoTun)
+	ierr = dev.start()
 	if ierr != nil {
 		return
 	}
 
+	// 网络变化时不等 ICE 超时, 立即做 ICE restart
+	if err := bind.watchNetwork(try.To1(cfg.GoTun.Name())); err != nil {
+		slog.Warn("watch network changes failed", "err", err)
+	}
+
 	return
 }